@@ -1218,6 +1218,40 @@ var _ = Describe("Container Store", func() {
 						}))
 					})
 
+					Context("with a port bypassing the proxy", func() {
+						BeforeEach(func() {
+							runReq.Ports = []executor.PortMapping{
+								{ContainerPort: 8080},
+								{ContainerPort: 9090, DisableContainerProxy: true},
+							}
+							proxyManager.ProxyPortsReturns([]executor.ProxyPortMapping{
+								{AppPort: 8080, ProxyPort: 61001},
+							}, []uint16{61001})
+						})
+
+						It("passes it to NetIn too", func() {
+							container, err := containerStore.Create(logger, containerGuid)
+							Expect(err).NotTo(HaveOccurred())
+
+							containerSpec := gardenClient.CreateArgsForCall(0)
+							Expect(containerSpec.NetIn).To(ConsistOf(
+								garden.NetIn{HostPort: 0, ContainerPort: 9090},
+								garden.NetIn{HostPort: 0, ContainerPort: 61001},
+							))
+
+							Expect(container.Ports).To(ConsistOf(executor.PortMapping{
+								ContainerPort:         8080,
+								HostPort:              0,
+								ContainerTLSProxyPort: 61001,
+								HostTLSProxyPort:      16001,
+							}, executor.PortMapping{
+								ContainerPort:         9090,
+								HostPort:              16004,
+								DisableContainerProxy: true,
+							}))
+						})
+					})
+
 					It("unproxied host ports are set to 0", func() {
 						container, err := containerStore.Create(logger, containerGuid)
 						Expect(err).NotTo(HaveOccurred())
@@ -1,13 +1,72 @@
 package envoy
 
 type Config struct {
-	StatPrefix string `yaml:"stat_prefix"` // envoy.tcp_proxy
-	Cluster    string `yaml:"cluster"`
+	StatPrefix  string       `yaml:"stat_prefix"`
+	Cluster     string       `yaml:"cluster,omitempty"`      // envoy.tcp_proxy
+	RouteConfig *RouteConfig `yaml:"route_config,omitempty"` // envoy.http_connection_manager
+	HTTPFilters []HTTPFilter `yaml:"http_filters,omitempty"`
+	AccessLog   []AccessLog  `yaml:"access_log,omitempty"`
+	IdleTimeout string       `yaml:"idle_timeout,omitempty"`
+}
+
+type AccessLog struct {
+	Name        string                `yaml:"name"`
+	Config      AccessLogConfig       `yaml:"config,omitempty"`
+	TypedConfig *AccessLogTypedConfig `yaml:"typed_config,omitempty"` // v3
+}
+
+type AccessLogConfig struct {
+	Path string `yaml:"path"`
+}
+
+type AccessLogTypedConfig struct {
+	Type string `yaml:"@type"`
+	Path string `yaml:"path"`
+}
+
+type RouteConfig struct {
+	Name         string        `yaml:"name"`
+	VirtualHosts []VirtualHost `yaml:"virtual_hosts"`
+}
+
+type VirtualHost struct {
+	Name    string   `yaml:"name"`
+	Domains []string `yaml:"domains"`
+	Routes  []Route  `yaml:"routes"`
+}
+
+type Route struct {
+	Match RouteMatch  `yaml:"match"`
+	Route RouteAction `yaml:"route"`
+}
+
+type RouteMatch struct {
+	Prefix string `yaml:"prefix"`
+}
+
+type RouteAction struct {
+	Cluster string `yaml:"cluster"`
+}
+
+type HTTPFilter struct {
+	Name        string          `yaml:"name"`
+	TypedConfig *TypedExtension `yaml:"typed_config,omitempty"` // v3
+}
+
+// TypedExtension is the typed_config of a v3 extension without settings.
+type TypedExtension struct {
+	Type string `yaml:"@type"`
 }
 
 type Filter struct {
-	Name   string `yaml:"name"`
-	Config Config `yaml:"config"`
+	Name        string             `yaml:"name"`
+	Config      Config             `yaml:"config,omitempty"`
+	TypedConfig *FilterTypedConfig `yaml:"typed_config,omitempty"` // v3
+}
+
+type FilterTypedConfig struct {
+	Type   string `yaml:"@type"`
+	Config `yaml:",inline"`
 }
 
 type DataSource struct {
@@ -20,18 +79,55 @@ type TLSCertificate struct {
 }
 
 type CertificateValidationContext struct {
-	TrustedCA            DataSource `yaml:"trusted_ca,omitempty"`
-	VerifySubjectAltName []string   `yaml:"verify_subject_alt_name,omitempty"`
+	TrustedCA                 DataSource              `yaml:"trusted_ca,omitempty"`
+	VerifySubjectAltName      []string                `yaml:"verify_subject_alt_name,omitempty"`
+	MatchTypedSubjectAltNames []SubjectAltNameMatcher `yaml:"match_typed_subject_alt_names,omitempty"`
+}
+
+type SubjectAltNameMatcher struct {
+	SanType string        `yaml:"san_type"`
+	Matcher StringMatcher `yaml:"matcher"`
+}
+
+type StringMatcher struct {
+	Exact string `yaml:"exact"`
 }
 
 type CommonTLSContext struct {
-	TLSCertificates   []TLSCertificate             `yaml:"tls_certificates"`
-	TLSParams         TLSParams                    `yaml:"tls_params"`
-	ValidationContext CertificateValidationContext `yaml:"validation_context"`
+	TLSCertificates                []TLSCertificate             `yaml:"tls_certificates,omitempty"`
+	TLSCertificateSDSSecretConfigs []SDSSecretConfig            `yaml:"tls_certificate_sds_secret_configs,omitempty"`
+	TLSParams                      TLSParams                    `yaml:"tls_params"`
+	ValidationContext              CertificateValidationContext `yaml:"validation_context,omitempty"`
+}
+
+type SDSSecretConfig struct {
+	Name      string    `yaml:"name"`
+	SDSConfig SDSConfig `yaml:"sds_config"`
+}
+
+type SDSConfig struct {
+	APIConfigSource    APIConfigSource `yaml:"api_config_source"`
+	ResourceAPIVersion string          `yaml:"resource_api_version,omitempty"`
+}
+
+type APIConfigSource struct {
+	APIType             string        `yaml:"api_type"`
+	TransportAPIVersion string        `yaml:"transport_api_version,omitempty"`
+	GRPCServices        []GRPCService `yaml:"grpc_services"`
+}
+
+type GRPCService struct {
+	EnvoyGRPC EnvoyGRPC `yaml:"envoy_grpc"`
+}
+
+type EnvoyGRPC struct {
+	ClusterName string `yaml:"cluster_name"`
 }
 
 type TLSParams struct {
-	CipherSuites string `yaml:"cipher_suites"`
+	CipherSuites              string `yaml:"cipher_suites"`
+	TLSMinimumProtocolVersion string `yaml:"tls_minimum_protocol_version,omitempty"`
+	TLSMaximumProtocolVersion string `yaml:"tls_maximum_protocol_version,omitempty"`
 }
 
 type TLSContext struct {
@@ -39,9 +135,36 @@ type TLSContext struct {
 	RequireClientCertificate bool             `yaml:"require_client_certificate"`
 }
 
+type FilterChainMatch struct {
+	ServerNames  []string    `yaml:"server_names,omitempty"`
+	PrefixRanges []CIDRRange `yaml:"prefix_ranges,omitempty"`
+}
+
+type CIDRRange struct {
+	AddressPrefix string `yaml:"address_prefix"`
+	PrefixLen     uint32 `yaml:"prefix_len"`
+}
+
+type ListenerFilter struct {
+	Name        string          `yaml:"name"`
+	TypedConfig *TypedExtension `yaml:"typed_config,omitempty"` // v3
+}
+
 type FilterChain struct {
-	Filters    []Filter   `yaml:"filters"`
-	TLSContext TLSContext `yaml:"tls_context"`
+	FilterChainMatch *FilterChainMatch `yaml:"filter_chain_match,omitempty"`
+	Filters          []Filter          `yaml:"filters"`
+	TLSContext       TLSContext        `yaml:"tls_context,omitempty"`
+	TransportSocket  *TransportSocket  `yaml:"transport_socket,omitempty"` // v3
+}
+
+type TransportSocket struct {
+	Name        string               `yaml:"name"`
+	TypedConfig DownstreamTLSContext `yaml:"typed_config"`
+}
+
+type DownstreamTLSContext struct {
+	Type       string `yaml:"@type"`
+	TLSContext `yaml:",inline"`
 }
 
 type Resource struct {
@@ -49,6 +172,11 @@ type Resource struct {
 	Name         string        `yaml:"name"`
 	Address      Address       `yaml:"address"`
 	FilterChains []FilterChain `yaml:"filter_chains"`
+	ReusePort    bool          `yaml:"reuse_port,omitempty"`
+
+	ListenerFilters []ListenerFilter `yaml:"listener_filters,omitempty"`
+
+	PerConnectionBufferLimitBytes uint32 `yaml:"per_connection_buffer_limit_bytes,omitempty"`
 }
 
 type ListenerConfig struct {
@@ -61,8 +189,13 @@ type SocketAddress struct {
 	PortValue uint16 `yaml:"port_value"`
 }
 
+type Pipe struct {
+	Path string `yaml:"path"`
+}
+
 type Address struct {
-	SocketAddress SocketAddress `yaml:"socket_address"`
+	SocketAddress SocketAddress `yaml:"socket_address,omitempty"`
+	Pipe          *Pipe         `yaml:"pipe,omitempty"`
 }
 
 type Admin struct {
@@ -71,7 +204,9 @@ type Admin struct {
 }
 
 type Threshold struct {
-	MaxConnections uint32 `yaml:"max_connections"`
+	MaxConnections     uint32 `yaml:"max_connections"`
+	MaxPendingRequests uint32 `yaml:"max_pending_requests,omitempty"`
+	MaxRequests        uint32 `yaml:"max_requests,omitempty"`
 }
 
 type CircuitBreakers struct {
@@ -83,8 +218,49 @@ type Cluster struct {
 	ConnectionTimeout string          `yaml:"connect_timeout"`
 	Type              string          `yaml:"type"`
 	LbPolicy          string          `yaml:"lb_policy"`
-	Hosts             []Address       `yaml:"hosts"`
-	CircuitBreakers   CircuitBreakers `yaml:"circuit_breakers"`
+	Hosts             []Address       `yaml:"hosts,omitempty"`
+	CircuitBreakers   CircuitBreakers `yaml:"circuit_breakers,omitempty"`
+
+	LoadAssignment *ClusterLoadAssignment `yaml:"load_assignment,omitempty"` // v3
+
+	UpstreamConnectionOptions *UpstreamConnectionOptions `yaml:"upstream_connection_options,omitempty"`
+	OutlierDetection          *OutlierDetection          `yaml:"outlier_detection,omitempty"`
+	HTTP2ProtocolOptions      *HTTP2ProtocolOptions      `yaml:"http2_protocol_options,omitempty"`
+}
+
+type HTTP2ProtocolOptions struct{}
+
+type OutlierDetection struct {
+	Consecutive5xx            uint32 `yaml:"consecutive_5xx,omitempty"`
+	ConsecutiveGatewayFailure uint32 `yaml:"consecutive_gateway_failure,omitempty"`
+	BaseEjectionTime          string `yaml:"base_ejection_time,omitempty"`
+}
+
+type ClusterLoadAssignment struct {
+	ClusterName string                `yaml:"cluster_name"`
+	Endpoints   []LocalityLbEndpoints `yaml:"endpoints"`
+}
+
+type LocalityLbEndpoints struct {
+	LbEndpoints []LbEndpoint `yaml:"lb_endpoints"`
+}
+
+type LbEndpoint struct {
+	Endpoint Endpoint `yaml:"endpoint"`
+}
+
+type Endpoint struct {
+	Address Address `yaml:"address"`
+}
+
+type UpstreamConnectionOptions struct {
+	TCPKeepalive TCPKeepalive `yaml:"tcp_keepalive"`
+}
+
+type TCPKeepalive struct {
+	KeepaliveProbes   uint32 `yaml:"keepalive_probes,omitempty"`
+	KeepaliveTime     uint32 `yaml:"keepalive_time,omitempty"`     // seconds
+	KeepaliveInterval uint32 `yaml:"keepalive_interval,omitempty"` // seconds
 }
 
 type StaticResources struct {
@@ -92,14 +268,28 @@ type StaticResources struct {
 }
 
 type LDSConfig struct {
-	Path string `yaml:"path"`
+	Path               string `yaml:"path"`
+	ResourceAPIVersion string `yaml:"resource_api_version,omitempty"`
 }
 
 type DynamicResources struct {
 	LDSConfig LDSConfig `yaml:"lds_config"`
 }
 
+type Locality struct {
+	Region  string `yaml:"region,omitempty"`
+	Zone    string `yaml:"zone,omitempty"`
+	SubZone string `yaml:"sub_zone,omitempty"`
+}
+
+type Node struct {
+	Id       string            `yaml:"id"`
+	Locality *Locality         `yaml:"locality,omitempty"`
+	Metadata map[string]string `yaml:"metadata,omitempty"`
+}
+
 type ProxyConfig struct {
+	Node             *Node            `yaml:"node,omitempty"`
 	Admin            Admin            `yaml:"admin"`
 	StaticResources  StaticResources  `yaml:"static_resources"`
 	DynamicResources DynamicResources `yaml:"dynamic_resources"`
@@ -0,0 +1,9 @@
+package containerstore
+
+// WithRename replaces os.Rename for moving written config files into place,
+// so filesystem failures can be simulated.
+func WithRename(rename func(oldpath, newpath string) error) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.rename = rename
+	}
+}
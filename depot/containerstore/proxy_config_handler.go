@@ -2,19 +2,39 @@ package containerstore
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
 	"math"
+	"math/big"
+	"math/rand"
+	"net"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	multierror "github.com/hashicorp/go-multierror"
 	"github.com/tedsuo/ifrit"
 	yaml "gopkg.in/yaml.v2"
 
 	"code.cloudfoundry.org/clock"
+	loggingclient "code.cloudfoundry.org/diego-logging-client"
 	"code.cloudfoundry.org/executor"
 	"code.cloudfoundry.org/executor/depot/containerstore/envoy"
 	"code.cloudfoundry.org/garden"
@@ -25,21 +45,102 @@ const (
 	StartProxyPort = 61001
 	EndProxyPort   = 65534
 
-	TimeOut    = "0.25s"
-	Static     = "STATIC"
-	RoundRobin = "ROUND_ROBIN"
+	TimeOut       = "0.25s"
+	Static        = "STATIC"
+	StrictDNS     = "STRICT_DNS"
+	OriginalDst   = "ORIGINAL_DST"
+	RoundRobin    = "ROUND_ROBIN"
+	OriginalDstLb = "ORIGINAL_DST_LB"
 
 	IngressListener = "ingress_listener"
 	TcpProxy        = "envoy.tcp_proxy"
 
-	AdminAccessLog = "/dev/null"
+	SDSCluster = "sds-grpc"
+	GRPC       = "GRPC"
+
+	EgressListener            = "egress-listener"
+	EgressCluster             = "egress-original-dst"
+	EgressBindAddress         = "127.0.0.1"
+	OriginalDstListenerFilter = "envoy.listener.original_dst"
+
+	DefaultListenerBindAddress = "0.0.0.0"
+
+	HttpConnectionManager = "envoy.http_connection_manager"
+	HttpRouter            = "envoy.router"
+	FileAccessLog         = "envoy.file_access_log"
+
+	ListenerType = "type.googleapis.com/envoy.api.v2.Listener"
+
+	// names and type urls of the v3 api, used with WithEnvoyAPIV3
+	ListenerTypeV3              = "type.googleapis.com/envoy.config.listener.v3.Listener"
+	TcpProxyV3                  = "envoy.filters.network.tcp_proxy"
+	TcpProxyTypeV3              = "type.googleapis.com/envoy.extensions.filters.network.tcp_proxy.v3.TcpProxy"
+	HttpConnectionManagerV3     = "envoy.filters.network.http_connection_manager"
+	HttpConnectionManagerTypeV3 = "type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager"
+	HttpRouterV3                = "envoy.filters.http.router"
+	HttpRouterTypeV3            = "type.googleapis.com/envoy.extensions.filters.http.router.v3.Router"
+	FileAccessLogV3             = "envoy.access_loggers.file"
+	FileAccessLogTypeV3         = "type.googleapis.com/envoy.extensions.access_loggers.file.v3.FileAccessLog"
+	TLSTransportSocketV3        = "envoy.transport_sockets.tls"
+	DownstreamTLSContextTypeV3  = "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext"
+	ResourceAPIVersionV3        = "V3"
+	ClusterProvidedLbV3         = "CLUSTER_PROVIDED"
+	OriginalDstListenerFilterV3 = "envoy.filters.listener.original_dst"
+	OriginalDstTypeV3           = "type.googleapis.com/envoy.extensions.filters.listener.original_dst.v3.OriginalDst"
+
+	AdminAccessLog  = "/dev/null"
+	StdoutAccessLog = "/dev/stdout"
+
+	DefaultConfigFileMode os.FileMode = 0666
+
+	ContainerProxyConfigMountPath = "/etc/cf-assets/envoy_config"
+
+	BatchUpdateWorkers = 8
+
+	// renaming a written config file into place is retried this often, with
+	// the interval doubling after every attempt, when the rename fails with
+	// EBUSY as it does on some overlay filesystems
+	RenameAttempts      = 4
+	RenameRetryInterval = 10 * time.Millisecond
+
+	AppGuidNodeMetadataKey     = "app_guid"
+	ProcessGuidNodeMetadataKey = "process_guid"
+
+	ContainerProxyConfigWriteSucceededDuration = "ContainerProxyConfigWriteSucceededDuration"
+	ContainerProxyConfigWriteFailedDuration    = "ContainerProxyConfigWriteFailedDuration"
 )
 
 var (
 	ErrNoPortsAvailable   = errors.New("no ports available")
 	ErrInvalidCertificate = errors.New("cannot parse invalid certificate")
+	ErrConfigDirNotFound  = errors.New("proxy config directory not found")
 
 	SupportedCipherSuites = "[ECDHE-RSA-AES256-GCM-SHA384|ECDHE-RSA-AES128-GCM-SHA256]"
+
+	serviceClusterName = regexp.MustCompile(`^\d+-service-cluster$`)
+
+	validLbPolicies = map[string]bool{
+		"ROUND_ROBIN":   true,
+		"LEAST_REQUEST": true,
+		"RING_HASH":     true,
+		"RANDOM":        true,
+		"MAGLEV":        true,
+	}
+
+	validSubjectAltNameTypes = map[string]bool{
+		"DNS":        true,
+		"URI":        true,
+		"EMAIL":      true,
+		"IP_ADDRESS": true,
+	}
+
+	validTLSProtocolVersions = map[string]bool{
+		"TLS_AUTO": true,
+		"TLSv1_0":  true,
+		"TLSv1_1":  true,
+		"TLSv1_2":  true,
+		"TLSv1_3":  true,
+	}
 )
 
 var dummyRunner = func(credRotatedChan <-chan Credential) ifrit.Runner {
@@ -64,7 +165,502 @@ type ProxyConfigHandler struct {
 	containerProxyRequireClientCerts   bool
 
 	reloadDuration time.Duration
+	drainDuration  time.Duration
 	reloadClock    clock.Clock
+
+	// reloadJitterLock protects reloadJitterRand, which is shared by the
+	// concurrent Close calls of all containers
+	reloadJitter     float64
+	reloadJitterLock sync.Mutex
+	reloadJitterRand *rand.Rand
+
+	// debounceLock protects debouncedUpdates, which holds the containers
+	// whose config was written less than updateDebounce ago
+	updateDebounce   time.Duration
+	debounceLock     sync.Mutex
+	debouncedUpdates map[string]*debouncedUpdate
+
+	// containerLocksLock protects containerLocks, which holds a lock per
+	// container serializing the writes to its config files
+	containerLocksLock sync.Mutex
+	containerLocks     map[string]*sync.Mutex
+
+	metronClient loggingclient.IngressClient
+
+	configWrittenHook func(executor.Container)
+
+	trustedCACertsFile    string
+	adminAccessLogPath    string
+	adminSocketPath       string
+	listenerAccessLogPath string
+	cipherSuites          []string
+	tlsMinimumVersion     string
+	tlsMaximumVersion     string
+	connectTimeout        time.Duration
+	idleTimeout           time.Duration
+
+	maxConnections     uint32
+	maxPendingRequests uint32
+	maxRequests        uint32
+
+	lbPolicy string
+
+	keepaliveProbes   uint32
+	keepaliveTime     time.Duration
+	keepaliveInterval time.Duration
+
+	consecutive5xx            uint32
+	consecutiveGatewayFailure uint32
+	baseEjectionTime          time.Duration
+
+	startProxyPort uint16
+	endProxyPort   uint16
+
+	deterministicProxyPorts bool
+	httpConnectionManager   bool
+	stableStatPrefixes      bool
+	reusePort               bool
+	drainOnClose            bool
+
+	listenerConfigFileMode os.FileMode
+	proxyConfigFileMode    os.FileMode
+
+	compressProxyConfig bool
+
+	rename func(oldpath, newpath string) error
+
+	sniCertificates []SNICertificate
+
+	typedSubjectAltNames []TypedSubjectAltName
+
+	sdsServerAddress string
+	sdsServerPort    uint16
+
+	egressPort  uint16
+	egressCIDRs []string
+
+	originalDstListenerFilter bool
+
+	omitSDSCircuitBreakers bool
+	sdsMaxConnections      uint32
+	sdsMaxPendingRequests  uint32
+	sdsMaxRequests         uint32
+
+	stdoutAccessLog bool
+
+	canonicalTCPProxyName bool
+
+	nodeLocality envoy.Locality
+	nodeMetadata map[string]string
+
+	listenerBindAddress string
+
+	perConnectionBufferLimitBytes uint32
+
+	envoyAPIV3 bool
+}
+
+// SNICertificate is a certificate the proxy listeners present to clients
+// that request one of its server names.
+type SNICertificate struct {
+	ServerNames []string
+	Cert        string
+	Key         string
+}
+
+// TypedSubjectAltName is a subject alt name of the given type, i.e. DNS, URI,
+// EMAIL or IP_ADDRESS, that client certificates are verified against. SPIFFE
+// ids are URI subject alt names.
+type TypedSubjectAltName struct {
+	Type    string
+	Matcher string
+}
+
+// ContainerCredential is the credential to update the proxy config of a
+// container with.
+type ContainerCredential struct {
+	Credential Credential
+	Container  executor.Container
+}
+
+type ProxyConfigHandlerOption func(*ProxyConfigHandler)
+
+type debouncedUpdate struct {
+	// writeLock serializes the writes of the container
+	writeLock sync.Mutex
+	pending   *ContainerCredential
+	done      chan struct{}
+}
+
+// WithMetronClient makes the handler report how long writing the proxy
+// config of a container takes.
+func WithMetronClient(metronClient loggingclient.IngressClient) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.metronClient = metronClient
+	}
+}
+
+// WithConfigWrittenHook calls hook with the container every time its proxy
+// config has been written successfully, e.g. to signal an external reloader.
+func WithConfigWrittenHook(hook func(executor.Container)) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.configWrittenHook = hook
+	}
+}
+
+// WithTrustedCACertsFile makes the handler read the CA certificates trusted
+// to sign client certificates from a PEM bundle on every Update instead of
+// using the certificates it was created with, so a rotated bundle is picked
+// up with the next credential rotation.
+func WithTrustedCACertsFile(path string) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.trustedCACertsFile = path
+	}
+}
+
+// WithAdminAccessLogPath sets the path envoy writes admin interface access
+// logs to. Paths under the envoy config mount are created in the
+// per-container config directory.
+func WithAdminAccessLogPath(path string) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.adminAccessLogPath = path
+	}
+}
+
+// WithListenerAccessLogPath makes each proxy listener filter log its
+// connections to the given file. Paths under the envoy config mount are
+// created in the per-container config directory.
+func WithListenerAccessLogPath(path string) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.listenerAccessLogPath = path
+	}
+}
+
+// WithAdminSocketPath binds the envoy admin interface to a unix domain socket
+// instead of a port from the proxy port range. Paths under the envoy config
+// mount are created in the per-container config directory.
+func WithAdminSocketPath(path string) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.adminSocketPath = path
+	}
+}
+
+// WithTLSProtocolVersions bounds the TLS protocol versions accepted by the
+// proxy listeners, e.g. "TLSv1_2". Empty bounds are left to envoy.
+func WithTLSProtocolVersions(minimum, maximum string) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.tlsMinimumVersion = minimum
+		p.tlsMaximumVersion = maximum
+	}
+}
+
+// WithConnectTimeout sets the connect timeout of the service clusters. A
+// zero duration keeps the default of 250ms.
+func WithConnectTimeout(connectTimeout time.Duration) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.connectTimeout = connectTimeout
+	}
+}
+
+// WithIdleTimeout makes the proxy listeners close connections without
+// activity for the given duration. A zero duration never closes them.
+func WithIdleTimeout(idleTimeout time.Duration) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.idleTimeout = idleTimeout
+	}
+}
+
+// WithCircuitBreakerThresholds caps the connections and requests envoy lets
+// through to the service clusters. A zero maxConnections leaves connections
+// unlimited, zero request limits are left to envoy.
+func WithCircuitBreakerThresholds(maxConnections, maxPendingRequests, maxRequests uint32) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.maxConnections = maxConnections
+		p.maxPendingRequests = maxPendingRequests
+		p.maxRequests = maxRequests
+	}
+}
+
+// WithUpdateDebounce coalesces the Updates of a container that follow its
+// last write within window: only the latest of them is written once the
+// window has passed. A zero window writes on every Update.
+func WithUpdateDebounce(window time.Duration) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.updateDebounce = window
+	}
+}
+
+// WithLbPolicy sets the load balancing policy of the service clusters to one
+// of envoy's policy names, e.g. LEAST_REQUEST. It defaults to ROUND_ROBIN.
+func WithLbPolicy(lbPolicy string) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.lbPolicy = lbPolicy
+	}
+}
+
+// WithTCPKeepalive enables TCP keepalive on the connections envoy opens to
+// the service clusters. Zero values are left to the kernel defaults and
+// durations are rounded down to whole seconds.
+func WithTCPKeepalive(probes uint32, keepaliveTime, interval time.Duration) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.keepaliveProbes = probes
+		p.keepaliveTime = keepaliveTime
+		p.keepaliveInterval = interval
+	}
+}
+
+// WithOutlierDetection makes envoy eject hosts of the service clusters
+// after the given number of consecutive errors. With envoy.tcp_proxy failed
+// connections count as such errors. Zero values are left to envoy.
+func WithOutlierDetection(consecutive5xx, consecutiveGatewayFailure uint32, baseEjectionTime time.Duration) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.consecutive5xx = consecutive5xx
+		p.consecutiveGatewayFailure = consecutiveGatewayFailure
+		p.baseEjectionTime = baseEjectionTime
+	}
+}
+
+// WithListenerBindAddress binds the proxy listeners to the given ip instead
+// of DefaultListenerBindAddress, e.g. to expose them on the overlay interface
+// only.
+func WithListenerBindAddress(address string) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.listenerBindAddress = address
+	}
+}
+
+// WithProxyPortRange sets the range, with an exclusive end, that proxy
+// listener and admin ports are allocated from instead of
+// StartProxyPort-EndProxyPort.
+func WithProxyPortRange(start, end uint16) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.startProxyPort = start
+		p.endProxyPort = end
+	}
+}
+
+// WithDeterministicProxyPorts derives each proxy port from a hash of its app
+// port, so an app port keeps its proxy port when other container ports are
+// added, removed or reordered. Collisions fall back to linear assignment.
+func WithDeterministicProxyPorts(enabled bool) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.deterministicProxyPorts = enabled
+	}
+}
+
+// WithHTTPConnectionManager makes the proxy listeners terminate HTTP with an
+// envoy.http_connection_manager filter routing all requests to the service
+// cluster, instead of forwarding raw TCP with envoy.tcp_proxy.
+func WithHTTPConnectionManager(enabled bool) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.httpConnectionManager = enabled
+	}
+}
+
+// WithStableStatPrefixes names listener stats "<container guid>-<app port>"
+// instead of after the position of the port in container.Ports, so they can
+// be correlated across restarts that reorder the ports.
+func WithStableStatPrefixes(enabled bool) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.stableStatPrefixes = enabled
+	}
+}
+
+// WithReusePort sets SO_REUSEPORT on the proxy listeners so the kernel
+// balances accepted connections across the envoy workers.
+func WithReusePort(enabled bool) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.reusePort = enabled
+	}
+}
+
+// WithPerConnectionBufferLimit caps the read and write buffers envoy keeps
+// for each connection to a proxy listener. Zero leaves the limit to envoy.
+func WithPerConnectionBufferLimit(bytes uint32) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.perConnectionBufferLimitBytes = bytes
+	}
+}
+
+// WithEnvoyAPIV3 generates the proxy config for the v3 xDS api, for envoys
+// that no longer accept v2 config. The v2 api is used by default.
+func WithEnvoyAPIV3(enabled bool) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.envoyAPIV3 = enabled
+	}
+}
+
+// WithReloadJitter randomly lengthens or shortens the wait for envoy to reload
+// its config on Close by up to the given fraction of the reload duration, so
+// the containers of a mass rotation don't all finish draining at once. The
+// jitter is drawn from source, or from a time seeded source when it is nil.
+func WithReloadJitter(jitter float64, source rand.Source) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		if source == nil {
+			source = rand.NewSource(time.Now().UnixNano())
+		}
+		p.reloadJitter = jitter
+		p.reloadJitterRand = rand.New(source)
+	}
+}
+
+// WithDrainOnClose makes Close first remove the proxy listeners and wait for
+// the drain duration, so envoy refuses new connections while the open ones
+// finish, before it writes the invalid credentials and waits for the reload.
+func WithDrainOnClose(enabled bool) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.drainOnClose = enabled
+	}
+}
+
+// WithDrainDuration sets how long Close waits for the connections of the
+// removed listeners to drain, before it writes the invalid credentials, when
+// drain on close is enabled. It defaults to the reload duration.
+func WithDrainDuration(drainDuration time.Duration) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.drainDuration = drainDuration
+	}
+}
+
+// WithConfigFileModes sets the modes listeners.yaml, which inlines the
+// private key, and envoy.yaml are created with. Both default to
+// DefaultConfigFileMode.
+func WithConfigFileModes(listenerConfigMode, proxyConfigMode os.FileMode) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.listenerConfigFileMode = listenerConfigMode
+		p.proxyConfigFileMode = proxyConfigMode
+	}
+}
+
+// WithCompressedProxyConfig writes the proxy config gzipped to envoy.yaml.gz
+// instead of envoy.yaml, for config mounts short on space. Whatever starts
+// envoy has to decompress it.
+func WithCompressedProxyConfig(enabled bool) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.compressProxyConfig = enabled
+	}
+}
+
+// WithCipherSuites overrides the cipher suites offered by the proxy
+// listeners. An empty list keeps SupportedCipherSuites.
+func WithCipherSuites(cipherSuites []string) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.cipherSuites = cipherSuites
+	}
+}
+
+// WithSNICertificates adds a filter chain per certificate to each proxy
+// listener, matched on the server names of the certificate. Connections
+// matching none of them are served the container credentials.
+func WithSNICertificates(certificates []SNICertificate) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.sniCertificates = certificates
+	}
+}
+
+// WithTypedSubjectAltNames verifies client certificates against subject alt
+// names of explicit types instead of the untyped subject alt names the handler
+// was created with. Subject alt names set on the container still take
+// precedence.
+func WithTypedSubjectAltNames(subjectAltNames []TypedSubjectAltName) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.typedSubjectAltNames = subjectAltNames
+	}
+}
+
+// WithSDSServer makes envoy fetch the container credentials from the SDS gRPC
+// server at address and port, instead of inlining them in the listener config.
+// The secret is named after the container guid.
+func WithSDSServer(address string, port uint16) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.sdsServerAddress = address
+		p.sdsServerPort = port
+	}
+}
+
+// WithEgressAllowlist adds an egress listener on port of the container
+// loopback that forwards connections to their original destination, but only
+// when it is in one of the cidrs. Connections to other destinations are
+// closed. The container traffic has to be redirected to the port, e.g. by
+// iptables.
+func WithEgressAllowlist(port uint16, cidrs []string) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.egressPort = port
+		p.egressCIDRs = cidrs
+	}
+}
+
+// WithOriginalDstListenerFilter adds the original_dst listener filter to the
+// proxy listeners, so envoy recovers the destination of connections
+// redirected to them, e.g. by iptables.
+func WithOriginalDstListenerFilter(enabled bool) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.originalDstListenerFilter = enabled
+	}
+}
+
+// WithSDSClusterCircuitBreakers controls whether the SDS cluster gets a
+// circuit breakers block at all. It is enabled by default.
+func WithSDSClusterCircuitBreakers(enabled bool) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.omitSDSCircuitBreakers = !enabled
+	}
+}
+
+// WithSDSClusterCircuitBreakerThresholds caps the connections and requests
+// envoy lets through to the SDS cluster, like WithCircuitBreakerThresholds
+// does for the service clusters.
+func WithSDSClusterCircuitBreakerThresholds(maxConnections, maxPendingRequests, maxRequests uint32) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.sdsMaxConnections = maxConnections
+		p.sdsMaxPendingRequests = maxPendingRequests
+		p.sdsMaxRequests = maxRequests
+	}
+}
+
+// WithStdoutAccessLog makes each proxy listener filter also log its
+// connections to stdout, so they end up in the log stream of the envoy
+// process. It can be combined with WithListenerAccessLogPath.
+func WithStdoutAccessLog(enabled bool) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.stdoutAccessLog = enabled
+	}
+}
+
+// WithCanonicalTCPProxyName names the tcp proxy filters
+// envoy.filters.network.tcp_proxy instead of the legacy envoy.tcp_proxy,
+// which recent envoy versions warn about.
+func WithCanonicalTCPProxyName(enabled bool) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.canonicalTCPProxyName = enabled
+	}
+}
+
+// WithNodeLocality sets the locality envoy reports for its node. Empty
+// values are omitted.
+func WithNodeLocality(region, zone, subZone string) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.nodeLocality = envoy.Locality{Region: region, Zone: zone, SubZone: subZone}
+	}
+}
+
+// WithNodeMetadata sets metadata envoy reports for its node.
+func WithNodeMetadata(metadata map[string]string) ProxyConfigHandlerOption {
+	return func(p *ProxyConfigHandler) {
+		p.nodeMetadata = metadata
+	}
+}
+
+//go:generate counterfeiter -o containerstorefakes/fake_proxy_config_manager.go . ProxyConfigManager
+
+// ProxyConfigManager is implemented by both ProxyConfigHandler and
+// NoopProxyConfigHandler, so callers can swap them or inject a fake.
+type ProxyConfigManager interface {
+	ProxyManager
+
+	AdminPort(logger lager.Logger, container executor.Container) (uint16, error)
+	Runner(logger lager.Logger, container executor.Container, credRotatedChan <-chan Credential) (ifrit.Runner, error)
+	RemoveProxyConfigDir(logger lager.Logger, container executor.Container) error
 }
 
 type NoopProxyConfigHandler struct{}
@@ -86,10 +682,26 @@ func (p *NoopProxyConfigHandler) RemoveProxyConfigDir(logger lager.Logger, conta
 	return nil
 }
 
+func (p *NoopProxyConfigHandler) ConfigFiles(executor.Container) []string {
+	return nil
+}
+
 func (p *NoopProxyConfigHandler) ProxyPorts(lager.Logger, *executor.Container) ([]executor.ProxyPortMapping, []uint16) {
 	return nil, nil
 }
 
+func (p *NoopProxyConfigHandler) AdminPort(lager.Logger, executor.Container) (uint16, error) {
+	return 0, nil
+}
+
+func (p *NoopProxyConfigHandler) ConfigStats(executor.Container) (int, int, int, error) {
+	return 0, 0, 0, nil
+}
+
+func (p *NoopProxyConfigHandler) GenerateConfig(Credential, executor.Container) ([]byte, error) {
+	return nil, nil
+}
+
 func (p *NoopProxyConfigHandler) Runner(logger lager.Logger, container executor.Container, credRotatedChan <-chan Credential) (ifrit.Runner, error) {
 	return dummyRunner(credRotatedChan), nil
 }
@@ -107,8 +719,9 @@ func NewProxyConfigHandler(
 	containerProxyRequireClientCerts bool,
 	reloadDuration time.Duration,
 	reloadClock clock.Clock,
+	opts ...ProxyConfigHandlerOption,
 ) *ProxyConfigHandler {
-	return &ProxyConfigHandler{
+	p := &ProxyConfigHandler{
 		logger:                             logger.Session("proxy-manager"),
 		containerProxyPath:                 containerProxyPath,
 		containerProxyConfigPath:           containerProxyConfigPath,
@@ -117,7 +730,30 @@ func NewProxyConfigHandler(
 		containerProxyRequireClientCerts:   containerProxyRequireClientCerts,
 		reloadDuration:                     reloadDuration,
 		reloadClock:                        reloadClock,
+		adminAccessLogPath:                 AdminAccessLog,
+		startProxyPort:                     StartProxyPort,
+		endProxyPort:                       EndProxyPort,
+		listenerConfigFileMode:             DefaultConfigFileMode,
+		proxyConfigFileMode:                DefaultConfigFileMode,
+		listenerBindAddress:                DefaultListenerBindAddress,
+		debouncedUpdates:                   make(map[string]*debouncedUpdate),
+		containerLocks:                     make(map[string]*sync.Mutex),
+		rename:                             os.Rename,
+	}
+
+	for _, o := range opts {
+		o(p)
+	}
+
+	if p.adminAccessLogPath == "" {
+		p.adminAccessLogPath = AdminAccessLog
+	}
+
+	if p.drainDuration == 0 {
+		p.drainDuration = p.reloadDuration
 	}
+
+	return p
 }
 
 // This modifies the container pointer in order to create garden NetIn rules in the storenode.Create
@@ -126,20 +762,87 @@ func (p *ProxyConfigHandler) ProxyPorts(logger lager.Logger, container *executor
 		return nil, nil
 	}
 
-	proxyPortMapping := []executor.ProxyPortMapping{}
+	logger = logger.Session("proxy-ports", lager.Data{"container-guid": container.Guid})
 
 	existingPorts := make(map[uint16]interface{})
-	containerPorts := make([]uint16, len(container.Ports))
-	for i, portMap := range container.Ports {
+	for _, portMap := range container.Ports {
 		existingPorts[portMap.ContainerPort] = struct{}{}
-		containerPorts[i] = portMap.ContainerPort
 	}
+	containerPorts := proxiedPorts(container)
+
+	var proxyPortMapping []executor.ProxyPortMapping
+	var extraPorts []uint16
+	if p.deterministicProxyPorts {
+		proxyPortMapping, extraPorts = p.deterministicProxyPortMapping(existingPorts, containerPorts)
+	} else {
+		proxyPortMapping, extraPorts = p.linearProxyPortMapping(existingPorts, containerPorts)
+	}
+
+	// return the mappings ordered by app port so callers building NetIn rules
+	// get the same order regardless of the order of container.Ports
+	sort.Slice(proxyPortMapping, func(i, j int) bool {
+		return proxyPortMapping[i].AppPort < proxyPortMapping[j].AppPort
+	})
+	for i, mapping := range proxyPortMapping {
+		extraPorts[i] = mapping.ProxyPort
+	}
+
+	for _, mapping := range proxyPortMapping {
+		logger.Debug("assigned-proxy-port", lager.Data{"app-port": mapping.AppPort, "proxy-port": mapping.ProxyPort})
+	}
+	logger.Info("assigned-proxy-ports", lager.Data{"count": len(proxyPortMapping)})
+
+	if len(proxyPortMapping) < len(containerPorts) {
+		logger.Error("failed-to-assign-all-proxy-ports", ErrNoPortsAvailable, lager.Data{
+			"requested": len(containerPorts),
+			"assigned":  len(proxyPortMapping),
+		})
+	}
+
+	return proxyPortMapping, extraPorts
+}
+
+// AllProxyPorts is like ProxyPorts, but returns ErrNoPortsAvailable instead
+// of a partial mapping when the proxy port range has no room for a proxy port
+// for every container port.
+func (p *ProxyConfigHandler) AllProxyPorts(logger lager.Logger, container *executor.Container) ([]executor.ProxyPortMapping, []uint16, error) {
+	proxyPortMapping, extraPorts := p.ProxyPorts(logger, container)
+	if !container.EnableContainerProxy {
+		return proxyPortMapping, extraPorts, nil
+	}
+
+	if len(proxyPortMapping) < len(proxiedPorts(container)) {
+		return nil, nil, ErrNoPortsAvailable
+	}
+
+	return proxyPortMapping, extraPorts, nil
+}
+
+// proxiedPorts returns the distinct container ports that get a proxy port,
+// in the order of container.Ports.
+func proxiedPorts(container *executor.Container) []uint16 {
+	seen := make(map[uint16]struct{})
+	containerPorts := []uint16{}
+	for _, portMap := range container.Ports {
+		if portMap.DisableContainerProxy {
+			continue
+		}
+		if _, ok := seen[portMap.ContainerPort]; ok {
+			continue
+		}
+		seen[portMap.ContainerPort] = struct{}{}
+		containerPorts = append(containerPorts, portMap.ContainerPort)
+	}
+	return containerPorts
+}
 
+func (p *ProxyConfigHandler) linearProxyPortMapping(existingPorts map[uint16]interface{}, containerPorts []uint16) ([]executor.ProxyPortMapping, []uint16) {
+	proxyPortMapping := []executor.ProxyPortMapping{}
 	extraPorts := []uint16{}
 
 	portCount := 0
-	for port := uint16(StartProxyPort); port < EndProxyPort; port++ {
-		if portCount == len(existingPorts) {
+	for port := p.startProxyPort; port < p.endProxyPort; port++ {
+		if portCount == len(containerPorts) {
 			break
 		}
 
@@ -159,32 +862,184 @@ func (p *ProxyConfigHandler) ProxyPorts(logger lager.Logger, container *executor
 	return proxyPortMapping, extraPorts
 }
 
-func (p *ProxyConfigHandler) CreateDir(logger lager.Logger, container executor.Container) ([]garden.BindMount, []executor.EnvironmentVariable, error) {
-	if !container.EnableContainerProxy {
-		return nil, nil, nil
+func (p *ProxyConfigHandler) deterministicProxyPortMapping(existingPorts map[uint16]interface{}, containerPorts []uint16) ([]executor.ProxyPortMapping, []uint16) {
+	appPorts := make([]int, 0, len(containerPorts))
+	for _, port := range containerPorts {
+		appPorts = append(appPorts, int(port))
 	}
+	// assign in app port order so collisions resolve the same way regardless
+	// of the order of container.Ports
+	sort.Ints(appPorts)
 
-	logger.Info("adding-container-proxy-bindmounts")
-	proxyConfigDir := filepath.Join(p.containerProxyConfigPath, container.Guid)
-	mounts := []garden.BindMount{
-		{
-			Origin:  garden.BindMountOriginHost,
-			SrcPath: p.containerProxyPath,
-			DstPath: "/etc/cf-assets/envoy",
-		},
-		{
-			Origin:  garden.BindMountOriginHost,
-			SrcPath: proxyConfigDir,
-			DstPath: "/etc/cf-assets/envoy_config",
-		},
+	proxyPortMapping := []executor.ProxyPortMapping{}
+	extraPorts := []uint16{}
+	usedPorts := make(map[uint16]struct{})
+
+	isFree := func(port uint16) bool {
+		if existingPorts[port] != nil {
+			return false
+		}
+		_, used := usedPorts[port]
+		return !used
 	}
 
-	err := os.MkdirAll(proxyConfigDir, 0755)
-	if err != nil {
-		return nil, nil, err
+	rangeSize := uint32(p.endProxyPort) - uint32(p.startProxyPort)
+	for _, appPort := range appPorts {
+		if rangeSize == 0 {
+			break
+		}
+
+		hash := fnv.New32a()
+		binary.Write(hash, binary.BigEndian, uint16(appPort))
+		proxyPort := p.startProxyPort + uint16(hash.Sum32()%rangeSize)
+
+		if !isFree(proxyPort) {
+			found := false
+			for port := p.startProxyPort; port < p.endProxyPort; port++ {
+				if isFree(port) {
+					proxyPort = port
+					found = true
+					break
+				}
+			}
+			if !found {
+				break
+			}
+		}
+
+		usedPorts[proxyPort] = struct{}{}
+		extraPorts = append(extraPorts, proxyPort)
+		proxyPortMapping = append(proxyPortMapping, executor.ProxyPortMapping{
+			AppPort:   uint16(appPort),
+			ProxyPort: proxyPort,
+		})
 	}
 
-	return mounts, nil, nil
+	return proxyPortMapping, extraPorts
+}
+
+// Validate checks the handler configuration that is otherwise only checked
+// when the proxy config of a container is written, reporting every problem
+// found.
+func (p *ProxyConfigHandler) Validate() error {
+	aggregate := &multierror.Error{}
+
+	_, err := formatCipherSuites(p.cipherSuites)
+	if err != nil {
+		aggregate = multierror.Append(aggregate, err)
+	}
+
+	for _, version := range []string{p.tlsMinimumVersion, p.tlsMaximumVersion} {
+		err := validateTLSProtocolVersion(version)
+		if err != nil {
+			aggregate = multierror.Append(aggregate, err)
+		}
+	}
+
+	if p.startProxyPort >= p.endProxyPort {
+		aggregate = multierror.Append(aggregate, fmt.Errorf("invalid proxy port range: %d-%d", p.startProxyPort, p.endProxyPort))
+	}
+
+	_, err = pemConcatenate(p.containerProxyTrustedCACerts)
+	if err != nil {
+		aggregate = multierror.Append(aggregate, fmt.Errorf("invalid trusted ca certs: %s", err))
+	}
+
+	if p.trustedCACertsFile != "" {
+		_, err := readTrustedCACerts(p.trustedCACertsFile)
+		if err != nil {
+			aggregate = multierror.Append(aggregate, err)
+		}
+	}
+
+	if net.ParseIP(envoyHostAddress(p.listenerBindAddress)) == nil {
+		aggregate = multierror.Append(aggregate, fmt.Errorf("invalid listener bind address: %q", p.listenerBindAddress))
+	}
+
+	if p.lbPolicy != "" && !validLbPolicies[p.lbPolicy] {
+		aggregate = multierror.Append(aggregate, fmt.Errorf("invalid lb policy: %q", p.lbPolicy))
+	}
+
+	for _, subjectAltName := range p.typedSubjectAltNames {
+		if !validSubjectAltNameTypes[subjectAltName.Type] {
+			aggregate = multierror.Append(aggregate, fmt.Errorf("invalid subject alt name type for %s: %q", subjectAltName.Matcher, subjectAltName.Type))
+		}
+	}
+
+	if p.sdsServerAddress != "" && p.sdsServerPort == 0 {
+		aggregate = multierror.Append(aggregate, fmt.Errorf("invalid sds server: %s has no port", p.sdsServerAddress))
+	}
+
+	if len(p.egressCIDRs) > 0 {
+		if p.egressPort == 0 || (p.egressPort >= p.startProxyPort && p.egressPort < p.endProxyPort) {
+			aggregate = multierror.Append(aggregate, fmt.Errorf("invalid egress port: %d", p.egressPort))
+		}
+		_, err := egressPrefixRanges(p.egressCIDRs)
+		if err != nil {
+			aggregate = multierror.Append(aggregate, err)
+		}
+	}
+
+	if p.reloadJitter < 0 || p.reloadJitter > 1 {
+		aggregate = multierror.Append(aggregate, fmt.Errorf("invalid reload jitter: %v", p.reloadJitter))
+	}
+
+	for _, certificate := range p.sniCertificates {
+		if len(certificate.ServerNames) == 0 {
+			aggregate = multierror.Append(aggregate, errors.New("sni certificate has no server names"))
+			continue
+		}
+		_, err := tls.X509KeyPair([]byte(certificate.Cert), []byte(certificate.Key))
+		if err != nil {
+			aggregate = multierror.Append(aggregate, fmt.Errorf("invalid sni certificate for %s: %s", strings.Join(certificate.ServerNames, ","), err))
+		}
+	}
+
+	return aggregate.ErrorOrNil()
+}
+
+// AdminPort returns the port the envoy admin interface of the container is
+// bound to. It is the first port of the proxy port range not taken by the
+// container or its proxy listeners, so it is stable for a given set of ports.
+// No port is used when the admin interface is bound to a unix socket.
+func (p *ProxyConfigHandler) AdminPort(logger lager.Logger, container executor.Container) (uint16, error) {
+	if !container.EnableContainerProxy || p.adminSocketPath != "" {
+		return 0, nil
+	}
+
+	if p.startProxyPort >= p.endProxyPort {
+		return 0, fmt.Errorf("invalid proxy port range: %d-%d", p.startProxyPort, p.endProxyPort)
+	}
+
+	return getAvailablePort(p.startProxyPort, p.endProxyPort, container.Ports)
+}
+
+func (p *ProxyConfigHandler) CreateDir(logger lager.Logger, container executor.Container) ([]garden.BindMount, []executor.EnvironmentVariable, error) {
+	if !container.EnableContainerProxy {
+		return nil, nil, nil
+	}
+
+	logger.Info("adding-container-proxy-bindmounts")
+	proxyConfigDir := filepath.Join(p.containerProxyConfigPath, container.Guid)
+	mounts := []garden.BindMount{
+		{
+			Origin:  garden.BindMountOriginHost,
+			SrcPath: p.containerProxyPath,
+			DstPath: "/etc/cf-assets/envoy",
+		},
+		{
+			Origin:  garden.BindMountOriginHost,
+			SrcPath: proxyConfigDir,
+			DstPath: ContainerProxyConfigMountPath,
+		},
+	}
+
+	err := os.MkdirAll(proxyConfigDir, 0755)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return mounts, nil, nil
 }
 
 func (p *ProxyConfigHandler) RemoveDir(logger lager.Logger, container executor.Container) error {
@@ -192,135 +1047,1198 @@ func (p *ProxyConfigHandler) RemoveDir(logger lager.Logger, container executor.C
 		return nil
 	}
 
-	logger.Info("removing-container-proxy-config-dir")
-	proxyConfigDir := filepath.Join(p.containerProxyConfigPath, container.Guid)
-	return os.RemoveAll(proxyConfigDir)
+	logger.Info("removing-container-proxy-config-dir")
+	p.cancelDebouncedUpdate(container.Guid)
+	p.removeContainerLock(container.Guid)
+	proxyConfigDir := filepath.Join(p.containerProxyConfigPath, container.Guid)
+	return os.RemoveAll(proxyConfigDir)
+}
+
+// RemoveProxyConfigDir removes the proxy config directory of the container
+// like RemoveDir, but also when the container has the proxy disabled.
+func (p *ProxyConfigHandler) RemoveProxyConfigDir(logger lager.Logger, container executor.Container) error {
+	logger.Info("removing-container-proxy-config-dir")
+	p.cancelDebouncedUpdate(container.Guid)
+	p.removeContainerLock(container.Guid)
+	proxyConfigDir := filepath.Join(p.containerProxyConfigPath, container.Guid)
+	return os.RemoveAll(proxyConfigDir)
+}
+
+// containerLock returns the lock serializing the writes to the config files
+// of the container, so concurrent Update and Close calls never interleave
+// their writes while different containers are written in parallel.
+func (p *ProxyConfigHandler) containerLock(guid string) *sync.Mutex {
+	p.containerLocksLock.Lock()
+	defer p.containerLocksLock.Unlock()
+
+	lock, ok := p.containerLocks[guid]
+	if !ok {
+		lock = &sync.Mutex{}
+		p.containerLocks[guid] = lock
+	}
+	return lock
+}
+
+// removeContainerLock forgets the lock of a container whose config directory
+// is removed, writes racing the removal fail with ErrConfigDirNotFound anyway.
+func (p *ProxyConfigHandler) removeContainerLock(guid string) {
+	p.containerLocksLock.Lock()
+	delete(p.containerLocks, guid)
+	p.containerLocksLock.Unlock()
+}
+
+// ConfigFiles returns the absolute host paths of the files in the proxy
+// config directory of the container: the config files Update writes, and the
+// access logs and admin socket envoy is configured to create inside the
+// config mount.
+func (p *ProxyConfigHandler) ConfigFiles(container executor.Container) []string {
+	if !container.EnableContainerProxy {
+		return nil
+	}
+
+	proxyConfigDir := filepath.Join(p.containerProxyConfigPath, container.Guid)
+	files := []string{
+		filepath.Join(proxyConfigDir, p.proxyConfigFileName()),
+		filepath.Join(proxyConfigDir, "listeners.yaml"),
+	}
+
+	for _, path := range []string{p.adminAccessLogPath, p.adminSocketPath, p.listenerAccessLogPath} {
+		if path == "" {
+			continue
+		}
+		if hostPath, ok := configMountHostPath(proxyConfigDir, path); ok {
+			files = append(files, hostPath)
+		}
+	}
+
+	return files
+}
+
+// Reap removes the config directories of containers not in knownGuids, e.g.
+// ones left behind by a crash before RemoveDir ran.
+func (p *ProxyConfigHandler) Reap(knownGuids []string) error {
+	logger := p.logger.Session("reap")
+
+	known := make(map[string]struct{}, len(knownGuids))
+	for _, guid := range knownGuids {
+		known[guid] = struct{}{}
+	}
+
+	entries, err := ioutil.ReadDir(p.containerProxyConfigPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		logger.Error("failed-to-read-proxy-config-path", err)
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		if _, ok := known[entry.Name()]; ok {
+			continue
+		}
+
+		p.cancelDebouncedUpdate(entry.Name())
+		p.removeContainerLock(entry.Name())
+
+		err := os.RemoveAll(filepath.Join(p.containerProxyConfigPath, entry.Name()))
+		if err != nil {
+			logger.Error("failed-to-reap-proxy-config-dir", err, lager.Data{"container-guid": entry.Name()})
+			return err
+		}
+		logger.Info("reaped-proxy-config-dir", lager.Data{"container-guid": entry.Name()})
+	}
+
+	return nil
+}
+
+func (p *ProxyConfigHandler) Update(credentials Credential, container executor.Container) error {
+	if !container.EnableContainerProxy {
+		return nil
+	}
+
+	// validate the pair up front so envoy never gets handed a cert it cannot load
+	err := p.validateCredentials(credentials, container)
+	if err != nil {
+		return err
+	}
+
+	if p.updateDebounce == 0 {
+		return p.writeConfig(credentials, container)
+	}
+
+	p.debounceLock.Lock()
+	update, ok := p.debouncedUpdates[container.Guid]
+	if ok {
+		update.pending = &ContainerCredential{Credential: credentials, Container: container}
+		p.debounceLock.Unlock()
+		return nil
+	}
+	update = &debouncedUpdate{done: make(chan struct{})}
+	p.debouncedUpdates[container.Guid] = update
+	update.writeLock.Lock()
+	p.debounceLock.Unlock()
+
+	go p.writeDebouncedUpdates(container.Guid, update)
+
+	defer update.writeLock.Unlock()
+	return p.writeConfig(credentials, container)
+}
+
+// writeDebouncedUpdates writes the latest pending update of the container
+// every updateDebounce, until a window passes without updates or the
+// container is closed.
+func (p *ProxyConfigHandler) writeDebouncedUpdates(guid string, update *debouncedUpdate) {
+	logger := p.logger.Session("debounced-update", lager.Data{"container-guid": guid})
+
+	for {
+		timer := p.reloadClock.NewTimer(p.updateDebounce)
+		select {
+		case <-timer.C():
+		case <-update.done:
+			timer.Stop()
+			return
+		}
+
+		p.debounceLock.Lock()
+		if p.debouncedUpdates[guid] != update {
+			// cancelled while the timer fired
+			p.debounceLock.Unlock()
+			return
+		}
+		pending := update.pending
+		update.pending = nil
+		if pending == nil {
+			delete(p.debouncedUpdates, guid)
+			p.debounceLock.Unlock()
+			return
+		}
+		update.writeLock.Lock()
+		p.debounceLock.Unlock()
+
+		err := p.writeConfig(pending.Credential, pending.Container)
+		update.writeLock.Unlock()
+		if err != nil {
+			logger.Error("failed-to-update", err)
+		}
+	}
+}
+
+// cancelDebouncedUpdate drops the pending update of the container and waits
+// for a debounced write in progress to finish.
+func (p *ProxyConfigHandler) cancelDebouncedUpdate(guid string) {
+	p.debounceLock.Lock()
+	update, ok := p.debouncedUpdates[guid]
+	if ok {
+		delete(p.debouncedUpdates, guid)
+		close(update.done)
+	}
+	p.debounceLock.Unlock()
+
+	if ok {
+		update.writeLock.Lock()
+		update.writeLock.Unlock()
+	}
+}
+
+// UpdateBatch updates the proxy configs of several containers like Update,
+// BatchUpdateWorkers containers at a time, and returns the errors of every
+// failed update. Updates of the same container are applied one after another
+// in the order given, so they never write the same directory concurrently.
+func (p *ProxyConfigHandler) UpdateBatch(entries []ContainerCredential) error {
+	guids := []string{}
+	entriesByGuid := make(map[string][]ContainerCredential)
+	for _, entry := range entries {
+		guid := entry.Container.Guid
+		if _, ok := entriesByGuid[guid]; !ok {
+			guids = append(guids, guid)
+		}
+		entriesByGuid[guid] = append(entriesByGuid[guid], entry)
+	}
+
+	var aggregateLock sync.Mutex
+	aggregate := &multierror.Error{}
+
+	guidsChan := make(chan string)
+	wg := sync.WaitGroup{}
+	for i := 0; i < BatchUpdateWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for guid := range guidsChan {
+				for _, entry := range entriesByGuid[guid] {
+					err := p.Update(entry.Credential, entry.Container)
+					if err != nil {
+						aggregateLock.Lock()
+						aggregate = multierror.Append(aggregate, fmt.Errorf("failed to update proxy config of %s: %s", guid, err))
+						aggregateLock.Unlock()
+					}
+				}
+			}
+		}()
+	}
+
+	for _, guid := range guids {
+		guidsChan <- guid
+	}
+	close(guidsChan)
+	wg.Wait()
+
+	return aggregate.ErrorOrNil()
+}
+
+// Rewrite regenerates the proxy config of a container from the config already
+// on disk, so changed handler settings such as the cipher suites reach
+// containers without waiting for their next credential rotation. The ports,
+// internal ips, extra clusters and credentials are read back from envoy.yaml
+// and listeners.yaml, per container overrides of the client certificate
+// settings and the health check port are not and fall back to those of the
+// handler.
+func (p *ProxyConfigHandler) Rewrite(guid string) error {
+	proxyConfigDir := filepath.Join(p.containerProxyConfigPath, guid)
+
+	proxyConfig, err := readExistingProxyConfig(proxyConfigDir)
+	if err != nil {
+		return fmt.Errorf("cannot rewrite proxy config of %s: %s", guid, err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(proxyConfigDir, "listeners.yaml"))
+	if err != nil {
+		return fmt.Errorf("cannot rewrite proxy config of %s: %s", guid, err)
+	}
+	var listenerConfig envoy.ListenerConfig
+	err = yaml.Unmarshal(data, &listenerConfig)
+	if err != nil {
+		return fmt.Errorf("cannot rewrite proxy config of %s: %s", guid, err)
+	}
+
+	container, credentials, err := p.reconstructContainer(guid, proxyConfig, listenerConfig)
+	if err != nil {
+		return fmt.Errorf("cannot rewrite proxy config of %s: %s", guid, err)
+	}
+
+	return p.writeConfig(credentials, container)
+}
+
+// readExistingProxyConfig reads envoy.yaml or, when the handler compressed it,
+// envoy.yaml.gz from the config directory of a container.
+func readExistingProxyConfig(proxyConfigDir string) (envoy.ProxyConfig, error) {
+	data, err := ioutil.ReadFile(filepath.Join(proxyConfigDir, "envoy.yaml"))
+	if os.IsNotExist(err) {
+		var compressed []byte
+		compressed, err = ioutil.ReadFile(filepath.Join(proxyConfigDir, "envoy.yaml.gz"))
+		if err == nil {
+			data, err = gunzip(compressed)
+		}
+	}
+	if err != nil {
+		return envoy.ProxyConfig{}, err
+	}
+
+	var proxyConfig envoy.ProxyConfig
+	err = yaml.Unmarshal(data, &proxyConfig)
+	if err != nil {
+		return envoy.ProxyConfig{}, err
+	}
+	return proxyConfig, nil
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReader.Close()
+	return ioutil.ReadAll(gzipReader)
+}
+
+// reconstructContainer recovers the container a proxy config was generated
+// for. Container ports come from the service clusters, which are named after
+// their index in container.Ports, and tls proxy ports from the listeners named
+// after the container port. Indices without a service cluster belonged to
+// ports bypassing the proxy and are kept as such.
+func (p *ProxyConfigHandler) reconstructContainer(guid string, proxyConfig envoy.ProxyConfig, listenerConfig envoy.ListenerConfig) (executor.Container, Credential, error) {
+	container := executor.Container{Guid: guid}
+	container.EnableContainerProxy = true
+
+	if node := proxyConfig.Node; node != nil {
+		container.AppGuid = node.Metadata[AppGuidNodeMetadataKey]
+		container.ProcessGuid = node.Metadata[ProcessGuidNodeMetadataKey]
+	}
+
+	listeners := make(map[string]envoy.Resource)
+	for _, listener := range listenerConfig.Resources {
+		listeners[listener.Name] = listener
+	}
+
+	var credentials Credential
+	foundCredentials := false
+	for _, cluster := range proxyConfig.StaticResources.Clusters {
+		hosts := clusterHosts(cluster)
+
+		switch {
+		case cluster.Name == SDSCluster || cluster.Name == EgressCluster:
+			continue
+		case !serviceClusterName.MatchString(cluster.Name):
+			if len(hosts) != 1 {
+				return executor.Container{}, Credential{}, fmt.Errorf("extra cluster %q has %d hosts", cluster.Name, len(hosts))
+			}
+			container.ContainerProxyExtraClusters = append(container.ContainerProxyExtraClusters, executor.ProxyCluster{
+				Name: cluster.Name,
+				Host: hosts[0].SocketAddress.Address,
+				Port: hosts[0].SocketAddress.PortValue,
+			})
+			continue
+		}
+
+		if len(hosts) == 0 {
+			return executor.Container{}, Credential{}, fmt.Errorf("cluster %q has no hosts", cluster.Name)
+		}
+
+		index, err := strconv.Atoi(strings.TrimSuffix(cluster.Name, "-service-cluster"))
+		if err != nil {
+			return executor.Container{}, Credential{}, err
+		}
+
+		containerPort := hosts[0].SocketAddress.PortValue
+		listener, ok := listeners[fmt.Sprintf("listener-%d", containerPort)]
+		if !ok {
+			return executor.Container{}, Credential{}, fmt.Errorf("no listener for container port %d", containerPort)
+		}
+
+		if container.InternalIP == "" {
+			container.InternalIP = hosts[0].SocketAddress.Address
+			for _, host := range hosts[1:] {
+				container.AdditionalInternalIPs = append(container.AdditionalInternalIPs, host.SocketAddress.Address)
+			}
+		}
+
+		for len(container.Ports) <= index {
+			container.Ports = append(container.Ports, executor.PortMapping{DisableContainerProxy: true})
+		}
+		container.Ports[index] = executor.PortMapping{
+			ContainerPort:           containerPort,
+			ContainerTLSProxyPort:   listener.Address.SocketAddress.PortValue,
+			PlaintextContainerProxy: isPlaintextListener(listener),
+		}
+
+		if !foundCredentials {
+			credentials, foundCredentials = listenerCredentials(listener)
+		}
+	}
+
+	if container.InternalIP == "" {
+		return executor.Container{}, Credential{}, errors.New("no service clusters")
+	}
+
+	if !foundCredentials && p.sdsServerAddress == "" {
+		return executor.Container{}, Credential{}, errors.New("no inline credentials")
+	}
+
+	return container, credentials, nil
+}
+
+// isPlaintextListener reports whether the listener passes connections on
+// without terminating tls.
+func isPlaintextListener(listener envoy.Resource) bool {
+	for _, filterChain := range listener.FilterChains {
+		if filterChain.TransportSocket != nil || !reflect.DeepEqual(filterChain.TLSContext, envoy.TLSContext{}) {
+			return false
+		}
+	}
+	return len(listener.FilterChains) > 0
+}
+
+// clusterHosts returns the hosts of a cluster in either the v2 or v3 form.
+func clusterHosts(cluster envoy.Cluster) []envoy.Address {
+	if cluster.LoadAssignment == nil {
+		return cluster.Hosts
+	}
+
+	hosts := []envoy.Address{}
+	for _, endpoints := range cluster.LoadAssignment.Endpoints {
+		for _, lbEndpoint := range endpoints.LbEndpoints {
+			hosts = append(hosts, lbEndpoint.Endpoint.Address)
+		}
+	}
+	return hosts
+}
+
+// listenerCredentials returns the credentials of the container filter chain,
+// which comes after those of the sni certificates. Credentials served over
+// sds are not in the listener config at all.
+func listenerCredentials(listener envoy.Resource) (Credential, bool) {
+	if len(listener.FilterChains) == 0 {
+		return Credential{}, false
+	}
+
+	filterChain := listener.FilterChains[len(listener.FilterChains)-1]
+	tlsContext := filterChain.TLSContext
+	if filterChain.TransportSocket != nil {
+		tlsContext = filterChain.TransportSocket.TypedConfig.TLSContext
+	}
+
+	certificates := tlsContext.CommonTLSContext.TLSCertificates
+	if len(certificates) == 0 {
+		return Credential{}, false
+	}
+
+	return Credential{
+		Cert: certificates[0].CertificateChain.InlineString,
+		Key:  certificates[0].PrivateKey.InlineString,
+	}, true
+}
+
+// GenerateConfig returns the envoy.yaml Update would write for the container
+// without touching the filesystem. The credentials never end up in envoy.yaml,
+// so they are not validated and a dry run needs no key pair.
+func (p *ProxyConfigHandler) GenerateConfig(credentials Credential, container executor.Container) ([]byte, error) {
+	if !container.EnableContainerProxy {
+		return nil, nil
+	}
+
+	_, err := p.tlsParams()
+	if err != nil {
+		return nil, err
+	}
+
+	proxyConfig, _, err := p.BuildProxyConfig(container)
+	if err != nil {
+		return nil, err
+	}
+
+	return yaml.Marshal(proxyConfig)
+}
+
+// BuildProxyConfig returns the envoy.yaml Update writes for the container as
+// a struct, along with the admin port it binds envoy to.
+func (p *ProxyConfigHandler) BuildProxyConfig(container executor.Container) (envoy.ProxyConfig, uint16, error) {
+	adminPort, err := p.AdminPort(p.logger, container)
+	if err != nil {
+		return envoy.ProxyConfig{}, 0, err
+	}
+
+	proxyConfig, err := p.generateProxyConfig(container, adminPort)
+	if err != nil {
+		return envoy.ProxyConfig{}, 0, err
+	}
+
+	return proxyConfig, adminPort, nil
+}
+
+// ConfigStats reports how many clusters and listeners the proxy config of the
+// container consists of, and approximately how many bytes it takes, without
+// writing it. The size leaves out the credentials, which are not known yet.
+func (p *ProxyConfigHandler) ConfigStats(container executor.Container) (clusters, listeners, approxBytes int, err error) {
+	if !container.EnableContainerProxy {
+		return 0, 0, 0, nil
+	}
+
+	tlsParams, err := p.tlsParams()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	proxyConfig, _, err := p.BuildProxyConfig(container)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	listenerConfig, err := p.containerListenerConfig(container, Credential{}, tlsParams)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	proxyConfigData, err := yaml.Marshal(proxyConfig)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	listenerConfigData, err := yaml.Marshal(listenerConfig)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	return len(proxyConfig.StaticResources.Clusters), len(listenerConfig.Resources), len(proxyConfigData) + len(listenerConfigData), nil
+}
+
+func (p *ProxyConfigHandler) validateCredentials(credentials Credential, container executor.Container) error {
+	_, err := tls.X509KeyPair([]byte(credentials.Cert), []byte(credentials.Key))
+	if err != nil {
+		p.logger.Error("invalid-credentials", err, lager.Data{"container-guid": container.Guid})
+		return ErrInvalidCertificate
+	}
+	return nil
+}
+
+func (p *ProxyConfigHandler) Close(invalidCredentials Credential, container executor.Container) error {
+	return p.CloseWithContext(context.Background(), invalidCredentials, container)
+}
+
+// CloseWithContext is Close, but stops waiting for envoy to reload the
+// invalidated credentials and returns ctx.Err() once ctx is done.
+func (p *ProxyConfigHandler) CloseWithContext(ctx context.Context, invalidCredentials Credential, container executor.Container) error {
+	if !container.EnableContainerProxy {
+		return nil
+	}
+
+	// a debounced update must not bring back valid credentials
+	p.cancelDebouncedUpdate(container.Guid)
+
+	if p.drainOnClose {
+		err := p.drainListeners(container)
+		if err != nil {
+			return err
+		}
+
+		err = p.wait(ctx, p.drainDuration)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := p.writeConfig(invalidCredentials, container)
+	if err != nil {
+		return err
+	}
+
+	return p.wait(ctx, p.jitteredReloadDuration(container))
+}
+
+func (p *ProxyConfigHandler) wait(ctx context.Context, duration time.Duration) error {
+	select {
+	case <-p.reloadClock.After(duration):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *ProxyConfigHandler) jitteredReloadDuration(container executor.Container) time.Duration {
+	reloadDuration := p.reloadDuration
+	if container.ContainerProxyReloadDurationMs > 0 {
+		reloadDuration = time.Duration(container.ContainerProxyReloadDurationMs) * time.Millisecond
+	}
+
+	if p.reloadJitter == 0 {
+		return reloadDuration
+	}
+
+	p.reloadJitterLock.Lock()
+	offset := p.reloadJitterRand.Float64()*2 - 1
+	p.reloadJitterLock.Unlock()
+
+	return reloadDuration + time.Duration(offset*p.reloadJitter*float64(reloadDuration))
+}
+
+// Runner returns a runner that updates the proxy config of the container with
+// every credential received on credRotatedChan, logging failed updates. When
+// signalled it closes the proxy of the container with a self signed credential
+// that does not identify the container.
+func (p *ProxyConfigHandler) Runner(logger lager.Logger, container executor.Container, credRotatedChan <-chan Credential) (ifrit.Runner, error) {
+	if !container.EnableContainerProxy {
+		return dummyRunner(credRotatedChan), nil
+	}
+
+	logger = logger.Session("proxy-config-runner", lager.Data{"container-guid": container.Guid})
+
+	return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+		close(ready)
+
+		for {
+			select {
+			case credentials, ok := <-credRotatedChan:
+				if !ok {
+					credRotatedChan = nil
+					continue
+				}
+
+				err := p.Update(credentials, container)
+				if err != nil {
+					logger.Error("failed-to-update", err)
+				}
+			case signal := <-signals:
+				logger.Info("signalled", lager.Data{"signal": signal.String()})
+
+				invalidCredentials, err := p.invalidCredentials(container)
+				if err != nil {
+					logger.Error("failed-to-generate-invalid-credentials", err)
+					return err
+				}
+
+				err = p.CloseWithContext(context.Background(), invalidCredentials, container)
+				if err != nil {
+					logger.Error("failed-to-close", err)
+					return err
+				}
+				return nil
+			}
+		}
+	}), nil
+}
+
+// invalidCredentials returns a self signed credential for an empty guid, as
+// the credential manager closes the proxy with a credential for an empty guid
+// signed by its CA, which Runner does not have.
+func (p *ProxyConfigHandler) invalidCredentials(container executor.Container) (Credential, error) {
+	privateKey, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	now := p.reloadClock.Now()
+	template := createCertificateTemplate(container.InternalIP, "", now, now.Add(time.Hour), nil)
+	template.SerialNumber = big.NewInt(1)
+
+	certBytes, err := x509.CreateCertificate(crand.Reader, template, template, privateKey.Public(), privateKey)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	var certificateBuf, keyBuf bytes.Buffer
+	err = pemEncode(certBytes, certificatePEMBlockType, &certificateBuf)
+	if err != nil {
+		return Credential{}, err
+	}
+	err = pemEncode(x509.MarshalPKCS1PrivateKey(privateKey), privateKeyPEMBlockType, &keyBuf)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	return Credential{Cert: certificateBuf.String(), Key: keyBuf.String()}, nil
+}
+
+// drainListeners removes every listener from the LDS config. Envoy stops
+// accepting connections on removed listeners and drains the open ones.
+func (p *ProxyConfigHandler) drainListeners(container executor.Container) error {
+	listenerConfigPath := filepath.Join(p.containerProxyConfigPath, container.Guid, "listeners.yaml")
+
+	lock := p.containerLock(container.Guid)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return p.writeListenerConfig(envoy.ListenerConfig{
+		VersionInfo: "0",
+		Resources:   []envoy.Resource{},
+	}, listenerConfigPath, p.listenerConfigFileMode)
+}
+
+func (p *ProxyConfigHandler) writeConfig(credentials Credential, container executor.Container) error {
+	lock := p.containerLock(container.Guid)
+	lock.Lock()
+	startTime := p.reloadClock.Now()
+	err := p.writeConfigFiles(credentials, container)
+	lock.Unlock()
+	p.sendWriteDuration(p.reloadClock.Since(startTime), err)
+	if err != nil {
+		return err
+	}
+
+	if p.configWrittenHook != nil {
+		p.configWrittenHook(container)
+	}
+	return nil
+}
+
+func (p *ProxyConfigHandler) sendWriteDuration(duration time.Duration, writeErr error) {
+	if p.metronClient == nil {
+		return
+	}
+
+	metricName := ContainerProxyConfigWriteSucceededDuration
+	if writeErr != nil {
+		metricName = ContainerProxyConfigWriteFailedDuration
+	}
+
+	err := p.metronClient.SendDuration(metricName, duration)
+	if err != nil {
+		p.logger.Error("failed-to-send-duration", err, lager.Data{"metric-name": metricName})
+	}
+}
+
+func (p *ProxyConfigHandler) writeConfigFiles(credentials Credential, container executor.Container) error {
+	proxyConfigDir := filepath.Join(p.containerProxyConfigPath, container.Guid)
+	proxyConfigPath := filepath.Join(proxyConfigDir, p.proxyConfigFileName())
+	listenerConfigPath := filepath.Join(proxyConfigDir, "listeners.yaml")
+
+	_, err := os.Stat(proxyConfigDir)
+	if os.IsNotExist(err) {
+		p.logger.Error("proxy-config-dir-not-found", err, lager.Data{"path": proxyConfigDir})
+		return ErrConfigDirNotFound
+	}
+
+	tlsParams, err := p.tlsParams()
+	if err != nil {
+		return err
+	}
+
+	proxyConfig, _, err := p.BuildProxyConfig(container)
+	if err != nil {
+		return err
+	}
+
+	err = p.validateTLSProxyPorts(container)
+	if err != nil {
+		return err
+	}
+
+	err = createConfigMountDir(proxyConfigDir, p.adminAccessLogPath)
+	if err != nil {
+		return err
+	}
+
+	if p.adminSocketPath != "" {
+		err = createConfigMountDir(proxyConfigDir, p.adminSocketPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.listenerAccessLogPath != "" {
+		err = createConfigMountDir(proxyConfigDir, p.listenerAccessLogPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	listenerConfig, err := p.containerListenerConfig(container, credentials, tlsParams)
+	if err != nil {
+		return err
+	}
+
+	err = p.writeProxyConfig(proxyConfig, proxyConfigPath, p.proxyConfigFileMode, p.compressProxyConfig)
+	if err != nil {
+		return err
+	}
+
+	err = p.writeListenerConfig(listenerConfig, listenerConfigPath, p.listenerConfigFileMode)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// validateTLSProxyPorts catches listeners envoy would fail to bind, because
+// they share a port or got one outside of the proxy port range.
+func (p *ProxyConfigHandler) validateTLSProxyPorts(container executor.Container) error {
+	tlsProxyPorts := make(map[uint16]uint16)
+	for _, portMap := range container.Ports {
+		if portMap.DisableContainerProxy {
+			continue
+		}
+
+		tlsProxyPort := portMap.ContainerTLSProxyPort
+		if tlsProxyPort < p.startProxyPort || tlsProxyPort >= p.endProxyPort {
+			return fmt.Errorf("tls proxy port %d of container port %d is outside of the proxy port range %d-%d", tlsProxyPort, portMap.ContainerPort, p.startProxyPort, p.endProxyPort)
+		}
+
+		if containerPort, ok := tlsProxyPorts[tlsProxyPort]; ok {
+			return fmt.Errorf("tls proxy port %d is shared by container ports %d and %d", tlsProxyPort, containerPort, portMap.ContainerPort)
+		}
+		tlsProxyPorts[tlsProxyPort] = portMap.ContainerPort
+	}
+
+	return nil
+}
+
+// createConfigMountDir creates the host directory backing a file path, such as
+// an access log, that lives under the envoy config mount.
+func createConfigMountDir(proxyConfigDir, path string) error {
+	hostPath, ok := configMountHostPath(proxyConfigDir, path)
+	if !ok {
+		// the file lives outside of the config mount, nothing to create
+		return nil
+	}
+
+	return os.MkdirAll(filepath.Dir(hostPath), 0755)
+}
+
+// configMountHostPath returns where a path inside the container's config
+// mount lives on the host, and false when the path is outside of the mount.
+func configMountHostPath(proxyConfigDir, path string) (string, bool) {
+	relPath, err := filepath.Rel(ContainerProxyConfigMountPath, path)
+	if err != nil || strings.HasPrefix(relPath, "..") {
+		return "", false
+	}
+
+	return filepath.Join(proxyConfigDir, relPath), true
+}
+
+func (p *ProxyConfigHandler) generateProxyConfig(container executor.Container, adminPort uint16) (envoy.ProxyConfig, error) {
+	timeout := TimeOut
+	if p.connectTimeout > 0 {
+		timeout = envoyDuration(p.connectTimeout)
+	}
+
+	maxConnections := uint32(math.MaxUint32)
+	if p.maxConnections > 0 {
+		maxConnections = p.maxConnections
+	}
+
+	lbPolicy := RoundRobin
+	if p.lbPolicy != "" {
+		if !validLbPolicies[p.lbPolicy] {
+			return envoy.ProxyConfig{}, fmt.Errorf("invalid lb policy: %q", p.lbPolicy)
+		}
+		lbPolicy = p.lbPolicy
+	}
+
+	// envoy fails to load clusters without a valid host with a cryptic error
+	hostAddresses := []string{}
+	for _, ip := range append([]string{container.InternalIP}, container.AdditionalInternalIPs...) {
+		hostAddress := envoyHostAddress(ip)
+		if net.ParseIP(hostAddress) == nil {
+			return envoy.ProxyConfig{}, fmt.Errorf("invalid container internal ip: %q", ip)
+		}
+		hostAddresses = append(hostAddresses, hostAddress)
+	}
+
+	var upstreamConnectionOptions *envoy.UpstreamConnectionOptions
+	if p.keepaliveProbes > 0 || p.keepaliveTime > 0 || p.keepaliveInterval > 0 {
+		upstreamConnectionOptions = &envoy.UpstreamConnectionOptions{
+			TCPKeepalive: envoy.TCPKeepalive{
+				KeepaliveProbes:   p.keepaliveProbes,
+				KeepaliveTime:     uint32(p.keepaliveTime / time.Second),
+				KeepaliveInterval: uint32(p.keepaliveInterval / time.Second),
+			},
+		}
+	}
+
+	var outlierDetection *envoy.OutlierDetection
+	if p.consecutive5xx > 0 || p.consecutiveGatewayFailure > 0 || p.baseEjectionTime > 0 {
+		outlierDetection = &envoy.OutlierDetection{
+			Consecutive5xx:            p.consecutive5xx,
+			ConsecutiveGatewayFailure: p.consecutiveGatewayFailure,
+		}
+		if p.baseEjectionTime > 0 {
+			outlierDetection.BaseEjectionTime = envoyDuration(p.baseEjectionTime)
+		}
+	}
+
+	clusters := []envoy.Cluster{}
+	for index, portMap := range container.Ports {
+		if portMap.DisableContainerProxy {
+			continue
+		}
+
+		clusterName := fmt.Sprintf("%d-service-cluster", index)
+
+		hosts := []envoy.Address{}
+		for _, hostAddress := range hostAddresses {
+			hosts = append(hosts, envoy.Address{
+				SocketAddress: envoy.SocketAddress{Address: hostAddress, PortValue: portMap.ContainerPort},
+			})
+		}
+
+		clusters = append(clusters, envoy.Cluster{
+			Name:              clusterName,
+			ConnectionTimeout: timeout,
+			Type:              Static,
+			LbPolicy:          lbPolicy,
+			Hosts:             hosts,
+			CircuitBreakers: envoy.CircuitBreakers{Thresholds: []envoy.Threshold{
+				{
+					MaxConnections:     maxConnections,
+					MaxPendingRequests: p.maxPendingRequests,
+					MaxRequests:        p.maxRequests,
+				},
+			}},
+			UpstreamConnectionOptions: upstreamConnectionOptions,
+			OutlierDetection:          outlierDetection,
+		})
+	}
+
+	if p.sdsServerAddress != "" {
+		var sdsCircuitBreakers envoy.CircuitBreakers
+		if !p.omitSDSCircuitBreakers {
+			sdsMaxConnections := uint32(math.MaxUint32)
+			if p.sdsMaxConnections > 0 {
+				sdsMaxConnections = p.sdsMaxConnections
+			}
+			sdsCircuitBreakers = envoy.CircuitBreakers{Thresholds: []envoy.Threshold{
+				{
+					MaxConnections:     sdsMaxConnections,
+					MaxPendingRequests: p.sdsMaxPendingRequests,
+					MaxRequests:        p.sdsMaxRequests,
+				},
+			}}
+		}
+
+		clusters = append(clusters, envoy.Cluster{
+			Name:              SDSCluster,
+			ConnectionTimeout: timeout,
+			Type:              clusterType(p.sdsServerAddress),
+			LbPolicy:          RoundRobin,
+			Hosts: []envoy.Address{
+				{SocketAddress: envoy.SocketAddress{Address: envoyHostAddress(p.sdsServerAddress), PortValue: p.sdsServerPort}},
+			},
+			CircuitBreakers:      sdsCircuitBreakers,
+			HTTP2ProtocolOptions: &envoy.HTTP2ProtocolOptions{},
+		})
+	}
+
+	if len(p.egressCIDRs) > 0 {
+		clusters = append(clusters, envoy.Cluster{
+			Name:              EgressCluster,
+			ConnectionTimeout: timeout,
+			Type:              OriginalDst,
+			LbPolicy:          OriginalDstLb,
+		})
+	}
+
+	extraClusterNames := map[string]bool{}
+	for _, extraCluster := range container.ContainerProxyExtraClusters {
+		if extraCluster.Name == "" || extraCluster.Name == SDSCluster || extraCluster.Name == EgressCluster || serviceClusterName.MatchString(extraCluster.Name) {
+			return envoy.ProxyConfig{}, fmt.Errorf("invalid extra cluster name: %q", extraCluster.Name)
+		}
+		if extraClusterNames[extraCluster.Name] {
+			return envoy.ProxyConfig{}, fmt.Errorf("duplicate extra cluster name: %q", extraCluster.Name)
+		}
+		extraClusterNames[extraCluster.Name] = true
+
+		clusters = append(clusters, envoy.Cluster{
+			Name:              extraCluster.Name,
+			ConnectionTimeout: timeout,
+			Type:              clusterType(extraCluster.Host),
+			LbPolicy:          RoundRobin,
+			Hosts: []envoy.Address{
+				{SocketAddress: envoy.SocketAddress{Address: envoyHostAddress(extraCluster.Host), PortValue: extraCluster.Port}},
+			},
+			CircuitBreakers: envoy.CircuitBreakers{Thresholds: []envoy.Threshold{
+				{
+					MaxConnections:     maxConnections,
+					MaxPendingRequests: p.maxPendingRequests,
+					MaxRequests:        p.maxRequests,
+				},
+			}},
+		})
+	}
+
+	adminAddress := envoy.Address{
+		SocketAddress: envoy.SocketAddress{
+			Address:   "127.0.0.1",
+			PortValue: adminPort,
+		},
+	}
+	if p.adminSocketPath != "" {
+		adminAddress = envoy.Address{Pipe: &envoy.Pipe{Path: p.adminSocketPath}}
+	}
+
+	config := envoy.ProxyConfig{
+		Node: p.node(container),
+		Admin: envoy.Admin{
+			AccessLogPath: p.adminAccessLogPath,
+			Address:       adminAddress,
+		},
+		StaticResources: envoy.StaticResources{
+			Clusters: clusters,
+		},
+		DynamicResources: envoy.DynamicResources{
+			LDSConfig: envoy.LDSConfig{
+				Path: filepath.Join(ContainerProxyConfigMountPath, "listeners.yaml"),
+			},
+		},
+	}
+
+	if p.envoyAPIV3 {
+		config.DynamicResources.LDSConfig.ResourceAPIVersion = ResourceAPIVersionV3
+		for i := range config.StaticResources.Clusters {
+			config.StaticResources.Clusters[i] = clusterV3(config.StaticResources.Clusters[i])
+		}
+	}
+	return config, nil
 }
 
-func (p *ProxyConfigHandler) Update(credentials Credential, container executor.Container) error {
-	if !container.EnableContainerProxy {
+// node identifies the envoy of the container when a locality or metadata is
+// configured or the container names its app or process, otherwise the node
+// is left to envoy.
+func (p *ProxyConfigHandler) node(container executor.Container) *envoy.Node {
+	var locality *envoy.Locality
+	if p.nodeLocality != (envoy.Locality{}) {
+		nodeLocality := p.nodeLocality
+		locality = &nodeLocality
+	}
+
+	var metadata map[string]string
+	if len(p.nodeMetadata) > 0 || container.AppGuid != "" || container.ProcessGuid != "" {
+		metadata = make(map[string]string)
+		for key, value := range p.nodeMetadata {
+			metadata[key] = value
+		}
+		if container.AppGuid != "" {
+			metadata[AppGuidNodeMetadataKey] = container.AppGuid
+		}
+		if container.ProcessGuid != "" {
+			metadata[ProcessGuidNodeMetadataKey] = container.ProcessGuid
+		}
+	}
+
+	if locality == nil && metadata == nil {
 		return nil
 	}
 
-	return p.writeConfig(credentials, container)
+	return &envoy.Node{
+		Id:       container.Guid,
+		Locality: locality,
+		Metadata: metadata,
+	}
 }
 
-func (p *ProxyConfigHandler) Close(invalidCredentials Credential, container executor.Container) error {
-	if !container.EnableContainerProxy {
-		return nil
+// clusterType returns the type of a cluster of the host, hostnames have to be
+// resolved while ips can be used as they are.
+func clusterType(host string) string {
+	if net.ParseIP(envoyHostAddress(host)) != nil {
+		return Static
 	}
+	return StrictDNS
+}
 
-	err := p.writeConfig(invalidCredentials, container)
-	if err != nil {
-		return err
+// envoyHostAddress returns the ip as envoy expects it in a socket address,
+// dropping the brackets IPv6 literals are often written with.
+func envoyHostAddress(ip string) string {
+	trimmed := strings.TrimSuffix(strings.TrimPrefix(ip, "["), "]")
+	if parsed := net.ParseIP(trimmed); parsed != nil {
+		return parsed.String()
 	}
+	return ip
+}
 
-	p.reloadClock.Sleep(p.reloadDuration)
-	return nil
+// envoyDuration formats a duration the way envoy parses protobuf durations,
+// i.e. as fractional seconds.
+func envoyDuration(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
 }
 
-func (p *ProxyConfigHandler) writeConfig(credentials Credential, container executor.Container) error {
-	proxyConfigPath := filepath.Join(p.containerProxyConfigPath, container.Guid, "envoy.yaml")
-	listenerConfigPath := filepath.Join(p.containerProxyConfigPath, container.Guid, "listeners.yaml")
+func (p *ProxyConfigHandler) proxyConfigFileName() string {
+	if p.compressProxyConfig {
+		return "envoy.yaml.gz"
+	}
+	return "envoy.yaml"
+}
 
-	adminPort, err := getAvailablePort(container.Ports)
+func (p *ProxyConfigHandler) writeProxyConfig(proxyConfig envoy.ProxyConfig, path string, mode os.FileMode, compress bool) error {
+	data, err := yaml.Marshal(proxyConfig)
 	if err != nil {
 		return err
 	}
 
-	proxyConfig, err := generateProxyConfig(container, adminPort)
-	if err != nil {
-		return err
+	if compress {
+		var compressed bytes.Buffer
+		gzipWriter := gzip.NewWriter(&compressed)
+		_, err = gzipWriter.Write(data)
+		if err != nil {
+			return err
+		}
+		err = gzipWriter.Close()
+		if err != nil {
+			return err
+		}
+		data = compressed.Bytes()
+	}
+
+	// credential rotations leave the proxy config unchanged, rewriting it
+	// would only make envoy notice a change
+	existing, err := ioutil.ReadFile(path)
+	if err == nil && bytes.Equal(existing, data) {
+		return nil
 	}
 
-	err = writeProxyConfig(proxyConfig, proxyConfigPath)
+	return p.writeFileAtomically(path, data, mode)
+}
+
+func (p *ProxyConfigHandler) writeListenerConfig(listenerConfig envoy.ListenerConfig, path string, mode os.FileMode) error {
+	data, err := yaml.Marshal(listenerConfig)
 	if err != nil {
 		return err
 	}
 
-	listenerConfig, err := generateListenerConfig(
-		container,
-		credentials,
-		p.containerProxyTrustedCACerts,
-		p.containerProxyVerifySubjectAltName,
-		p.containerProxyRequireClientCerts,
-	)
-	if err != nil {
+	return p.writeFileAtomically(path, data, mode)
+}
+
+// writeFileAtomically writes data to a tmp file next to path and renames it
+// into place, so readers never see a partially written file.
+func (p *ProxyConfigHandler) writeFileAtomically(path string, data []byte, mode os.FileMode) error {
+	tmpPath := path + ".tmp"
+
+	// a leftover tmp file would keep its old mode, so always create it afresh
+	err := os.Remove(tmpPath)
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
-	err = writeListenerConfig(listenerConfig, listenerConfigPath)
+	err = ioutil.WriteFile(tmpPath, data, mode)
 	if err != nil {
 		return err
 	}
-
-	return nil
+	return p.renameWithRetry(tmpPath, path)
 }
-func generateProxyConfig(container executor.Container, adminPort uint16) (envoy.ProxyConfig, error) {
-	clusters := []envoy.Cluster{}
-	for index, portMap := range container.Ports {
-		clusterName := fmt.Sprintf("%d-service-cluster", index)
-		clusters = append(clusters, envoy.Cluster{
-			Name:              clusterName,
-			ConnectionTimeout: TimeOut,
-			Type:              Static,
-			LbPolicy:          RoundRobin,
-			Hosts: []envoy.Address{
-				{SocketAddress: envoy.SocketAddress{Address: container.InternalIP, PortValue: portMap.ContainerPort}},
-			},
-			CircuitBreakers: envoy.CircuitBreakers{Thresholds: []envoy.Threshold{
-				{MaxConnections: math.MaxUint32},
-			}},
-		})
-	}
 
-	config := envoy.ProxyConfig{
-		Admin: envoy.Admin{
-			AccessLogPath: AdminAccessLog,
-			Address: envoy.Address{
-				SocketAddress: envoy.SocketAddress{
-					Address:   "127.0.0.1",
-					PortValue: adminPort,
-				},
-			},
-		},
-		StaticResources: envoy.StaticResources{
-			Clusters: clusters,
-		},
-		DynamicResources: envoy.DynamicResources{
-			LDSConfig: envoy.LDSConfig{
-				Path: "/etc/cf-assets/envoy_config/listeners.yaml",
-			},
-		},
+// renameWithRetry retries renames failing with EBUSY up to RenameAttempts
+// times, backing off on the reload clock, and returns the last error when
+// the rename keeps failing.
+func (p *ProxyConfigHandler) renameWithRetry(oldpath, newpath string) error {
+	interval := RenameRetryInterval
+	for attempt := 1; ; attempt++ {
+		err := p.rename(oldpath, newpath)
+		if err == nil || attempt == RenameAttempts || !isBusyError(err) {
+			return err
+		}
+
+		p.logger.Info("retrying-busy-rename", lager.Data{"path": newpath, "attempt": attempt})
+		p.reloadClock.Sleep(interval)
+		interval *= 2
 	}
-	return config, nil
 }
 
-func writeProxyConfig(proxyConfig envoy.ProxyConfig, path string) error {
-	data, err := yaml.Marshal(proxyConfig)
-	if err != nil {
-		return err
+func isBusyError(err error) bool {
+	if linkErr, ok := err.(*os.LinkError); ok {
+		err = linkErr.Err
 	}
-
-	return ioutil.WriteFile(path, data, 0666)
+	return err == syscall.EBUSY
 }
 
-func writeListenerConfig(listenerConfig envoy.ListenerConfig, path string) error {
-	tmpPath := path + ".tmp"
+// containerListenerConfig generates the listener config with the client
+// certificate settings of the container, falling back to those of the handler.
+func (p *ProxyConfigHandler) containerListenerConfig(container executor.Container, credentials Credential, tlsParams envoy.TLSParams) (envoy.ListenerConfig, error) {
+	requireClientCerts := p.containerProxyRequireClientCerts
+	if container.ContainerProxyRequireClientCerts != nil {
+		requireClientCerts = *container.ContainerProxyRequireClientCerts
+	}
 
-	data, err := yaml.Marshal(listenerConfig)
-	if err != nil {
-		return err
+	subjectAltNames := p.containerProxyVerifySubjectAltName
+	if len(container.ContainerProxyVerifySubjectAltName) > 0 {
+		subjectAltNames = container.ContainerProxyVerifySubjectAltName
 	}
 
-	err = ioutil.WriteFile(tmpPath, data, 0666)
-	if err != nil {
-		return err
+	trustedCACerts := p.containerProxyTrustedCACerts
+	if requireClientCerts && p.trustedCACertsFile != "" {
+		var err error
+		trustedCACerts, err = readTrustedCACerts(p.trustedCACertsFile)
+		if err != nil {
+			return envoy.ListenerConfig{}, err
+		}
 	}
-	return os.Rename(tmpPath, path)
+
+	return p.generateListenerConfig(
+		container,
+		credentials,
+		trustedCACerts,
+		subjectAltNames,
+		requireClientCerts,
+		tlsParams,
+	)
 }
 
-func generateListenerConfig(container executor.Container, creds Credential, trustedCaCerts []string, subjectAltNames []string, requireClientCerts bool) (envoy.ListenerConfig, error) {
+func (p *ProxyConfigHandler) generateListenerConfig(container executor.Container, creds Credential, trustedCaCerts []string, subjectAltNames []string, requireClientCerts bool, tlsParams envoy.TLSParams) (envoy.ListenerConfig, error) {
+	if net.ParseIP(envoyHostAddress(p.listenerBindAddress)) == nil {
+		return envoy.ListenerConfig{}, fmt.Errorf("invalid listener bind address: %q", p.listenerBindAddress)
+	}
+
 	resources := []envoy.Resource{}
 
 	if !requireClientCerts {
@@ -337,47 +2255,122 @@ func generateListenerConfig(container executor.Container, creds Credential, trus
 		}
 	}
 
+	var typedSubjectAltNames []envoy.SubjectAltNameMatcher
+	if requireClientCerts && len(container.ContainerProxyVerifySubjectAltName) == 0 {
+		for _, subjectAltName := range p.typedSubjectAltNames {
+			typedSubjectAltNames = append(typedSubjectAltNames, envoy.SubjectAltNameMatcher{
+				SanType: subjectAltName.Type,
+				Matcher: envoy.StringMatcher{Exact: subjectAltName.Matcher},
+			})
+		}
+	}
+	if len(typedSubjectAltNames) > 0 {
+		subjectAltNames = nil
+	}
+
+	var listenerFilters []envoy.ListenerFilter
+	if p.originalDstListenerFilter {
+		listenerFilters = []envoy.ListenerFilter{{Name: OriginalDstListenerFilter}}
+	}
+
 	for index, portMap := range container.Ports {
-		listenerName := TcpProxy
+		if portMap.DisableContainerProxy {
+			continue
+		}
+
 		clusterName := fmt.Sprintf("%d-service-cluster", index)
 
-		resources = append(resources, envoy.Resource{
-			Type:    "type.googleapis.com/envoy.api.v2.Listener",
-			Name:    fmt.Sprintf("listener-%d", portMap.ContainerPort),
-			Address: envoy.Address{SocketAddress: envoy.SocketAddress{Address: "0.0.0.0", PortValue: portMap.ContainerTLSProxyPort}},
-			FilterChains: []envoy.FilterChain{envoy.FilterChain{
+		listenerRequireClientCerts := requireClientCerts
+		validationContext := envoy.CertificateValidationContext{
+			TrustedCA:                 envoy.DataSource{InlineString: certs},
+			VerifySubjectAltName:      subjectAltNames,
+			MatchTypedSubjectAltNames: typedSubjectAltNames,
+		}
+		if container.ContainerProxyHealthCheckPort != 0 && portMap.ContainerPort == container.ContainerProxyHealthCheckPort {
+			// the platform health checker has no client certificate to present
+			listenerRequireClientCerts = false
+			validationContext = envoy.CertificateValidationContext{}
+		}
+
+		filterChain := func(cert, key string) envoy.FilterChain {
+			return envoy.FilterChain{
 				Filters: []envoy.Filter{
-					envoy.Filter{
-						Name: listenerName,
-						Config: envoy.Config{
-							StatPrefix: fmt.Sprintf("%d-stats", index),
-							Cluster:    clusterName,
-						},
-					},
+					p.listenerFilter(index, p.statPrefix(container, index, portMap), clusterName),
 				},
 				TLSContext: envoy.TLSContext{
-					RequireClientCertificate: requireClientCerts,
+					RequireClientCertificate: listenerRequireClientCerts,
 					CommonTLSContext: envoy.CommonTLSContext{
-						TLSParams: envoy.TLSParams{
-							CipherSuites: SupportedCipherSuites,
-						},
+						TLSParams: tlsParams,
 						TLSCertificates: []envoy.TLSCertificate{
 							envoy.TLSCertificate{
-								CertificateChain: envoy.DataSource{InlineString: creds.Cert},
-								PrivateKey:       envoy.DataSource{InlineString: creds.Key},
+								CertificateChain: envoy.DataSource{InlineString: cert},
+								PrivateKey:       envoy.DataSource{InlineString: key},
 							},
 						},
-						ValidationContext: envoy.CertificateValidationContext{
-							TrustedCA:            envoy.DataSource{InlineString: certs},
-							VerifySubjectAltName: subjectAltNames,
+						ValidationContext: validationContext,
+					},
+				},
+			}
+		}
+
+		filterChains := []envoy.FilterChain{}
+		for _, sniCertificate := range p.sniCertificates {
+			sniFilterChain := filterChain(sniCertificate.Cert, sniCertificate.Key)
+			sniFilterChain.FilterChainMatch = &envoy.FilterChainMatch{ServerNames: sniCertificate.ServerNames}
+			filterChains = append(filterChains, sniFilterChain)
+		}
+		containerFilterChain := filterChain(creds.Cert, creds.Key)
+		if p.sdsServerAddress != "" {
+			commonTLSContext := &containerFilterChain.TLSContext.CommonTLSContext
+			commonTLSContext.TLSCertificates = nil
+			commonTLSContext.TLSCertificateSDSSecretConfigs = []envoy.SDSSecretConfig{
+				{
+					Name: container.Guid,
+					SDSConfig: envoy.SDSConfig{
+						APIConfigSource: envoy.APIConfigSource{
+							APIType: GRPC,
+							GRPCServices: []envoy.GRPCService{
+								{EnvoyGRPC: envoy.EnvoyGRPC{ClusterName: SDSCluster}},
+							},
 						},
 					},
 				},
-			},
-			},
+			}
+		}
+		filterChains = append(filterChains, containerFilterChain)
+
+		if portMap.PlaintextContainerProxy {
+			// the connections are passed on to the app without terminating
+			// tls, so there are no certificates to present or names to match
+			filterChains = []envoy.FilterChain{{Filters: containerFilterChain.Filters}}
+		}
+
+		resources = append(resources, envoy.Resource{
+			Type:         ListenerType,
+			Name:         fmt.Sprintf("listener-%d", portMap.ContainerPort),
+			Address:      envoy.Address{SocketAddress: envoy.SocketAddress{Address: envoyHostAddress(p.listenerBindAddress), PortValue: portMap.ContainerTLSProxyPort}},
+			ReusePort:    p.reusePort,
+			FilterChains: filterChains,
+
+			ListenerFilters:               listenerFilters,
+			PerConnectionBufferLimitBytes: p.perConnectionBufferLimitBytes,
 		})
 	}
 
+	if len(p.egressCIDRs) > 0 {
+		egressListener, err := p.egressListener()
+		if err != nil {
+			return envoy.ListenerConfig{}, err
+		}
+		resources = append(resources, egressListener)
+	}
+
+	if p.envoyAPIV3 {
+		for i := range resources {
+			resources[i] = listenerV3(resources[i])
+		}
+	}
+
 	config := envoy.ListenerConfig{
 		VersionInfo: "0",
 		Resources:   resources,
@@ -386,6 +2379,308 @@ func generateListenerConfig(container executor.Container, creds Credential, trus
 	return config, nil
 }
 
+// egressListener only has a filter chain for the allowed destinations, so
+// envoy closes connections to any other destination.
+func (p *ProxyConfigHandler) egressListener() (envoy.Resource, error) {
+	prefixRanges, err := egressPrefixRanges(p.egressCIDRs)
+	if err != nil {
+		return envoy.Resource{}, err
+	}
+
+	var idleTimeout string
+	if p.idleTimeout > 0 {
+		idleTimeout = envoyDuration(p.idleTimeout)
+	}
+
+	return envoy.Resource{
+		Type:    ListenerType,
+		Name:    EgressListener,
+		Address: envoy.Address{SocketAddress: envoy.SocketAddress{Address: EgressBindAddress, PortValue: p.egressPort}},
+		FilterChains: []envoy.FilterChain{
+			{
+				FilterChainMatch: &envoy.FilterChainMatch{PrefixRanges: prefixRanges},
+				Filters: []envoy.Filter{
+					{
+						Name: p.tcpProxyName(),
+						Config: envoy.Config{
+							StatPrefix:  "egress",
+							Cluster:     EgressCluster,
+							IdleTimeout: idleTimeout,
+						},
+					},
+				},
+			},
+		},
+		ListenerFilters: []envoy.ListenerFilter{{Name: OriginalDstListenerFilter}},
+	}, nil
+}
+
+func (p *ProxyConfigHandler) tcpProxyName() string {
+	if p.canonicalTCPProxyName {
+		return TcpProxyV3
+	}
+	return TcpProxy
+}
+
+func egressPrefixRanges(cidrs []string) ([]envoy.CIDRRange, error) {
+	prefixRanges := []envoy.CIDRRange{}
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid egress cidr: %q", cidr)
+		}
+		prefixLen, _ := ipNet.Mask.Size()
+		prefixRanges = append(prefixRanges, envoy.CIDRRange{
+			AddressPrefix: ipNet.IP.String(),
+			PrefixLen:     uint32(prefixLen),
+		})
+	}
+	return prefixRanges, nil
+}
+
+// statPrefix names the stats of a listener after its position in
+// container.Ports, or after the container and app port when stable stat
+// prefixes are enabled.
+func (p *ProxyConfigHandler) statPrefix(container executor.Container, index int, portMap executor.PortMapping) string {
+	if p.stableStatPrefixes {
+		return fmt.Sprintf("%s-%d", container.Guid, portMap.ContainerPort)
+	}
+	return fmt.Sprintf("%d-stats", index)
+}
+
+func (p *ProxyConfigHandler) listenerFilter(index int, statPrefix, clusterName string) envoy.Filter {
+	var idleTimeout string
+	if p.idleTimeout > 0 {
+		idleTimeout = envoyDuration(p.idleTimeout)
+	}
+
+	var accessLog []envoy.AccessLog
+	if p.listenerAccessLogPath != "" {
+		accessLog = append(accessLog, envoy.AccessLog{
+			Name:   FileAccessLog,
+			Config: envoy.AccessLogConfig{Path: p.listenerAccessLogPath},
+		})
+	}
+	if p.stdoutAccessLog {
+		accessLog = append(accessLog, envoy.AccessLog{
+			Name:   FileAccessLog,
+			Config: envoy.AccessLogConfig{Path: StdoutAccessLog},
+		})
+	}
+
+	if !p.httpConnectionManager {
+		return envoy.Filter{
+			Name: p.tcpProxyName(),
+			Config: envoy.Config{
+				StatPrefix:  statPrefix,
+				Cluster:     clusterName,
+				AccessLog:   accessLog,
+				IdleTimeout: idleTimeout,
+			},
+		}
+	}
+
+	return envoy.Filter{
+		Name: HttpConnectionManager,
+		Config: envoy.Config{
+			StatPrefix: statPrefix,
+			RouteConfig: &envoy.RouteConfig{
+				Name: fmt.Sprintf("%d-route", index),
+				VirtualHosts: []envoy.VirtualHost{
+					{
+						Name:    clusterName,
+						Domains: []string{"*"},
+						Routes: []envoy.Route{
+							{
+								Match: envoy.RouteMatch{Prefix: "/"},
+								Route: envoy.RouteAction{Cluster: clusterName},
+							},
+						},
+					},
+				},
+			},
+			HTTPFilters: []envoy.HTTPFilter{{Name: HttpRouter}},
+			AccessLog:   accessLog,
+			IdleTimeout: idleTimeout,
+		},
+	}
+}
+
+// clusterV3 moves the hosts of a cluster into the load assignment the v3 api
+// replaced them with.
+func clusterV3(cluster envoy.Cluster) envoy.Cluster {
+	if cluster.Type == OriginalDst {
+		// original destination clusters have no endpoints of their own
+		cluster.LbPolicy = ClusterProvidedLbV3
+		return cluster
+	}
+
+	lbEndpoints := []envoy.LbEndpoint{}
+	for _, host := range cluster.Hosts {
+		lbEndpoints = append(lbEndpoints, envoy.LbEndpoint{Endpoint: envoy.Endpoint{Address: host}})
+	}
+
+	cluster.LoadAssignment = &envoy.ClusterLoadAssignment{
+		ClusterName: cluster.Name,
+		Endpoints:   []envoy.LocalityLbEndpoints{{LbEndpoints: lbEndpoints}},
+	}
+	cluster.Hosts = nil
+	return cluster
+}
+
+// listenerV3 rewrites a listener into its v3 form, where the filters, access
+// logs and tls context are configured as typed extensions.
+func listenerV3(listener envoy.Resource) envoy.Resource {
+	listener.Type = ListenerTypeV3
+
+	filterChains := []envoy.FilterChain{}
+	for _, filterChain := range listener.FilterChains {
+		filters := []envoy.Filter{}
+		for _, filter := range filterChain.Filters {
+			filters = append(filters, filterV3(filter))
+		}
+		filterChain.Filters = filters
+
+		sdsSecretConfigs := []envoy.SDSSecretConfig{}
+		for _, sdsSecretConfig := range filterChain.TLSContext.CommonTLSContext.TLSCertificateSDSSecretConfigs {
+			sdsSecretConfig.SDSConfig.ResourceAPIVersion = ResourceAPIVersionV3
+			sdsSecretConfig.SDSConfig.APIConfigSource.TransportAPIVersion = ResourceAPIVersionV3
+			sdsSecretConfigs = append(sdsSecretConfigs, sdsSecretConfig)
+		}
+		if len(sdsSecretConfigs) > 0 {
+			filterChain.TLSContext.CommonTLSContext.TLSCertificateSDSSecretConfigs = sdsSecretConfigs
+		}
+
+		if !reflect.DeepEqual(filterChain.TLSContext, envoy.TLSContext{}) {
+			filterChain.TransportSocket = &envoy.TransportSocket{
+				Name: TLSTransportSocketV3,
+				TypedConfig: envoy.DownstreamTLSContext{
+					Type:       DownstreamTLSContextTypeV3,
+					TLSContext: filterChain.TLSContext,
+				},
+			}
+			filterChain.TLSContext = envoy.TLSContext{}
+		}
+
+		filterChains = append(filterChains, filterChain)
+	}
+	listener.FilterChains = filterChains
+
+	var listenerFilters []envoy.ListenerFilter
+	for _, listenerFilter := range listener.ListenerFilters {
+		if listenerFilter.Name == OriginalDstListenerFilter {
+			listenerFilter = envoy.ListenerFilter{
+				Name:        OriginalDstListenerFilterV3,
+				TypedConfig: &envoy.TypedExtension{Type: OriginalDstTypeV3},
+			}
+		}
+		listenerFilters = append(listenerFilters, listenerFilter)
+	}
+	listener.ListenerFilters = listenerFilters
+
+	return listener
+}
+
+func filterV3(filter envoy.Filter) envoy.Filter {
+	config := filter.Config
+
+	var accessLog []envoy.AccessLog
+	for _, log := range config.AccessLog {
+		accessLog = append(accessLog, envoy.AccessLog{
+			Name:        FileAccessLogV3,
+			TypedConfig: &envoy.AccessLogTypedConfig{Type: FileAccessLogTypeV3, Path: log.Config.Path},
+		})
+	}
+	config.AccessLog = accessLog
+
+	var httpFilters []envoy.HTTPFilter
+	for range config.HTTPFilters {
+		httpFilters = append(httpFilters, envoy.HTTPFilter{
+			Name:        HttpRouterV3,
+			TypedConfig: &envoy.TypedExtension{Type: HttpRouterTypeV3},
+		})
+	}
+	config.HTTPFilters = httpFilters
+
+	if filter.Name == HttpConnectionManager {
+		return envoy.Filter{
+			Name:        HttpConnectionManagerV3,
+			TypedConfig: &envoy.FilterTypedConfig{Type: HttpConnectionManagerTypeV3, Config: config},
+		}
+	}
+	return envoy.Filter{
+		Name:        TcpProxyV3,
+		TypedConfig: &envoy.FilterTypedConfig{Type: TcpProxyTypeV3, Config: config},
+	}
+}
+
+func (p *ProxyConfigHandler) tlsParams() (envoy.TLSParams, error) {
+	cipherSuites, err := formatCipherSuites(p.cipherSuites)
+	if err != nil {
+		return envoy.TLSParams{}, err
+	}
+
+	for _, version := range []string{p.tlsMinimumVersion, p.tlsMaximumVersion} {
+		err := validateTLSProtocolVersion(version)
+		if err != nil {
+			return envoy.TLSParams{}, err
+		}
+	}
+
+	return envoy.TLSParams{
+		CipherSuites:              cipherSuites,
+		TLSMinimumProtocolVersion: p.tlsMinimumVersion,
+		TLSMaximumProtocolVersion: p.tlsMaximumVersion,
+	}, nil
+}
+
+// validateTLSProtocolVersion accepts envoy's tls protocol names or no version.
+func validateTLSProtocolVersion(version string) error {
+	if version != "" && !validTLSProtocolVersions[version] {
+		return fmt.Errorf("invalid tls protocol version: %q", version)
+	}
+	return nil
+}
+
+// formatCipherSuites renders cipher suites in envoy's bracketed, pipe
+// separated form, falling back to SupportedCipherSuites.
+func formatCipherSuites(cipherSuites []string) (string, error) {
+	if len(cipherSuites) == 0 {
+		return SupportedCipherSuites, nil
+	}
+
+	for _, cipherSuite := range cipherSuites {
+		if cipherSuite == "" || strings.ContainsAny(cipherSuite, "|[]") {
+			return "", fmt.Errorf("invalid cipher suite: %q", cipherSuite)
+		}
+	}
+
+	return "[" + strings.Join(cipherSuites, "|") + "]", nil
+}
+
+func readTrustedCACerts(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trusted ca certs file: %s", err)
+	}
+
+	certs := []string{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		certs = append(certs, string(pem.EncodeToMemory(block)))
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in trusted ca certs file: %s", path)
+	}
+
+	return certs, nil
+}
+
 func pemConcatenate(certs []string) (string, error) {
 	var certificateBuf bytes.Buffer
 	for _, cert := range certs {
@@ -398,7 +2693,7 @@ func pemConcatenate(certs []string) (string, error) {
 	return certificateBuf.String(), nil
 }
 
-func getAvailablePort(allocatedPorts []executor.PortMapping, extraKnownPorts ...uint16) (uint16, error) {
+func getAvailablePort(startPort, endPort uint16, allocatedPorts []executor.PortMapping, extraKnownPorts ...uint16) (uint16, error) {
 	existingPorts := make(map[uint16]interface{})
 	for _, portMap := range allocatedPorts {
 		existingPorts[portMap.ContainerPort] = struct{}{}
@@ -409,7 +2704,7 @@ func getAvailablePort(allocatedPorts []executor.PortMapping, extraKnownPorts ...
 		existingPorts[extraKnownPort] = struct{}{}
 	}
 
-	for port := uint16(StartProxyPort); port < EndProxyPort; port++ {
+	for port := startPort; port < endPort; port++ {
 		if existingPorts[port] != nil {
 			continue
 		}
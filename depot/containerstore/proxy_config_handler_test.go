@@ -1,31 +1,48 @@
 package containerstore_test
 
 import (
+	"compress/gzip"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"math/big"
+	mathrand "math/rand"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"code.cloudfoundry.org/clock/fakeclock"
+	mfakes "code.cloudfoundry.org/diego-logging-client/testhelpers"
 	"code.cloudfoundry.org/executor"
 	"code.cloudfoundry.org/executor/depot/containerstore"
 	"code.cloudfoundry.org/executor/depot/containerstore/envoy"
 	"code.cloudfoundry.org/garden"
+	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/lager/lagertest"
+	multierror "github.com/hashicorp/go-multierror"
 	uuid "github.com/nu7hatch/gouuid"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/tedsuo/ifrit"
 	yaml "gopkg.in/yaml.v2"
 )
 
+var (
+	_ containerstore.ProxyConfigManager = &containerstore.ProxyConfigHandler{}
+	_ containerstore.ProxyConfigManager = &containerstore.NoopProxyConfigHandler{}
+)
+
 var _ = Describe("ProxyConfigHandler", func() {
 
 	var (
@@ -43,6 +60,8 @@ var _ = Describe("ProxyConfigHandler", func() {
 		containerProxyTrustedCACerts       []string
 		containerProxyVerifySubjectAltName []string
 		containerProxyRequireClientCerts   bool
+		opts                               []containerstore.ProxyConfigHandlerOption
+		validCert, validKey                string
 	)
 
 	BeforeEach(func() {
@@ -78,6 +97,9 @@ var _ = Describe("ProxyConfigHandler", func() {
 		containerProxyTrustedCACerts = []string{}
 		containerProxyVerifySubjectAltName = []string{}
 		containerProxyRequireClientCerts = false
+		opts = nil
+
+		validCert, validKey, _ = generateCertAndKey()
 	})
 
 	JustBeforeEach(func() {
@@ -90,6 +112,7 @@ var _ = Describe("ProxyConfigHandler", func() {
 			containerProxyRequireClientCerts,
 			reloadDuration,
 			reloadClock,
+			opts...,
 		)
 		Eventually(rotatingCredChan).Should(BeSent(containerstore.Credential{
 			Cert: "some-cert",
@@ -128,7 +151,7 @@ var _ = Describe("ProxyConfigHandler", func() {
 		Describe("Close", func() {
 			JustBeforeEach(func() {
 				Expect(proxyConfigFile).NotTo(BeAnExistingFile())
-				err := proxyConfigHandler.Update(containerstore.Credential{Cert: "cert", Key: "key"}, container)
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
 				Expect(err).NotTo(HaveOccurred())
 			})
 
@@ -140,7 +163,7 @@ var _ = Describe("ProxyConfigHandler", func() {
 		Describe("Update", func() {
 			JustBeforeEach(func() {
 				Expect(proxyConfigFile).NotTo(BeAnExistingFile())
-				err := proxyConfigHandler.Update(containerstore.Credential{Cert: "cert", Key: "key"}, container)
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
 				Expect(err).NotTo(HaveOccurred())
 			})
 
@@ -153,6 +176,23 @@ var _ = Describe("ProxyConfigHandler", func() {
 			ports, extraPorts := proxyConfigHandler.ProxyPorts(logger, &container)
 			Expect(ports).To(BeEmpty())
 			Expect(extraPorts).To(BeEmpty())
+			Expect(logger.Logs()).To(BeEmpty())
+		})
+
+		It("returns no admin port", func() {
+			adminPort, err := proxyConfigHandler.AdminPort(logger, container)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(adminPort).To(BeZero())
+		})
+
+		It("has no config files", func() {
+			Expect(proxyConfigHandler.ConfigFiles(container)).To(BeNil())
+		})
+
+		It("generates no config", func() {
+			data, err := proxyConfigHandler.GenerateConfig(containerstore.Credential{Cert: "cert", Key: "key"}, container)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data).To(BeNil())
 		})
 	})
 
@@ -229,84 +269,95 @@ var _ = Describe("ProxyConfigHandler", func() {
 		})
 	})
 
-	Describe("ProxyPorts", func() {
-		BeforeEach(func() {
-			container.Ports = []executor.PortMapping{
-				{
-					ContainerPort: 8080,
-				},
-				{
-					ContainerPort: 9090,
-				},
-			}
+	Describe("RemoveProxyConfigDir", func() {
+		It("removes the directory created by CreateDir", func() {
+			_, _, err := proxyConfigHandler.CreateDir(logger, container)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(configPath).To(BeADirectory())
+
+			err = proxyConfigHandler.RemoveProxyConfigDir(logger, container)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(configPath).NotTo(BeADirectory())
 		})
 
 		Context("the EnableContainerProxy is disabled on the container", func() {
 			BeforeEach(func() {
+				err := os.MkdirAll(configPath, 0755)
+				Expect(err).NotTo(HaveOccurred())
+
 				container.EnableContainerProxy = false
 			})
 
-			It("returns an empty proxy port mapping", func() {
-				ports, extraPorts := proxyConfigHandler.ProxyPorts(logger, &container)
-				Expect(ports).To(BeEmpty())
-				Expect(extraPorts).To(BeEmpty())
+			It("still removes the directory", func() {
+				err := proxyConfigHandler.RemoveProxyConfigDir(logger, container)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(configPath).NotTo(BeADirectory())
+			})
+
+			It("does not return an error when the directory does not exist", func() {
+				Expect(os.RemoveAll(configPath)).To(Succeed())
+
+				err := proxyConfigHandler.RemoveProxyConfigDir(logger, container)
+				Expect(err).NotTo(HaveOccurred())
 			})
 		})
+	})
 
-		It("each port gets an equivalent extra proxy port", func() {
-			ports, extraPorts := proxyConfigHandler.ProxyPorts(logger, &container)
-			Expect(ports).To(ConsistOf([]executor.ProxyPortMapping{
-				{
-					AppPort:   8080,
-					ProxyPort: 61001,
-				},
-				{
-					AppPort:   9090,
-					ProxyPort: 61002,
-				},
-			}))
+	Describe("ConfigFiles", func() {
+		BeforeEach(func() {
+			err := os.MkdirAll(configPath, 0755)
+			Expect(err).ToNot(HaveOccurred())
 
-			Expect(extraPorts).To(ConsistOf([]uint16{61001, 61002}))
+			container.Ports = []executor.PortMapping{
+				{ContainerPort: 8080, ContainerTLSProxyPort: 61001},
+			}
 		})
 
-		Context("when the requested ports are in the 6100n range", func() {
-			BeforeEach(func() {
+		It("returns the files Update writes", func() {
+			err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+			Expect(err).NotTo(HaveOccurred())
 
-				container.Ports = []executor.PortMapping{
-					{ContainerPort: 61001},
-					{ContainerPort: 9090},
+			written := []string{}
+			err = filepath.Walk(configPath, func(path string, info os.FileInfo, err error) error {
+				if err == nil && info.Mode().IsRegular() {
+					written = append(written, path)
 				}
+				return err
 			})
+			Expect(err).NotTo(HaveOccurred())
 
-			It("the additional proxy ports don't collide with requested ports", func() {
-				ports, extraPorts := proxyConfigHandler.ProxyPorts(logger, &container)
-				Expect(ports).To(ConsistOf([]executor.ProxyPortMapping{
-					{
-						AppPort:   61001,
-						ProxyPort: 61002,
-					},
-					{
-						AppPort:   9090,
-						ProxyPort: 61003,
-					},
-				}))
+			Expect(proxyConfigHandler.ConfigFiles(container)).To(ConsistOf(written))
+			Expect(written).To(ConsistOf(proxyConfigFile, listenerConfigFile))
+		})
 
-				Expect(extraPorts).To(ConsistOf([]uint16{61002, 61003}))
+		Context("with access logs and an admin socket inside the config mount", func() {
+			BeforeEach(func() {
+				opts = append(opts,
+					containerstore.WithAdminAccessLogPath("/etc/cf-assets/envoy_config/logs/admin.log"),
+					containerstore.WithAdminSocketPath("/etc/cf-assets/envoy_config/admin/envoy.sock"),
+					containerstore.WithListenerAccessLogPath("/etc/cf-assets/envoy_config/logs/access.log"),
+				)
+			})
+
+			It("includes them", func() {
+				Expect(proxyConfigHandler.ConfigFiles(container)).To(ConsistOf(
+					proxyConfigFile,
+					listenerConfigFile,
+					filepath.Join(configPath, "logs", "admin.log"),
+					filepath.Join(configPath, "admin", "envoy.sock"),
+					filepath.Join(configPath, "logs", "access.log"),
+				))
 			})
 		})
-	})
 
-	Describe("Update", func() {
-		BeforeEach(func() {
-			err := os.MkdirAll(configPath, 0755)
-			Expect(err).ToNot(HaveOccurred())
+		Context("with access logs outside of the config mount", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithListenerAccessLogPath("/var/log/access.log"))
+			})
 
-			container.Ports = []executor.PortMapping{
-				{
-					ContainerPort:         8080,
-					ContainerTLSProxyPort: 61001,
-				},
-			}
+			It("leaves them out", func() {
+				Expect(proxyConfigHandler.ConfigFiles(container)).To(ConsistOf(proxyConfigFile, listenerConfigFile))
+			})
 		})
 
 		Context("the EnableContainerProxy is disabled on the container", func() {
@@ -314,157 +365,3020 @@ var _ = Describe("ProxyConfigHandler", func() {
 				container.EnableContainerProxy = false
 			})
 
-			It("does not write a envoy config file", func() {
-				err := proxyConfigHandler.Update(containerstore.Credential{Cert: "", Key: ""}, container)
-				Expect(err).NotTo(HaveOccurred())
-
-				Expect(proxyConfigFile).NotTo(BeAnExistingFile())
+			It("returns no files", func() {
+				Expect(proxyConfigHandler.ConfigFiles(container)).To(BeNil())
 			})
 		})
+	})
 
-		It("creates the appropriate proxy config at start", func() {
-			err := proxyConfigHandler.Update(containerstore.Credential{Cert: "cert", Key: "key"}, container)
-			Expect(err).NotTo(HaveOccurred())
-
-			Eventually(proxyConfigFile).Should(BeAnExistingFile())
+	Describe("Validate", func() {
+		It("accepts the default configuration", func() {
+			Expect(proxyConfigHandler.Validate()).To(Succeed())
+		})
 
-			data, err := ioutil.ReadFile(proxyConfigFile)
-			Expect(err).NotTo(HaveOccurred())
+		Context("with valid trusted ca certs", func() {
+			BeforeEach(func() {
+				cert, _, _ := generateCertAndKey()
+				containerProxyTrustedCACerts = []string{cert}
+			})
 
-			var proxyConfig envoy.ProxyConfig
+			It("accepts them", func() {
+				Expect(proxyConfigHandler.Validate()).To(Succeed())
+			})
+		})
 
-			err = yaml.Unmarshal(data, &proxyConfig)
-			Expect(err).NotTo(HaveOccurred())
+		Context("with invalid trusted ca certs", func() {
+			BeforeEach(func() {
+				containerProxyTrustedCACerts = []string{"some-cert"}
+			})
 
-			admin := proxyConfig.Admin
-			Expect(admin.AccessLogPath).To(Equal("/dev/null"))
-			Expect(admin.Address).To(Equal(envoy.Address{SocketAddress: envoy.SocketAddress{Address: "127.0.0.1", PortValue: 61002}}))
+			It("reports them", func() {
+				Expect(proxyConfigHandler.Validate()).To(MatchError(ContainSubstring("invalid trusted ca certs")))
+			})
+		})
 
-			Expect(proxyConfig.StaticResources.Clusters).To(HaveLen(1))
-			cluster := proxyConfig.StaticResources.Clusters[0]
-			Expect(cluster.Name).To(Equal("0-service-cluster"))
-			Expect(cluster.ConnectionTimeout).To(Equal("0.25s"))
-			Expect(cluster.Type).To(Equal("STATIC"))
-			Expect(cluster.LbPolicy).To(Equal("ROUND_ROBIN"))
-			Expect(cluster.Hosts).To(Equal([]envoy.Address{
-				{SocketAddress: envoy.SocketAddress{Address: "10.0.0.1", PortValue: 8080}},
-			}))
-			Expect(cluster.CircuitBreakers.Thresholds).To(HaveLen(1))
-			Expect(cluster.CircuitBreakers.Thresholds[0].MaxConnections).To(BeNumerically("==", math.MaxUint32))
+		Context("with a malformed cipher suite", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithCipherSuites([]string{"ECDHE-RSA-AES128-GCM-SHA256|RC4"}))
+			})
 
-			Expect(proxyConfig.DynamicResources.LDSConfig).To(Equal(envoy.LDSConfig{
-				Path: "/etc/cf-assets/envoy_config/listeners.yaml",
-			}))
+			It("reports it", func() {
+				Expect(proxyConfigHandler.Validate()).To(MatchError(ContainSubstring("invalid cipher suite")))
+			})
 		})
 
-		Context("for listener config", func() {
-			var listenerConfig envoy.ListenerConfig
+		Context("with an invalid sni certificate", func() {
 			BeforeEach(func() {
-				containerProxyRequireClientCerts = true
+				opts = append(opts, containerstore.WithSNICertificates([]containerstore.SNICertificate{
+					{ServerNames: []string{"app.example.com"}, Cert: "some-cert", Key: "some-key"},
+				}))
 			})
 
-			Context("with invalid trusted cert", func() {
-				BeforeEach(func() {
-					containerProxyTrustedCACerts = []string{"some-cert"}
-				})
+			It("reports it", func() {
+				Expect(proxyConfigHandler.Validate()).To(MatchError(ContainSubstring("invalid sni certificate for app.example.com")))
+			})
+		})
 
-				It("should error out", func() {
-					err := proxyConfigHandler.Update(containerstore.Credential{Cert: "cert", Key: "key"}, container)
-					Expect(err).To(MatchError("failed to read certificate."))
-				})
+		Context("with an sni certificate without server names", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithSNICertificates([]containerstore.SNICertificate{
+					{Cert: validCert, Key: validKey},
+				}))
 			})
 
-			Context("with valid config", func() {
-				JustBeforeEach(func() {
-					err := proxyConfigHandler.Update(containerstore.Credential{Cert: "cert", Key: "key"}, container)
-					Expect(err).NotTo(HaveOccurred())
-					Eventually(listenerConfigFile).Should(BeAnExistingFile())
+			It("reports it", func() {
+				Expect(proxyConfigHandler.Validate()).To(MatchError(ContainSubstring("sni certificate has no server names")))
+			})
+		})
 
-					data, err := ioutil.ReadFile(listenerConfigFile)
-					Expect(err).NotTo(HaveOccurred())
+		Context("with a typed subject alt name of an unknown type", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithTypedSubjectAltNames([]containerstore.TypedSubjectAltName{
+					{Type: "SPIFFE", Matcher: "spiffe://cf.example.com/app"},
+				}))
+			})
 
-					err = yaml.Unmarshal(data, &listenerConfig)
-					Expect(err).NotTo(HaveOccurred())
-					Expect(listenerConfig.Resources).To(HaveLen(1))
-				})
+			It("returns an error", func() {
+				Expect(proxyConfigHandler.Validate()).To(MatchError(ContainSubstring(`invalid subject alt name type for spiffe://cf.example.com/app: "SPIFFE"`)))
+			})
+		})
 
-				It("writes the initial listener config at start", func() {
-					listener := listenerConfig.Resources[0]
+		Context("with an sds server without a port", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithSDSServer("sds.service.internal", 0))
+			})
 
-					Expect(listener.Type).To(Equal("type.googleapis.com/envoy.api.v2.Listener"))
-					Expect(listener.Name).To(Equal("listener-8080"))
-					Expect(listener.Address).To(Equal(envoy.Address{SocketAddress: envoy.SocketAddress{Address: "0.0.0.0", PortValue: 61001}}))
-					Expect(listener.FilterChains).To(HaveLen(1))
+			It("returns an error", func() {
+				Expect(proxyConfigHandler.Validate()).To(MatchError(ContainSubstring("invalid sds server: sds.service.internal has no port")))
+			})
+		})
 
-					chain := listener.FilterChains[0]
-					certs := chain.TLSContext.CommonTLSContext.TLSCertificates
-					validations := chain.TLSContext.CommonTLSContext.ValidationContext
-					Expect(chain.TLSContext.RequireClientCertificate).To(BeTrue())
-					Expect(certs).To(ConsistOf(envoy.TLSCertificate{
-						CertificateChain: envoy.DataSource{InlineString: "cert"},
-						PrivateKey:       envoy.DataSource{InlineString: "key"},
-					}))
-					Expect(validations.TrustedCA).To(Equal(envoy.DataSource{InlineString: ""}))
-					Expect(validations.VerifySubjectAltName).To(BeNil())
-					Expect(chain.TLSContext.CommonTLSContext.TLSParams.CipherSuites).To(Equal("[ECDHE-RSA-AES256-GCM-SHA384|ECDHE-RSA-AES128-GCM-SHA256]"))
+		Context("with a valid lb policy", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithLbPolicy("RANDOM"))
+			})
 
-					Expect(chain.Filters).To(HaveLen(1))
-					filter := chain.Filters[0]
-					Expect(filter.Name).To(Equal("envoy.tcp_proxy"))
-					Expect(filter.Config.Cluster).To(Equal("0-service-cluster"))
-					Expect(filter.Config.StatPrefix).NotTo(BeEmpty())
-				})
+			It("accepts it", func() {
+				Expect(proxyConfigHandler.Validate()).To(Succeed())
+			})
+		})
 
-				Context("with container proxy trusted certs set", func() {
-					var inlinedCert string
-					BeforeEach(func() {
-						cert, _, _ := generateCertAndKey()
-						inlinedCert = fmt.Sprintf("%s%s", cert, cert)
-						containerProxyTrustedCACerts = []string{cert, cert}
-						containerProxyVerifySubjectAltName = []string{"valid-alt-name-1", "valid-alt-name-2"}
-					})
+		Context("with an invalid lb policy", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithLbPolicy("least_request"))
+			})
 
-					It("writes trusted certs info into listener config", func() {
-						listener := listenerConfig.Resources[0]
-						chain := listener.FilterChains[0]
-						validations := chain.TLSContext.CommonTLSContext.ValidationContext
-						Expect(validations.TrustedCA).To(Equal(envoy.DataSource{InlineString: inlinedCert}))
-						Expect(validations.VerifySubjectAltName).To(ConsistOf("valid-alt-name-1", "valid-alt-name-2"))
-					})
-				})
+			It("returns an error", func() {
+				Expect(proxyConfigHandler.Validate()).To(MatchError(ContainSubstring(`invalid lb policy: "least_request"`)))
 			})
 		})
 
-		Context("with multiple port mappings", func() {
+		Context("with an invalid egress allowlist", func() {
 			BeforeEach(func() {
-				container.Ports = []executor.PortMapping{
-					executor.PortMapping{
-						ContainerPort:         8080,
-						ContainerTLSProxyPort: 61001,
-					},
-					executor.PortMapping{
-						ContainerPort:         2222,
-						ContainerTLSProxyPort: 61002,
-					},
-				}
+				opts = append(opts, containerstore.WithEgressAllowlist(61005, []string{"10.10.0.0/16", "10.300.0.0/16"}))
 			})
 
-			It("creates the appropriate listener config with a unique stat prefix", func() {
-				err := proxyConfigHandler.Update(containerstore.Credential{Cert: "cert", Key: "key"}, container)
-				Expect(err).NotTo(HaveOccurred())
-				Eventually(listenerConfigFile).Should(BeAnExistingFile())
+			It("reports the port and the cidr", func() {
+				err := proxyConfigHandler.Validate()
+				Expect(err).To(MatchError(ContainSubstring("invalid egress port: 61005")))
+				Expect(err).To(MatchError(ContainSubstring(`invalid egress cidr: "10.300.0.0/16"`)))
+			})
+		})
 
-				data, err := ioutil.ReadFile(listenerConfigFile)
-				Expect(err).NotTo(HaveOccurred())
+		Context("with an egress port at the exclusive end of the proxy port range", func() {
+			BeforeEach(func() {
+				opts = append(opts,
+					containerstore.WithProxyPortRange(61001, 62001),
+					containerstore.WithEgressAllowlist(62001, []string{"10.10.0.0/16"}),
+				)
+			})
 
-				var listenerConfig envoy.ListenerConfig
+			It("accepts it", func() {
+				Expect(proxyConfigHandler.Validate()).To(Succeed())
+			})
+		})
 
-				err = yaml.Unmarshal(data, &listenerConfig)
-				Expect(err).NotTo(HaveOccurred())
+		Context("with a reload jitter above one", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithReloadJitter(1.5, nil))
+			})
 
-				Expect(listenerConfig.Resources).To(HaveLen(2))
+			It("returns an error", func() {
+				Expect(proxyConfigHandler.Validate()).To(MatchError(ContainSubstring("invalid reload jitter: 1.5")))
+			})
+		})
 
-				listener := listenerConfig.Resources[0]
+		Context("with an invalid listener bind address", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithListenerBindAddress("not-an-ip"))
+			})
+
+			It("reports it", func() {
+				Expect(proxyConfigHandler.Validate()).To(MatchError(ContainSubstring(`invalid listener bind address: "not-an-ip"`)))
+			})
+		})
+
+		Context("with a missing trusted ca certs file", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithTrustedCACertsFile(filepath.Join(proxyDir, "does-not-exist")))
+			})
+
+			It("reports it", func() {
+				Expect(proxyConfigHandler.Validate()).To(MatchError(ContainSubstring("failed to read trusted ca certs file")))
+			})
+		})
+
+		Context("with several problems", func() {
+			BeforeEach(func() {
+				containerProxyTrustedCACerts = []string{"some-cert"}
+				opts = append(opts,
+					containerstore.WithCipherSuites([]string{"[RC4]"}),
+					containerstore.WithTLSProtocolVersions("TLSv0_9", "TLSv9_9"),
+					containerstore.WithProxyPortRange(62003, 62000),
+				)
+			})
+
+			It("reports all of them", func() {
+				err := proxyConfigHandler.Validate()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("invalid cipher suite"))
+				Expect(err.Error()).To(ContainSubstring(`invalid tls protocol version: "TLSv0_9"`))
+				Expect(err.Error()).To(ContainSubstring(`invalid tls protocol version: "TLSv9_9"`))
+				Expect(err.Error()).To(ContainSubstring("invalid proxy port range: 62003-62000"))
+				Expect(err.Error()).To(ContainSubstring("invalid trusted ca certs"))
+			})
+		})
+	})
+
+	Describe("Reap", func() {
+		var knownDir, unknownDir, regularFile string
+
+		BeforeEach(func() {
+			knownDir = filepath.Join(proxyConfigDir, "known-guid")
+			unknownDir = filepath.Join(proxyConfigDir, "unknown-guid")
+			regularFile = filepath.Join(proxyConfigDir, "not-a-dir")
+
+			Expect(os.MkdirAll(knownDir, 0755)).To(Succeed())
+			Expect(os.MkdirAll(unknownDir, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(regularFile, []byte("data"), 0644)).To(Succeed())
+		})
+
+		It("removes the directories of unknown containers", func() {
+			err := proxyConfigHandler.Reap([]string{"known-guid"})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(unknownDir).NotTo(BeADirectory())
+		})
+
+		It("keeps the directories of known containers", func() {
+			err := proxyConfigHandler.Reap([]string{"known-guid"})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(knownDir).To(BeADirectory())
+		})
+
+		It("ignores entries that are not directories", func() {
+			err := proxyConfigHandler.Reap([]string{"known-guid"})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(regularFile).To(BeARegularFile())
+		})
+
+		It("logs the reaped directories", func() {
+			err := proxyConfigHandler.Reap([]string{"known-guid"})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(logger).To(gbytes.Say("reaped-proxy-config-dir.*unknown-guid"))
+		})
+
+		Context("when the proxy config path does not exist", func() {
+			BeforeEach(func() {
+				Expect(os.RemoveAll(proxyConfigDir)).To(Succeed())
+			})
+
+			It("does not return an error", func() {
+				err := proxyConfigHandler.Reap([]string{"known-guid"})
+				Expect(err).NotTo(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("ProxyPorts", func() {
+		BeforeEach(func() {
+			container.Ports = []executor.PortMapping{
+				{
+					ContainerPort: 8080,
+				},
+				{
+					ContainerPort: 9090,
+				},
+			}
+		})
+
+		Context("the EnableContainerProxy is disabled on the container", func() {
+			BeforeEach(func() {
+				container.EnableContainerProxy = false
+			})
+
+			It("returns an empty proxy port mapping", func() {
+				ports, extraPorts := proxyConfigHandler.ProxyPorts(logger, &container)
+				Expect(ports).To(BeEmpty())
+				Expect(extraPorts).To(BeEmpty())
+			})
+		})
+
+		It("each port gets an equivalent extra proxy port", func() {
+			ports, extraPorts := proxyConfigHandler.ProxyPorts(logger, &container)
+			Expect(ports).To(ConsistOf([]executor.ProxyPortMapping{
+				{
+					AppPort:   8080,
+					ProxyPort: 61001,
+				},
+				{
+					AppPort:   9090,
+					ProxyPort: 61002,
+				},
+			}))
+
+			Expect(extraPorts).To(ConsistOf([]uint16{61001, 61002}))
+		})
+
+		Context("with a port bypassing the proxy", func() {
+			BeforeEach(func() {
+				container.Ports[0].DisableContainerProxy = true
+			})
+
+			It("gives it no proxy port", func() {
+				ports, extraPorts := proxyConfigHandler.ProxyPorts(logger, &container)
+				Expect(ports).To(Equal([]executor.ProxyPortMapping{
+					{AppPort: 9090, ProxyPort: 61001},
+				}))
+				Expect(extraPorts).To(Equal([]uint16{61001}))
+				Expect(logger).NotTo(gbytes.Say("failed-to-assign-all-proxy-ports"))
+			})
+
+			Context("with deterministic proxy ports", func() {
+				BeforeEach(func() {
+					opts = append(opts, containerstore.WithDeterministicProxyPorts(true))
+				})
+
+				It("gives it no proxy port either", func() {
+					ports, _ := proxyConfigHandler.ProxyPorts(logger, &container)
+					Expect(ports).To(HaveLen(1))
+					Expect(ports[0].AppPort).To(Equal(uint16(9090)))
+				})
+			})
+		})
+
+		It("logs each assigned proxy port and a summary", func() {
+			proxyConfigHandler.ProxyPorts(logger, &container)
+
+			var mappingLogs []lager.LogFormat
+			var summaryLogs []lager.LogFormat
+			for _, log := range logger.Logs() {
+				if strings.HasSuffix(log.Message, "proxy-ports.assigned-proxy-port") {
+					mappingLogs = append(mappingLogs, log)
+				}
+				if strings.HasSuffix(log.Message, "proxy-ports.assigned-proxy-ports") {
+					summaryLogs = append(summaryLogs, log)
+				}
+			}
+
+			Expect(mappingLogs).To(HaveLen(2))
+			Expect(mappingLogs[0].LogLevel).To(Equal(lager.DEBUG))
+			Expect(mappingLogs[0].Data).To(HaveKeyWithValue("container-guid", container.Guid))
+			Expect(mappingLogs[0].Data).To(HaveKeyWithValue("app-port", BeNumerically("==", 8080)))
+			Expect(mappingLogs[0].Data).To(HaveKeyWithValue("proxy-port", BeNumerically("==", 61001)))
+			Expect(mappingLogs[1].Data).To(HaveKeyWithValue("app-port", BeNumerically("==", 9090)))
+			Expect(mappingLogs[1].Data).To(HaveKeyWithValue("proxy-port", BeNumerically("==", 61002)))
+
+			Expect(summaryLogs).To(HaveLen(1))
+			Expect(summaryLogs[0].LogLevel).To(Equal(lager.INFO))
+			Expect(summaryLogs[0].Data).To(HaveKeyWithValue("container-guid", container.Guid))
+			Expect(summaryLogs[0].Data).To(HaveKeyWithValue("count", BeNumerically("==", 2)))
+		})
+
+		Context("with a custom proxy port range", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithProxyPortRange(62000, 62002))
+			})
+
+			It("allocates proxy ports from that range", func() {
+				ports, extraPorts := proxyConfigHandler.ProxyPorts(logger, &container)
+				Expect(ports).To(ConsistOf([]executor.ProxyPortMapping{
+					{
+						AppPort:   8080,
+						ProxyPort: 62000,
+					},
+					{
+						AppPort:   9090,
+						ProxyPort: 62001,
+					},
+				}))
+
+				Expect(extraPorts).To(ConsistOf([]uint16{62000, 62001}))
+			})
+		})
+
+		Context("when the proxy port range is too small for every app port", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithProxyPortRange(62000, 62001))
+			})
+
+			It("returns a partial mapping and logs the failure", func() {
+				ports, extraPorts := proxyConfigHandler.ProxyPorts(logger, &container)
+				Expect(ports).To(HaveLen(1))
+				Expect(extraPorts).To(HaveLen(1))
+				Expect(logger).To(gbytes.Say("proxy-ports.failed-to-assign-all-proxy-ports"))
+			})
+
+			It("makes AllProxyPorts fail", func() {
+				ports, extraPorts, err := proxyConfigHandler.AllProxyPorts(logger, &container)
+				Expect(err).To(Equal(containerstore.ErrNoPortsAvailable))
+				Expect(ports).To(BeNil())
+				Expect(extraPorts).To(BeNil())
+			})
+		})
+
+		Describe("AllProxyPorts", func() {
+			It("returns the proxy port mapping when every app port gets a proxy port", func() {
+				ports, extraPorts, err := proxyConfigHandler.AllProxyPorts(logger, &container)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ports).To(ConsistOf([]executor.ProxyPortMapping{
+					{AppPort: 8080, ProxyPort: 61001},
+					{AppPort: 9090, ProxyPort: 61002},
+				}))
+				Expect(extraPorts).To(ConsistOf([]uint16{61001, 61002}))
+			})
+
+			Context("the EnableContainerProxy is disabled on the container", func() {
+				BeforeEach(func() {
+					container.EnableContainerProxy = false
+				})
+
+				It("returns an empty proxy port mapping", func() {
+					ports, extraPorts, err := proxyConfigHandler.AllProxyPorts(logger, &container)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(ports).To(BeEmpty())
+					Expect(extraPorts).To(BeEmpty())
+				})
+			})
+		})
+
+		Context("with deterministic proxy ports", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithDeterministicProxyPorts(true))
+			})
+
+			It("maps app ports to the same proxy ports regardless of their order", func() {
+				ports, extraPorts := proxyConfigHandler.ProxyPorts(logger, &container)
+				Expect(ports).To(HaveLen(2))
+				Expect(extraPorts).To(HaveLen(2))
+
+				container.Ports = []executor.PortMapping{
+					{
+						ContainerPort: 9090,
+					},
+					{
+						ContainerPort: 8080,
+					},
+				}
+
+				reorderedPorts, reorderedExtraPorts := proxyConfigHandler.ProxyPorts(logger, &container)
+				Expect(reorderedPorts).To(ConsistOf(ports))
+				Expect(reorderedExtraPorts).To(ConsistOf(extraPorts))
+			})
+
+			It("keeps the proxy port of an app port when other ports are removed", func() {
+				ports, _ := proxyConfigHandler.ProxyPorts(logger, &container)
+
+				container.Ports = []executor.PortMapping{
+					{
+						ContainerPort: 9090,
+					},
+				}
+
+				remainingPorts, _ := proxyConfigHandler.ProxyPorts(logger, &container)
+				Expect(remainingPorts).To(HaveLen(1))
+				Expect(ports).To(ContainElement(remainingPorts[0]))
+			})
+
+			It("allocates proxy ports within the proxy port range", func() {
+				_, extraPorts := proxyConfigHandler.ProxyPorts(logger, &container)
+				for _, port := range extraPorts {
+					Expect(port).To(BeNumerically(">=", containerstore.StartProxyPort))
+					Expect(port).To(BeNumerically("<", containerstore.EndProxyPort))
+				}
+			})
+
+			Context("when the hashed proxy ports collide", func() {
+				BeforeEach(func() {
+					opts = append(opts, containerstore.WithProxyPortRange(62000, 62002))
+					container.Ports = []executor.PortMapping{
+						{
+							ContainerPort: 8080,
+						},
+						{
+							ContainerPort: 9090,
+						},
+						{
+							ContainerPort: 62000,
+						},
+					}
+				})
+
+				It("falls back to the next free port in the range", func() {
+					ports, extraPorts := proxyConfigHandler.ProxyPorts(logger, &container)
+					Expect(extraPorts).To(ConsistOf([]uint16{62001}))
+					Expect(ports).To(HaveLen(1))
+					Expect(ports[0].ProxyPort).To(Equal(uint16(62001)))
+				})
+			})
+		})
+
+		Context("when the requested ports are in the 6100n range", func() {
+			BeforeEach(func() {
+
+				container.Ports = []executor.PortMapping{
+					{ContainerPort: 61001},
+					{ContainerPort: 9090},
+				}
+			})
+
+			It("the additional proxy ports don't collide with requested ports", func() {
+				ports, extraPorts := proxyConfigHandler.ProxyPorts(logger, &container)
+				Expect(ports).To(ConsistOf([]executor.ProxyPortMapping{
+					{
+						AppPort:   61001,
+						ProxyPort: 61002,
+					},
+					{
+						AppPort:   9090,
+						ProxyPort: 61003,
+					},
+				}))
+
+				Expect(extraPorts).To(ConsistOf([]uint16{61002, 61003}))
+			})
+
+			It("returns the mappings sorted by app port", func() {
+				ports, extraPorts := proxyConfigHandler.ProxyPorts(logger, &container)
+				Expect(ports).To(Equal([]executor.ProxyPortMapping{
+					{
+						AppPort:   9090,
+						ProxyPort: 61003,
+					},
+					{
+						AppPort:   61001,
+						ProxyPort: 61002,
+					},
+				}))
+
+				Expect(extraPorts).To(Equal([]uint16{61003, 61002}))
+			})
+		})
+
+		Context("when the ports are not in app port order", func() {
+			BeforeEach(func() {
+				container.Ports = []executor.PortMapping{
+					{ContainerPort: 9090},
+					{ContainerPort: 2222},
+					{ContainerPort: 8080},
+				}
+			})
+
+			It("returns the mappings sorted by app port", func() {
+				ports, extraPorts := proxyConfigHandler.ProxyPorts(logger, &container)
+				Expect(ports).To(HaveLen(3))
+				Expect(ports[0].AppPort).To(Equal(uint16(2222)))
+				Expect(ports[1].AppPort).To(Equal(uint16(8080)))
+				Expect(ports[2].AppPort).To(Equal(uint16(9090)))
+
+				Expect(extraPorts).To(Equal([]uint16{ports[0].ProxyPort, ports[1].ProxyPort, ports[2].ProxyPort}))
+			})
+
+			It("keeps the admin port clear of the requested and proxy ports", func() {
+				ports, _ := proxyConfigHandler.ProxyPorts(logger, &container)
+				for i, mapping := range ports {
+					container.Ports[i].ContainerTLSProxyPort = mapping.ProxyPort
+					container.Ports[i].ContainerPort = mapping.AppPort
+				}
+
+				adminPort, err := proxyConfigHandler.AdminPort(logger, container)
+				Expect(err).NotTo(HaveOccurred())
+				for _, mapping := range ports {
+					Expect(adminPort).NotTo(Equal(mapping.AppPort))
+					Expect(adminPort).NotTo(Equal(mapping.ProxyPort))
+				}
+			})
+		})
+	})
+
+	Describe("Update", func() {
+		BeforeEach(func() {
+			err := os.MkdirAll(configPath, 0755)
+			Expect(err).ToNot(HaveOccurred())
+
+			container.Ports = []executor.PortMapping{
+				{
+					ContainerPort:         8080,
+					ContainerTLSProxyPort: 61001,
+				},
+			}
+		})
+
+		Context("the EnableContainerProxy is disabled on the container", func() {
+			BeforeEach(func() {
+				container.EnableContainerProxy = false
+			})
+
+			It("does not write a envoy config file", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: "", Key: ""}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(proxyConfigFile).NotTo(BeAnExistingFile())
+			})
+		})
+
+		It("creates the appropriate proxy config at start", func() {
+			err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+			Expect(err).NotTo(HaveOccurred())
+
+			Eventually(proxyConfigFile).Should(BeAnExistingFile())
+
+			data, err := ioutil.ReadFile(proxyConfigFile)
+			Expect(err).NotTo(HaveOccurred())
+
+			var proxyConfig envoy.ProxyConfig
+
+			err = yaml.Unmarshal(data, &proxyConfig)
+			Expect(err).NotTo(HaveOccurred())
+
+			admin := proxyConfig.Admin
+			Expect(admin.AccessLogPath).To(Equal("/dev/null"))
+			Expect(admin.Address).To(Equal(envoy.Address{SocketAddress: envoy.SocketAddress{Address: "127.0.0.1", PortValue: 61002}}))
+
+			Expect(proxyConfig.StaticResources.Clusters).To(HaveLen(1))
+			cluster := proxyConfig.StaticResources.Clusters[0]
+			Expect(cluster.Name).To(Equal("0-service-cluster"))
+			Expect(cluster.ConnectionTimeout).To(Equal("0.25s"))
+			Expect(cluster.Type).To(Equal("STATIC"))
+			Expect(cluster.LbPolicy).To(Equal("ROUND_ROBIN"))
+			Expect(cluster.Hosts).To(Equal([]envoy.Address{
+				{SocketAddress: envoy.SocketAddress{Address: "10.0.0.1", PortValue: 8080}},
+			}))
+			Expect(cluster.CircuitBreakers.Thresholds).To(HaveLen(1))
+			Expect(cluster.CircuitBreakers.Thresholds[0].MaxConnections).To(BeNumerically("==", math.MaxUint32))
+
+			Expect(proxyConfig.DynamicResources.LDSConfig).To(Equal(envoy.LDSConfig{
+				Path: "/etc/cf-assets/envoy_config/listeners.yaml",
+			}))
+		})
+
+		Context("with additional internal ips", func() {
+			BeforeEach(func() {
+				container.Ports = append(container.Ports, executor.PortMapping{
+					ContainerPort:         2222,
+					ContainerTLSProxyPort: 61002,
+				})
+				container.AdditionalInternalIPs = []string{"10.0.0.2"}
+			})
+
+			It("adds a host per ip to each service cluster", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				proxyConfig := readProxyConfig(proxyConfigFile)
+				Expect(proxyConfig.StaticResources.Clusters).To(HaveLen(2))
+
+				Expect(proxyConfig.StaticResources.Clusters[0].LbPolicy).To(Equal("ROUND_ROBIN"))
+				Expect(proxyConfig.StaticResources.Clusters[0].Hosts).To(Equal([]envoy.Address{
+					{SocketAddress: envoy.SocketAddress{Address: "10.0.0.1", PortValue: 8080}},
+					{SocketAddress: envoy.SocketAddress{Address: "10.0.0.2", PortValue: 8080}},
+				}))
+
+				Expect(proxyConfig.StaticResources.Clusters[1].LbPolicy).To(Equal("ROUND_ROBIN"))
+				Expect(proxyConfig.StaticResources.Clusters[1].Hosts).To(Equal([]envoy.Address{
+					{SocketAddress: envoy.SocketAddress{Address: "10.0.0.1", PortValue: 2222}},
+					{SocketAddress: envoy.SocketAddress{Address: "10.0.0.2", PortValue: 2222}},
+				}))
+			})
+		})
+
+		Context("with an lb policy configured", func() {
+			BeforeEach(func() {
+				opts = append(opts,
+					containerstore.WithLbPolicy("LEAST_REQUEST"),
+					containerstore.WithSDSServer("10.255.0.9", 8234),
+				)
+			})
+
+			It("uses it for the service clusters only", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				clusters := readProxyConfig(proxyConfigFile).StaticResources.Clusters
+				Expect(clusters).To(HaveLen(2))
+				Expect(clusters[0].LbPolicy).To(Equal("LEAST_REQUEST"))
+				Expect(clusters[1].Name).To(Equal("sds-grpc"))
+				Expect(clusters[1].LbPolicy).To(Equal("ROUND_ROBIN"))
+			})
+		})
+
+		Context("with an invalid lb policy", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithLbPolicy("least_request"))
+			})
+
+			It("returns an error without writing the config", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).To(MatchError(`invalid lb policy: "least_request"`))
+
+				Expect(proxyConfigFile).NotTo(BeAnExistingFile())
+				Expect(listenerConfigFile).NotTo(BeAnExistingFile())
+			})
+		})
+
+		Context("with an invalid listener bind address", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithListenerBindAddress("not-an-ip"))
+			})
+
+			It("returns an error without writing the config", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).To(MatchError(`invalid listener bind address: "not-an-ip"`))
+				Expect(proxyConfigFile).NotTo(BeAnExistingFile())
+				Expect(listenerConfigFile).NotTo(BeAnExistingFile())
+			})
+		})
+
+		Context("with a tls proxy port shared by two container ports", func() {
+			BeforeEach(func() {
+				container.Ports = append(container.Ports, executor.PortMapping{
+					ContainerPort:         2222,
+					ContainerTLSProxyPort: 61001,
+				})
+			})
+
+			It("returns an error without writing the config", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).To(MatchError("tls proxy port 61001 is shared by container ports 8080 and 2222"))
+				Expect(proxyConfigFile).NotTo(BeAnExistingFile())
+				Expect(listenerConfigFile).NotTo(BeAnExistingFile())
+			})
+		})
+
+		Context("with a tls proxy port outside of the proxy port range", func() {
+			BeforeEach(func() {
+				container.Ports = append(container.Ports, executor.PortMapping{
+					ContainerPort:         2222,
+					ContainerTLSProxyPort: 2223,
+				})
+			})
+
+			It("returns an error", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).To(MatchError("tls proxy port 2223 of container port 2222 is outside of the proxy port range 61001-65534"))
+			})
+		})
+
+		Context("without an internal ip", func() {
+			BeforeEach(func() {
+				container.InternalIP = ""
+			})
+
+			It("returns an error without writing the config", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).To(MatchError(`invalid container internal ip: ""`))
+				Expect(proxyConfigFile).NotTo(BeAnExistingFile())
+				Expect(listenerConfigFile).NotTo(BeAnExistingFile())
+			})
+		})
+
+		Context("with a malformed internal ip", func() {
+			BeforeEach(func() {
+				container.InternalIP = "not-an-ip"
+			})
+
+			It("returns an error", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).To(MatchError(`invalid container internal ip: "not-an-ip"`))
+			})
+		})
+
+		Context("with a malformed additional internal ip", func() {
+			BeforeEach(func() {
+				container.AdditionalInternalIPs = []string{"10.0.0.256"}
+			})
+
+			It("returns an error", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).To(MatchError(`invalid container internal ip: "10.0.0.256"`))
+			})
+		})
+
+		Context("with an sds server", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithSDSServer("10.255.0.9", 8234))
+			})
+
+			It("adds an http2 cluster for it", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				clusters := readProxyConfig(proxyConfigFile).StaticResources.Clusters
+				Expect(clusters).To(HaveLen(2))
+				Expect(clusters[1].Name).To(Equal("sds-grpc"))
+				Expect(clusters[1].Type).To(Equal("STATIC"))
+				Expect(clusters[1].Hosts).To(Equal([]envoy.Address{
+					{SocketAddress: envoy.SocketAddress{Address: "10.255.0.9", PortValue: 8234}},
+				}))
+				Expect(clusters[1].HTTP2ProtocolOptions).NotTo(BeNil())
+			})
+
+			It("gives it an unlimited circuit breaker", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				clusters := readProxyConfig(proxyConfigFile).StaticResources.Clusters
+				Expect(clusters[1].CircuitBreakers.Thresholds).To(Equal([]envoy.Threshold{
+					{MaxConnections: math.MaxUint32},
+				}))
+			})
+
+			Context("with sds cluster circuit breaker thresholds configured", func() {
+				BeforeEach(func() {
+					opts = append(opts,
+						containerstore.WithCircuitBreakerThresholds(1024, 512, 2048),
+						containerstore.WithSDSClusterCircuitBreakerThresholds(16, 8, 32),
+					)
+				})
+
+				It("limits the sds cluster independently of the service clusters", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).NotTo(HaveOccurred())
+
+					clusters := readProxyConfig(proxyConfigFile).StaticResources.Clusters
+					Expect(clusters[0].CircuitBreakers.Thresholds).To(Equal([]envoy.Threshold{
+						{MaxConnections: 1024, MaxPendingRequests: 512, MaxRequests: 2048},
+					}))
+					Expect(clusters[1].CircuitBreakers.Thresholds).To(Equal([]envoy.Threshold{
+						{MaxConnections: 16, MaxPendingRequests: 8, MaxRequests: 32},
+					}))
+				})
+			})
+
+			Context("with sds cluster circuit breakers disabled", func() {
+				BeforeEach(func() {
+					opts = append(opts, containerstore.WithSDSClusterCircuitBreakers(false))
+				})
+
+				It("omits the circuit breakers of the sds cluster only", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).NotTo(HaveOccurred())
+
+					clusters := readProxyConfig(proxyConfigFile).StaticResources.Clusters
+					Expect(clusters[0].CircuitBreakers.Thresholds).To(HaveLen(1))
+					Expect(clusters[1].CircuitBreakers.Thresholds).To(BeEmpty())
+
+					data, err := ioutil.ReadFile(proxyConfigFile)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(strings.Count(string(data), "circuit_breakers")).To(Equal(1))
+				})
+			})
+
+			Context("when an extra cluster is named like it", func() {
+				BeforeEach(func() {
+					container.ContainerProxyExtraClusters = []executor.ProxyCluster{
+						{Name: "sds-grpc", Host: "10.1.0.5", Port: 9090},
+					}
+				})
+
+				It("returns an error", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).To(MatchError(`invalid extra cluster name: "sds-grpc"`))
+				})
+			})
+		})
+
+		It("does not add an sds cluster", func() {
+			err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+			Expect(err).NotTo(HaveOccurred())
+
+			data, err := ioutil.ReadFile(proxyConfigFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).NotTo(ContainSubstring("sds-grpc"))
+			Expect(string(data)).NotTo(ContainSubstring("http2_protocol_options"))
+		})
+
+		Context("with an egress allowlist", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithEgressAllowlist(15001, []string{"10.10.0.0/16", "192.168.1.7/32"}))
+			})
+
+			It("adds an egress listener matching only the allowed destinations", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				resources := readListenerConfig(listenerConfigFile).Resources
+				Expect(resources).To(HaveLen(2))
+
+				egress := resources[1]
+				Expect(egress.Name).To(Equal("egress-listener"))
+				Expect(egress.Address).To(Equal(envoy.Address{SocketAddress: envoy.SocketAddress{Address: "127.0.0.1", PortValue: 15001}}))
+				Expect(egress.ListenerFilters).To(Equal([]envoy.ListenerFilter{{Name: "envoy.listener.original_dst"}}))
+				Expect(egress.FilterChains).To(HaveLen(1))
+
+				chain := egress.FilterChains[0]
+				Expect(chain.FilterChainMatch).To(Equal(&envoy.FilterChainMatch{PrefixRanges: []envoy.CIDRRange{
+					{AddressPrefix: "10.10.0.0", PrefixLen: 16},
+					{AddressPrefix: "192.168.1.7", PrefixLen: 32},
+				}}))
+				Expect(chain.TLSContext).To(Equal(envoy.TLSContext{}))
+				Expect(chain.Filters).To(HaveLen(1))
+				Expect(chain.Filters[0].Name).To(Equal("envoy.tcp_proxy"))
+				Expect(chain.Filters[0].Config.Cluster).To(Equal("egress-original-dst"))
+			})
+
+			It("adds an original destination cluster", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				clusters := readProxyConfig(proxyConfigFile).StaticResources.Clusters
+				Expect(clusters).To(HaveLen(2))
+				Expect(clusters[1].Name).To(Equal("egress-original-dst"))
+				Expect(clusters[1].Type).To(Equal("ORIGINAL_DST"))
+				Expect(clusters[1].LbPolicy).To(Equal("ORIGINAL_DST_LB"))
+				Expect(clusters[1].Hosts).To(BeEmpty())
+			})
+
+			Context("with the envoy v3 api", func() {
+				BeforeEach(func() {
+					opts = append(opts, containerstore.WithEnvoyAPIV3(true))
+				})
+
+				It("emits the v3 forms without a tls transport socket on the egress listener", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).NotTo(HaveOccurred())
+
+					resources := readListenerConfig(listenerConfigFile).Resources
+					Expect(resources[0].FilterChains[0].TransportSocket).NotTo(BeNil())
+					Expect(resources[1].FilterChains[0].TransportSocket).To(BeNil())
+					Expect(resources[1].ListenerFilters).To(Equal([]envoy.ListenerFilter{{
+						Name:        "envoy.filters.listener.original_dst",
+						TypedConfig: &envoy.TypedExtension{Type: "type.googleapis.com/envoy.extensions.filters.listener.original_dst.v3.OriginalDst"},
+					}}))
+
+					clusters := readProxyConfig(proxyConfigFile).StaticResources.Clusters
+					Expect(clusters[1].LbPolicy).To(Equal("CLUSTER_PROVIDED"))
+					Expect(clusters[1].LoadAssignment).To(BeNil())
+				})
+			})
+		})
+
+		Context("with the original_dst listener filter", func() {
+			BeforeEach(func() {
+				container.Ports = append(container.Ports, executor.PortMapping{
+					ContainerPort:         2222,
+					ContainerTLSProxyPort: 61002,
+				})
+				opts = append(opts, containerstore.WithOriginalDstListenerFilter(true))
+			})
+
+			It("adds it to every proxy listener", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				resources := readListenerConfig(listenerConfigFile).Resources
+				Expect(resources).To(HaveLen(2))
+				for _, resource := range resources {
+					Expect(resource.ListenerFilters).To(Equal([]envoy.ListenerFilter{{Name: "envoy.listener.original_dst"}}))
+				}
+			})
+		})
+
+		It("does not add listener filters to the proxy listeners", func() {
+			err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(readListenerConfig(listenerConfigFile).Resources[0].ListenerFilters).To(BeEmpty())
+
+			data, err := ioutil.ReadFile(listenerConfigFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).NotTo(ContainSubstring("listener_filters"))
+		})
+
+		Context("with the canonical tcp proxy name", func() {
+			BeforeEach(func() {
+				opts = append(opts,
+					containerstore.WithCanonicalTCPProxyName(true),
+					containerstore.WithEgressAllowlist(15001, []string{"10.10.0.0/16"}),
+				)
+			})
+
+			It("names all tcp proxy filters envoy.filters.network.tcp_proxy", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				resources := readListenerConfig(listenerConfigFile).Resources
+				Expect(resources).To(HaveLen(2))
+				for _, resource := range resources {
+					Expect(resource.FilterChains[0].Filters[0].Name).To(Equal("envoy.filters.network.tcp_proxy"))
+				}
+
+				data, err := ioutil.ReadFile(listenerConfigFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).NotTo(ContainSubstring("envoy.tcp_proxy"))
+			})
+		})
+
+		It("does not add an egress listener", func() {
+			err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(readListenerConfig(listenerConfigFile).Resources).To(HaveLen(1))
+			Expect(readProxyConfig(proxyConfigFile).StaticResources.Clusters).To(HaveLen(1))
+		})
+
+		Context("with a port bypassing the proxy", func() {
+			BeforeEach(func() {
+				container.Ports = []executor.PortMapping{
+					{ContainerPort: 8080, DisableContainerProxy: true},
+					{ContainerPort: 2222, ContainerTLSProxyPort: 61001},
+				}
+			})
+
+			It("generates neither a service cluster nor a listener for it", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				clusters := readProxyConfig(proxyConfigFile).StaticResources.Clusters
+				Expect(clusters).To(HaveLen(1))
+				Expect(clusters[0].Name).To(Equal("1-service-cluster"))
+
+				listeners := readListenerConfig(listenerConfigFile).Resources
+				Expect(listeners).To(HaveLen(1))
+				Expect(listeners[0].Name).To(Equal("listener-2222"))
+				Expect(listeners[0].FilterChains[0].Filters[0].Config.Cluster).To(Equal("1-service-cluster"))
+			})
+		})
+
+		Context("when renaming a config file into place fails with EBUSY", func() {
+			var renameErrs chan error
+
+			BeforeEach(func() {
+				renameErrs = make(chan error, 10)
+				opts = append(opts, containerstore.WithRename(func(oldpath, newpath string) error {
+					select {
+					case err := <-renameErrs:
+						return err
+					default:
+						return os.Rename(oldpath, newpath)
+					}
+				}))
+			})
+
+			It("retries the rename after a backoff", func() {
+				busyErr := &os.LinkError{Op: "rename", Old: proxyConfigFile + ".tmp", New: proxyConfigFile, Err: syscall.EBUSY}
+				renameErrs <- busyErr
+
+				errCh := make(chan error, 1)
+				go func() {
+					errCh <- proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				}()
+
+				Consistently(errCh).ShouldNot(Receive())
+				reloadClock.WaitForWatcherAndIncrement(containerstore.RenameRetryInterval)
+				Eventually(errCh).Should(Receive(BeNil()))
+
+				listenerConfig := readListenerConfig(listenerConfigFile)
+				Expect(listenerConfig.Resources).To(HaveLen(1))
+				Expect(listenerConfigFile + ".tmp").NotTo(BeAnExistingFile())
+			})
+
+			It("returns the last error when the rename keeps failing", func() {
+				busyErr := &os.LinkError{Op: "rename", Old: proxyConfigFile + ".tmp", New: proxyConfigFile, Err: syscall.EBUSY}
+				for i := 0; i < containerstore.RenameAttempts; i++ {
+					renameErrs <- busyErr
+				}
+
+				errCh := make(chan error, 1)
+				go func() {
+					errCh <- proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				}()
+
+				Eventually(func() chan error {
+					reloadClock.Increment(time.Second)
+					return errCh
+				}).Should(Receive(Equal(busyErr)))
+				Expect(renameErrs).To(BeEmpty())
+				Expect(listenerConfigFile).NotTo(BeAnExistingFile())
+			})
+
+			It("does not retry other errors", func() {
+				renameErrs <- errors.New("boom")
+
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).To(MatchError("boom"))
+			})
+		})
+
+		Context("with a plaintext port", func() {
+			BeforeEach(func() {
+				container.Ports = []executor.PortMapping{
+					{ContainerPort: 8080, ContainerTLSProxyPort: 61001},
+					{ContainerPort: 2222, ContainerTLSProxyPort: 61003, PlaintextContainerProxy: true},
+				}
+			})
+
+			It("generates a listener without a tls context for it", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				listeners := readListenerConfig(listenerConfigFile).Resources
+				Expect(listeners).To(HaveLen(2))
+
+				Expect(listeners[0].FilterChains).To(HaveLen(1))
+				Expect(listeners[0].FilterChains[0].TLSContext.CommonTLSContext.TLSCertificates).To(HaveLen(1))
+
+				Expect(listeners[1].Name).To(Equal("listener-2222"))
+				Expect(listeners[1].FilterChains).To(HaveLen(1))
+				Expect(listeners[1].FilterChains[0].TLSContext).To(Equal(envoy.TLSContext{}))
+				Expect(listeners[1].FilterChains[0].Filters).To(HaveLen(1))
+				Expect(listeners[1].FilterChains[0].Filters[0].Config.Cluster).To(Equal("1-service-cluster"))
+			})
+
+			Context("with the v3 api", func() {
+				BeforeEach(func() {
+					opts = append(opts, containerstore.WithEnvoyAPIV3(true))
+				})
+
+				It("generates a listener without a transport socket for it", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).NotTo(HaveOccurred())
+
+					listeners := readListenerConfig(listenerConfigFile).Resources
+					Expect(listeners).To(HaveLen(2))
+					Expect(listeners[0].FilterChains[0].TransportSocket).NotTo(BeNil())
+					Expect(listeners[1].FilterChains[0].TransportSocket).To(BeNil())
+				})
+			})
+		})
+
+		Context("with extra clusters", func() {
+			BeforeEach(func() {
+				container.ContainerProxyExtraClusters = []executor.ProxyCluster{
+					{Name: "metrics-collector", Host: "10.1.0.5", Port: 9090},
+					{Name: "tracing", Host: "tracing.service.internal", Port: 9411},
+				}
+			})
+
+			It("adds them after the service clusters", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				clusters := readProxyConfig(proxyConfigFile).StaticResources.Clusters
+				Expect(clusters).To(HaveLen(3))
+				Expect(clusters[0].Name).To(Equal("0-service-cluster"))
+
+				Expect(clusters[1].Name).To(Equal("metrics-collector"))
+				Expect(clusters[1].Type).To(Equal("STATIC"))
+				Expect(clusters[1].ConnectionTimeout).To(Equal("0.25s"))
+				Expect(clusters[1].Hosts).To(Equal([]envoy.Address{
+					{SocketAddress: envoy.SocketAddress{Address: "10.1.0.5", PortValue: 9090}},
+				}))
+			})
+
+			It("resolves clusters with a hostname", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				clusters := readProxyConfig(proxyConfigFile).StaticResources.Clusters
+				Expect(clusters[2].Name).To(Equal("tracing"))
+				Expect(clusters[2].Type).To(Equal("STRICT_DNS"))
+				Expect(clusters[2].Hosts).To(Equal([]envoy.Address{
+					{SocketAddress: envoy.SocketAddress{Address: "tracing.service.internal", PortValue: 9411}},
+				}))
+			})
+
+			Context("when a name collides with a service cluster", func() {
+				BeforeEach(func() {
+					container.ContainerProxyExtraClusters = []executor.ProxyCluster{
+						{Name: "3-service-cluster", Host: "10.1.0.5", Port: 9090},
+					}
+				})
+
+				It("returns an error without writing the config", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).To(MatchError(`invalid extra cluster name: "3-service-cluster"`))
+					Expect(proxyConfigFile).NotTo(BeAnExistingFile())
+				})
+			})
+
+			Context("when names are used twice", func() {
+				BeforeEach(func() {
+					container.ContainerProxyExtraClusters = append(container.ContainerProxyExtraClusters,
+						executor.ProxyCluster{Name: "tracing", Host: "10.1.0.6", Port: 9411},
+					)
+				})
+
+				It("returns an error", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).To(MatchError(`duplicate extra cluster name: "tracing"`))
+				})
+			})
+		})
+
+		Context("with an IPv6 internal ip", func() {
+			BeforeEach(func() {
+				container.InternalIP = "fd00:0:0:0:0:0:0:1"
+			})
+
+			It("uses it as the cluster host address", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				proxyConfig := readProxyConfig(proxyConfigFile)
+				Expect(proxyConfig.StaticResources.Clusters[0].Hosts).To(Equal([]envoy.Address{
+					{SocketAddress: envoy.SocketAddress{Address: "fd00::1", PortValue: 8080}},
+				}))
+			})
+
+			Context("written with brackets", func() {
+				BeforeEach(func() {
+					container.InternalIP = "[fd00::1]"
+				})
+
+				It("drops the brackets from the cluster host address", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).NotTo(HaveOccurred())
+
+					proxyConfig := readProxyConfig(proxyConfigFile)
+					Expect(proxyConfig.StaticResources.Clusters[0].Hosts).To(Equal([]envoy.Address{
+						{SocketAddress: envoy.SocketAddress{Address: "fd00::1", PortValue: 8080}},
+					}))
+				})
+			})
+		})
+
+		It("does not configure the envoy node", func() {
+			err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+			Expect(err).NotTo(HaveOccurred())
+
+			proxyConfig := readProxyConfig(proxyConfigFile)
+			Expect(proxyConfig.Node).To(BeNil())
+
+			data, err := ioutil.ReadFile(proxyConfigFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).NotTo(ContainSubstring("node:"))
+		})
+
+		Context("with a node locality configured", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithNodeLocality("some-region", "some-zone", ""))
+			})
+
+			It("sets the locality of the envoy node", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				proxyConfig := readProxyConfig(proxyConfigFile)
+				Expect(proxyConfig.Node).To(Equal(&envoy.Node{
+					Id:       container.Guid,
+					Locality: &envoy.Locality{Region: "some-region", Zone: "some-zone"},
+				}))
+
+				data, err := ioutil.ReadFile(proxyConfigFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).NotTo(ContainSubstring("sub_zone"))
+				Expect(string(data)).NotTo(ContainSubstring("metadata"))
+			})
+
+			Context("and node metadata", func() {
+				BeforeEach(func() {
+					opts = append(opts, containerstore.WithNodeMetadata(map[string]string{"some-key": "some-value"}))
+				})
+
+				It("sets both on the envoy node", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).NotTo(HaveOccurred())
+
+					proxyConfig := readProxyConfig(proxyConfigFile)
+					Expect(proxyConfig.Node).To(Equal(&envoy.Node{
+						Id:       container.Guid,
+						Locality: &envoy.Locality{Region: "some-region", Zone: "some-zone"},
+						Metadata: map[string]string{"some-key": "some-value"},
+					}))
+				})
+			})
+		})
+
+		Context("with only node metadata configured", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithNodeMetadata(map[string]string{"some-key": "some-value"}))
+			})
+
+			It("omits the locality", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				proxyConfig := readProxyConfig(proxyConfigFile)
+				Expect(proxyConfig.Node).To(Equal(&envoy.Node{
+					Id:       container.Guid,
+					Metadata: map[string]string{"some-key": "some-value"},
+				}))
+			})
+		})
+
+		Context("when the container names its app and process", func() {
+			BeforeEach(func() {
+				container.AppGuid = "some-app-guid"
+				container.ProcessGuid = "some-process-guid"
+			})
+
+			It("adds them to the node metadata", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				proxyConfig := readProxyConfig(proxyConfigFile)
+				Expect(proxyConfig.Node).To(Equal(&envoy.Node{
+					Id: container.Guid,
+					Metadata: map[string]string{
+						"app_guid":     "some-app-guid",
+						"process_guid": "some-process-guid",
+					},
+				}))
+			})
+
+			Context("and node metadata is configured", func() {
+				var nodeMetadata map[string]string
+
+				BeforeEach(func() {
+					nodeMetadata = map[string]string{"some-key": "some-value"}
+					opts = append(opts, containerstore.WithNodeMetadata(nodeMetadata))
+				})
+
+				It("merges them without changing the configured metadata", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).NotTo(HaveOccurred())
+
+					proxyConfig := readProxyConfig(proxyConfigFile)
+					Expect(proxyConfig.Node.Metadata).To(Equal(map[string]string{
+						"some-key":     "some-value",
+						"app_guid":     "some-app-guid",
+						"process_guid": "some-process-guid",
+					}))
+					Expect(nodeMetadata).To(HaveLen(1))
+				})
+			})
+
+			Context("with only an app guid", func() {
+				BeforeEach(func() {
+					container.ProcessGuid = ""
+				})
+
+				It("omits the process guid", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).NotTo(HaveOccurred())
+
+					proxyConfig := readProxyConfig(proxyConfigFile)
+					Expect(proxyConfig.Node.Metadata).To(Equal(map[string]string{"app_guid": "some-app-guid"}))
+				})
+			})
+		})
+
+		Context("with an admin socket path configured", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithAdminSocketPath("/etc/cf-assets/envoy_config/admin/envoy.sock"))
+			})
+
+			It("binds the admin interface to the unix socket", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				proxyConfig := readProxyConfig(proxyConfigFile)
+				Expect(proxyConfig.Admin.Address).To(Equal(envoy.Address{
+					Pipe: &envoy.Pipe{Path: "/etc/cf-assets/envoy_config/admin/envoy.sock"},
+				}))
+
+				data, err := ioutil.ReadFile(proxyConfigFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).NotTo(ContainSubstring("127.0.0.1"))
+			})
+
+			It("creates the socket directory in the container config directory", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filepath.Join(configPath, "admin")).To(BeADirectory())
+			})
+
+			It("does not use an admin port", func() {
+				adminPort, err := proxyConfigHandler.AdminPort(logger, container)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(adminPort).To(BeZero())
+			})
+
+			Context("when the listeners take up the whole proxy port range", func() {
+				BeforeEach(func() {
+					opts = append(opts, containerstore.WithProxyPortRange(61001, 61002))
+				})
+
+				It("still writes the config", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).NotTo(HaveOccurred())
+				})
+			})
+		})
+
+		Describe("BuildProxyConfig", func() {
+			It("returns the proxy config Update writes and its admin port", func() {
+				proxyConfig, adminPort, err := proxyConfigHandler.BuildProxyConfig(container)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(adminPort).NotTo(BeZero())
+				Expect(proxyConfig.Admin.Address.SocketAddress.PortValue).To(Equal(adminPort))
+
+				err = proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				data, err := yaml.Marshal(proxyConfig)
+				Expect(err).NotTo(HaveOccurred())
+				writtenData, err := ioutil.ReadFile(proxyConfigFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(data).To(MatchYAML(writtenData))
+
+				var builtConfig envoy.ProxyConfig
+				Expect(yaml.Unmarshal(data, &builtConfig)).To(Succeed())
+				Expect(builtConfig).To(Equal(readProxyConfig(proxyConfigFile)))
+			})
+
+			Context("with an invalid internal ip", func() {
+				BeforeEach(func() {
+					container.InternalIP = "not-an-ip"
+				})
+
+				It("returns an error", func() {
+					_, _, err := proxyConfigHandler.BuildProxyConfig(container)
+					Expect(err).To(MatchError(`invalid container internal ip: "not-an-ip"`))
+				})
+			})
+		})
+
+		Describe("GenerateConfig", func() {
+			It("returns the proxy config Update writes", func() {
+				data, err := proxyConfigHandler.GenerateConfig(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				var generatedConfig envoy.ProxyConfig
+				err = yaml.Unmarshal(data, &generatedConfig)
+				Expect(err).NotTo(HaveOccurred())
+
+				err = proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(generatedConfig).To(Equal(readProxyConfig(proxyConfigFile)))
+			})
+
+			It("does not write any config", func() {
+				_, err := proxyConfigHandler.GenerateConfig(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(proxyConfigFile).NotTo(BeAnExistingFile())
+				Expect(listenerConfigFile).NotTo(BeAnExistingFile())
+			})
+
+			Context("without a key pair", func() {
+				It("still returns the proxy config", func() {
+					data, err := proxyConfigHandler.GenerateConfig(containerstore.Credential{}, container)
+					Expect(err).NotTo(HaveOccurred())
+
+					var generatedConfig envoy.ProxyConfig
+					err = yaml.Unmarshal(data, &generatedConfig)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(generatedConfig.StaticResources.Clusters).To(HaveLen(1))
+				})
+			})
+
+			Context("the EnableContainerProxy is disabled on the container", func() {
+				BeforeEach(func() {
+					container.EnableContainerProxy = false
+				})
+
+				It("returns no config", func() {
+					data, err := proxyConfigHandler.GenerateConfig(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(data).To(BeNil())
+				})
+			})
+		})
+
+		Describe("UpdateBatch", func() {
+			var (
+				containers []executor.Container
+				entries    []containerstore.ContainerCredential
+			)
+
+			BeforeEach(func() {
+				containers = nil
+				entries = nil
+				for i := 0; i < 2*containerstore.BatchUpdateWorkers+1; i++ {
+					batchContainer := container
+					batchContainer.Guid = fmt.Sprintf("%s-batch-%d", container.Guid, i)
+					Expect(os.MkdirAll(filepath.Join(proxyConfigDir, batchContainer.Guid), 0755)).To(Succeed())
+
+					containers = append(containers, batchContainer)
+					entries = append(entries, containerstore.ContainerCredential{
+						Credential: containerstore.Credential{Cert: validCert, Key: validKey},
+						Container:  batchContainer,
+					})
+				}
+			})
+
+			It("writes the config of every container", func() {
+				err := proxyConfigHandler.UpdateBatch(entries)
+				Expect(err).NotTo(HaveOccurred())
+
+				for _, batchContainer := range containers {
+					Expect(filepath.Join(proxyConfigDir, batchContainer.Guid, "envoy.yaml")).To(BeAnExistingFile())
+					Expect(filepath.Join(proxyConfigDir, batchContainer.Guid, "listeners.yaml")).To(BeAnExistingFile())
+				}
+			})
+
+			Context("when a container is updated more than once", func() {
+				var newCert string
+
+				BeforeEach(func() {
+					var newKey string
+					newCert, newKey, _ = generateCertAndKey()
+					entries = append(entries, containerstore.ContainerCredential{
+						Credential: containerstore.Credential{Cert: newCert, Key: newKey},
+						Container:  containers[0],
+					})
+				})
+
+				It("applies the updates in order", func() {
+					err := proxyConfigHandler.UpdateBatch(entries)
+					Expect(err).NotTo(HaveOccurred())
+
+					listenerConfig := readListenerConfig(filepath.Join(proxyConfigDir, containers[0].Guid, "listeners.yaml"))
+					certs := listenerConfig.Resources[0].FilterChains[0].TLSContext.CommonTLSContext.TLSCertificates
+					Expect(certs[0].CertificateChain.InlineString).To(Equal(newCert))
+				})
+			})
+
+			Context("when some updates fail", func() {
+				BeforeEach(func() {
+					entries[1].Credential = containerstore.Credential{Cert: "invalid", Key: "invalid"}
+					Expect(os.RemoveAll(filepath.Join(proxyConfigDir, containers[2].Guid))).To(Succeed())
+				})
+
+				It("returns all of their errors and still updates the other containers", func() {
+					err := proxyConfigHandler.UpdateBatch(entries)
+					Expect(err).To(HaveOccurred())
+					Expect(err.(*multierror.Error).Errors).To(ConsistOf(
+						MatchError(fmt.Sprintf("failed to update proxy config of %s: %s", containers[1].Guid, containerstore.ErrInvalidCertificate)),
+						MatchError(fmt.Sprintf("failed to update proxy config of %s: %s", containers[2].Guid, containerstore.ErrConfigDirNotFound)),
+					))
+
+					Expect(filepath.Join(proxyConfigDir, containers[0].Guid, "envoy.yaml")).To(BeAnExistingFile())
+					Expect(filepath.Join(proxyConfigDir, containers[3].Guid, "envoy.yaml")).To(BeAnExistingFile())
+				})
+			})
+		})
+
+		Describe("Rewrite", func() {
+			BeforeEach(func() {
+				container.Ports = []executor.PortMapping{
+					{ContainerPort: 8080, ContainerTLSProxyPort: 61001},
+					{ContainerPort: 2222, DisableContainerProxy: true},
+					{ContainerPort: 9090, ContainerTLSProxyPort: 61003},
+				}
+				opts = append(opts, containerstore.WithCipherSuites([]string{"ECDHE-RSA-AES128-GCM-SHA256"}))
+			})
+
+			JustBeforeEach(func() {
+				previousHandler := containerstore.NewProxyConfigHandler(
+					logger,
+					proxyDir,
+					proxyConfigDir,
+					containerProxyTrustedCACerts,
+					containerProxyVerifySubjectAltName,
+					containerProxyRequireClientCerts,
+					reloadDuration,
+					reloadClock,
+				)
+				err := previousHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("regenerates the config with the current cipher suites", func() {
+				previousProxyConfig := readProxyConfig(proxyConfigFile)
+				Expect(readListenerConfig(listenerConfigFile).Resources[0].FilterChains[0].TLSContext.CommonTLSContext.TLSParams.CipherSuites).To(Equal(containerstore.SupportedCipherSuites))
+
+				err := proxyConfigHandler.Rewrite(container.Guid)
+				Expect(err).NotTo(HaveOccurred())
+
+				listenerConfig := readListenerConfig(listenerConfigFile)
+				Expect(listenerConfig.Resources).To(HaveLen(2))
+				for i, listener := range listenerConfig.Resources {
+					Expect(listener.Name).To(Equal([]string{"listener-8080", "listener-9090"}[i]))
+					Expect(listener.Address.SocketAddress.PortValue).To(BeEquivalentTo([]int{61001, 61003}[i]))
+
+					tlsContext := listener.FilterChains[0].TLSContext
+					Expect(tlsContext.CommonTLSContext.TLSParams.CipherSuites).To(Equal("[ECDHE-RSA-AES128-GCM-SHA256]"))
+					Expect(tlsContext.CommonTLSContext.TLSCertificates).To(Equal([]envoy.TLSCertificate{
+						{
+							CertificateChain: envoy.DataSource{InlineString: validCert},
+							PrivateKey:       envoy.DataSource{InlineString: validKey},
+						},
+					}))
+				}
+
+				Expect(readProxyConfig(proxyConfigFile)).To(Equal(previousProxyConfig))
+			})
+
+			Context("with a plaintext port", func() {
+				BeforeEach(func() {
+					container.Ports[2].PlaintextContainerProxy = true
+				})
+
+				It("keeps the listener of the port plaintext", func() {
+					err := proxyConfigHandler.Rewrite(container.Guid)
+					Expect(err).NotTo(HaveOccurred())
+
+					listeners := readListenerConfig(listenerConfigFile).Resources
+					Expect(listeners).To(HaveLen(2))
+					Expect(listeners[0].FilterChains[0].TLSContext.CommonTLSContext.TLSCertificates).To(HaveLen(1))
+					Expect(listeners[1].FilterChains[0].TLSContext).To(Equal(envoy.TLSContext{}))
+				})
+			})
+
+			Context("when the container has no config", func() {
+				It("returns an error", func() {
+					err := proxyConfigHandler.Rewrite("some-other-guid")
+					Expect(err).To(MatchError(HavePrefix("cannot rewrite proxy config of some-other-guid: ")))
+				})
+			})
+
+			Context("when the config has no service clusters", func() {
+				JustBeforeEach(func() {
+					proxyConfig := readProxyConfig(proxyConfigFile)
+					proxyConfig.StaticResources.Clusters = nil
+					data, err := yaml.Marshal(proxyConfig)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(ioutil.WriteFile(proxyConfigFile, data, 0644)).To(Succeed())
+				})
+
+				It("returns an error without touching the listener config", func() {
+					previousListenerConfig := readListenerConfig(listenerConfigFile)
+
+					err := proxyConfigHandler.Rewrite(container.Guid)
+					Expect(err).To(MatchError(fmt.Sprintf("cannot rewrite proxy config of %s: no service clusters", container.Guid)))
+
+					Expect(readListenerConfig(listenerConfigFile)).To(Equal(previousListenerConfig))
+				})
+			})
+		})
+
+		Describe("ConfigStats", func() {
+			It("counts the clusters and listeners of the config", func() {
+				clusters, listeners, approxBytes, err := proxyConfigHandler.ConfigStats(container)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(clusters).To(Equal(1))
+				Expect(listeners).To(Equal(1))
+				Expect(approxBytes).To(BeNumerically(">", 0))
+			})
+
+			Context("with more ports", func() {
+				It("scales with them", func() {
+					_, _, singlePortBytes, err := proxyConfigHandler.ConfigStats(container)
+					Expect(err).NotTo(HaveOccurred())
+
+					container.Ports = append(container.Ports,
+						executor.PortMapping{ContainerPort: 2222, ContainerTLSProxyPort: 61002},
+						executor.PortMapping{ContainerPort: 3333, ContainerTLSProxyPort: 61003},
+					)
+
+					clusters, listeners, approxBytes, err := proxyConfigHandler.ConfigStats(container)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(clusters).To(Equal(3))
+					Expect(listeners).To(Equal(3))
+					Expect(approxBytes).To(BeNumerically(">", singlePortBytes))
+				})
+			})
+
+			It("does not write any config", func() {
+				_, _, _, err := proxyConfigHandler.ConfigStats(container)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(proxyConfigFile).NotTo(BeAnExistingFile())
+				Expect(listenerConfigFile).NotTo(BeAnExistingFile())
+			})
+
+			Context("the EnableContainerProxy is disabled on the container", func() {
+				BeforeEach(func() {
+					container.EnableContainerProxy = false
+				})
+
+				It("reports an empty config", func() {
+					clusters, listeners, approxBytes, err := proxyConfigHandler.ConfigStats(container)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(clusters).To(BeZero())
+					Expect(listeners).To(BeZero())
+					Expect(approxBytes).To(BeZero())
+				})
+			})
+		})
+
+		Describe("AdminPort", func() {
+			It("returns the admin port written to the proxy config", func() {
+				adminPort, err := proxyConfigHandler.AdminPort(logger, container)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(adminPort).To(Equal(uint16(61002)))
+
+				err = proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				proxyConfig := readProxyConfig(proxyConfigFile)
+				Expect(proxyConfig.Admin.Address.SocketAddress.PortValue).To(Equal(adminPort))
+			})
+
+			It("does not collide with the container or proxy listener ports", func() {
+				adminPort, err := proxyConfigHandler.AdminPort(logger, container)
+				Expect(err).NotTo(HaveOccurred())
+				for _, portMap := range container.Ports {
+					Expect(adminPort).NotTo(Equal(portMap.ContainerPort))
+					Expect(adminPort).NotTo(Equal(portMap.ContainerTLSProxyPort))
+				}
+			})
+
+			Context("the EnableContainerProxy is disabled on the container", func() {
+				BeforeEach(func() {
+					container.EnableContainerProxy = false
+				})
+
+				It("returns no admin port", func() {
+					adminPort, err := proxyConfigHandler.AdminPort(logger, container)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(adminPort).To(BeZero())
+				})
+			})
+		})
+
+		Context("with a metron client", func() {
+			var fakeMetronClient *mfakes.FakeIngressClient
+
+			BeforeEach(func() {
+				fakeMetronClient = new(mfakes.FakeIngressClient)
+				opts = append(opts, containerstore.WithMetronClient(fakeMetronClient))
+			})
+
+			It("reports how long writing the config took", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(fakeMetronClient.SendDurationCallCount()).To(Equal(1))
+				name, _, _ := fakeMetronClient.SendDurationArgsForCall(0)
+				Expect(name).To(Equal("ContainerProxyConfigWriteSucceededDuration"))
+			})
+
+			Context("when writing the config fails", func() {
+				BeforeEach(func() {
+					Expect(os.RemoveAll(configPath)).To(Succeed())
+				})
+
+				It("reports the duration as failed", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).To(HaveOccurred())
+
+					Expect(fakeMetronClient.SendDurationCallCount()).To(Equal(1))
+					name, _, _ := fakeMetronClient.SendDurationArgsForCall(0)
+					Expect(name).To(Equal("ContainerProxyConfigWriteFailedDuration"))
+				})
+			})
+		})
+
+		Context("with a config written hook", func() {
+			var writtenContainers []executor.Container
+
+			BeforeEach(func() {
+				writtenContainers = nil
+				opts = append(opts, containerstore.WithConfigWrittenHook(func(container executor.Container) {
+					Expect(proxyConfigFile).To(BeAnExistingFile())
+					Expect(listenerConfigFile).To(BeAnExistingFile())
+					writtenContainers = append(writtenContainers, container)
+				}))
+			})
+
+			It("calls it after every successful update", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(writtenContainers).To(Equal([]executor.Container{container}))
+
+				err = proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(writtenContainers).To(HaveLen(2))
+			})
+
+			It("does not call it when the update fails", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: "invalid", Key: "invalid"}, container)
+				Expect(err).To(HaveOccurred())
+
+				Expect(os.RemoveAll(configPath)).To(Succeed())
+				err = proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).To(Equal(containerstore.ErrConfigDirNotFound))
+
+				Expect(writtenContainers).To(BeEmpty())
+			})
+		})
+
+		Context("with an update debounce", func() {
+			var (
+				writesLock sync.Mutex
+				writes     int
+
+				secondCert, secondKey, thirdCert, thirdKey string
+			)
+
+			writeCount := func() int {
+				writesLock.Lock()
+				defer writesLock.Unlock()
+				return writes
+			}
+
+			listenerCert := func() string {
+				listenerConfig := readListenerConfig(listenerConfigFile)
+				return listenerConfig.Resources[0].FilterChains[0].TLSContext.CommonTLSContext.TLSCertificates[0].CertificateChain.InlineString
+			}
+
+			BeforeEach(func() {
+				writes = 0
+				secondCert, secondKey, _ = generateCertAndKey()
+				thirdCert, thirdKey, _ = generateCertAndKey()
+
+				opts = append(opts,
+					containerstore.WithUpdateDebounce(5*time.Second),
+					containerstore.WithConfigWrittenHook(func(executor.Container) {
+						writesLock.Lock()
+						defer writesLock.Unlock()
+						writes++
+					}),
+				)
+			})
+
+			It("writes the first update immediately and only the latest of the following ones after the window", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(writeCount()).To(Equal(1))
+				Expect(listenerCert()).To(Equal(validCert))
+
+				err = proxyConfigHandler.Update(containerstore.Credential{Cert: secondCert, Key: secondKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+				err = proxyConfigHandler.Update(containerstore.Credential{Cert: thirdCert, Key: thirdKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				Consistently(writeCount).Should(Equal(1))
+				Expect(listenerCert()).To(Equal(validCert))
+
+				reloadClock.WaitForWatcherAndIncrement(5 * time.Second)
+				Eventually(writeCount).Should(Equal(2))
+				Expect(listenerCert()).To(Equal(thirdCert))
+
+				reloadClock.WaitForWatcherAndIncrement(5 * time.Second)
+				Eventually(reloadClock.WatcherCount).Should(Equal(0))
+				Expect(writeCount()).To(Equal(2))
+			})
+
+			It("writes immediately again once a window passed without updates", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				reloadClock.WaitForWatcherAndIncrement(5 * time.Second)
+				Eventually(reloadClock.WatcherCount).Should(Equal(0))
+
+				err = proxyConfigHandler.Update(containerstore.Credential{Cert: secondCert, Key: secondKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(writeCount()).To(Equal(2))
+				Expect(listenerCert()).To(Equal(secondCert))
+			})
+
+			It("debounces every container on its own", func() {
+				otherContainer := container
+				otherContainer.Guid = "other-container-guid"
+				Expect(os.MkdirAll(filepath.Join(proxyConfigDir, otherContainer.Guid), 0755)).To(Succeed())
+
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+				err = proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, otherContainer)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(writeCount()).To(Equal(2))
+			})
+
+			It("drops the pending update when the container is closed", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+				err = proxyConfigHandler.Update(containerstore.Credential{Cert: secondCert, Key: secondKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				errCh := make(chan error)
+				go func() {
+					errCh <- proxyConfigHandler.Close(containerstore.Credential{Cert: thirdCert, Key: thirdKey}, container)
+				}()
+
+				Eventually(writeCount).Should(Equal(2))
+				Eventually(func() chan error {
+					reloadClock.Increment(time.Second)
+					return errCh
+				}).Should(Receive(BeNil()))
+
+				Consistently(writeCount).Should(Equal(2))
+				Expect(listenerCert()).To(Equal(thirdCert))
+			})
+
+			It("drops the pending update when the config dir is removed", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+				err = proxyConfigHandler.Update(containerstore.Credential{Cert: secondCert, Key: secondKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				err = proxyConfigHandler.RemoveProxyConfigDir(logger, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				Eventually(reloadClock.WatcherCount).Should(Equal(0))
+				reloadClock.Increment(5 * time.Second)
+				Consistently(writeCount).Should(Equal(1))
+				Expect(logger).NotTo(gbytes.Say("failed-to-update"))
+			})
+
+			It("drops the pending update when the config dir is reaped", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+				err = proxyConfigHandler.Update(containerstore.Credential{Cert: secondCert, Key: secondKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				err = proxyConfigHandler.Reap(nil)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(configPath).NotTo(BeADirectory())
+
+				Eventually(reloadClock.WatcherCount).Should(Equal(0))
+				reloadClock.Increment(5 * time.Second)
+				Consistently(writeCount).Should(Equal(1))
+				Expect(logger).NotTo(gbytes.Say("failed-to-update"))
+			})
+		})
+
+		Context("with a compressed proxy config", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithCompressedProxyConfig(true))
+			})
+
+			It("writes the proxy config gzipped", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(proxyConfigFile).NotTo(BeAnExistingFile())
+				Expect(proxyConfigFile + ".gz").To(BeAnExistingFile())
+				Expect(proxyConfigFile + ".gz.tmp").NotTo(BeAnExistingFile())
+
+				file, err := os.Open(proxyConfigFile + ".gz")
+				Expect(err).NotTo(HaveOccurred())
+				defer file.Close()
+
+				gzipReader, err := gzip.NewReader(file)
+				Expect(err).NotTo(HaveOccurred())
+				data, err := ioutil.ReadAll(gzipReader)
+				Expect(err).NotTo(HaveOccurred())
+
+				var proxyConfig envoy.ProxyConfig
+				Expect(yaml.Unmarshal(data, &proxyConfig)).To(Succeed())
+				Expect(proxyConfig.StaticResources.Clusters).To(HaveLen(1))
+				Expect(proxyConfig.DynamicResources.LDSConfig.Path).To(Equal("/etc/cf-assets/envoy_config/listeners.yaml"))
+			})
+
+			It("lists the compressed file", func() {
+				Expect(proxyConfigHandler.ConfigFiles(container)).To(ContainElement(proxyConfigFile + ".gz"))
+			})
+		})
+
+		Context("with config file modes configured", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithConfigFileModes(0600, 0640))
+			})
+
+			It("creates the config files with those modes", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				info, err := os.Stat(listenerConfigFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+
+				info, err = os.Stat(proxyConfigFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Mode().Perm()).To(Equal(os.FileMode(0640)))
+			})
+
+			Context("when a listener config tmp file is left over", func() {
+				BeforeEach(func() {
+					err := ioutil.WriteFile(listenerConfigFile+".tmp", []byte("stale"), 0666)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(os.Chmod(listenerConfigFile+".tmp", 0666)).To(Succeed())
+				})
+
+				It("does not inherit its mode", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).NotTo(HaveOccurred())
+
+					info, err := os.Stat(listenerConfigFile)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+				})
+			})
+
+			Context("when a proxy config file already exists", func() {
+				BeforeEach(func() {
+					err := ioutil.WriteFile(proxyConfigFile, []byte("stale"), 0666)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(os.Chmod(proxyConfigFile, 0666)).To(Succeed())
+				})
+
+				It("replaces it with a file of the configured mode", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).NotTo(HaveOccurred())
+
+					info, err := os.Stat(proxyConfigFile)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(info.Mode().Perm()).To(Equal(os.FileMode(0640)))
+					Expect(proxyConfigFile + ".tmp").NotTo(BeAnExistingFile())
+					Expect(readProxyConfig(proxyConfigFile).StaticResources.Clusters).To(HaveLen(1))
+				})
+			})
+		})
+
+		Context("when the credentials are rotated", func() {
+			var lastWeek time.Time
+
+			BeforeEach(func() {
+				lastWeek = time.Now().Add(-7 * 24 * time.Hour).Truncate(time.Second)
+			})
+
+			JustBeforeEach(func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(os.Chtimes(proxyConfigFile, lastWeek, lastWeek)).To(Succeed())
+				Expect(os.Chtimes(listenerConfigFile, lastWeek, lastWeek)).To(Succeed())
+			})
+
+			It("does not rewrite the unchanged proxy config", func() {
+				newCert, newKey, _ := generateCertAndKey()
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: newCert, Key: newKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				info, err := os.Stat(proxyConfigFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.ModTime()).To(BeTemporally("==", lastWeek))
+
+				info, err = os.Stat(listenerConfigFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.ModTime()).To(BeTemporally(">", lastWeek))
+
+				listenerConfig := readListenerConfig(listenerConfigFile)
+				certs := listenerConfig.Resources[0].FilterChains[0].TLSContext.CommonTLSContext.TLSCertificates
+				Expect(certs[0].CertificateChain.InlineString).To(Equal(newCert))
+			})
+
+			Context("when the ports change too", func() {
+				It("rewrites the proxy config", func() {
+					container.Ports = append(container.Ports, executor.PortMapping{ContainerPort: 2222, ContainerTLSProxyPort: 61002})
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).NotTo(HaveOccurred())
+
+					info, err := os.Stat(proxyConfigFile)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(info.ModTime()).To(BeTemporally(">", lastWeek))
+				})
+			})
+		})
+
+		Context("when the container config directory has not been created", func() {
+			BeforeEach(func() {
+				err := os.RemoveAll(configPath)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("returns ErrConfigDirNotFound", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).To(Equal(containerstore.ErrConfigDirNotFound))
+			})
+
+			It("logs the missing directory", func() {
+				proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(logger).To(gbytes.Say("proxy-config-dir-not-found"))
+				Expect(logger).To(gbytes.Say(configPath))
+			})
+		})
+
+		Context("with invalid credentials", func() {
+			var credentials containerstore.Credential
+
+			itFailsWithoutWritingConfig := func() {
+				It("returns ErrInvalidCertificate without writing any config", func() {
+					err := proxyConfigHandler.Update(credentials, container)
+					Expect(err).To(Equal(containerstore.ErrInvalidCertificate))
+
+					Expect(proxyConfigFile).NotTo(BeAnExistingFile())
+					Expect(listenerConfigFile).NotTo(BeAnExistingFile())
+				})
+			}
+
+			Context("with a malformed certificate", func() {
+				BeforeEach(func() {
+					credentials = containerstore.Credential{Cert: "not-a-cert", Key: validKey}
+				})
+
+				itFailsWithoutWritingConfig()
+			})
+
+			Context("with a malformed key", func() {
+				BeforeEach(func() {
+					credentials = containerstore.Credential{Cert: validCert, Key: "not-a-key"}
+				})
+
+				itFailsWithoutWritingConfig()
+			})
+
+			Context("with a key that does not match the certificate", func() {
+				BeforeEach(func() {
+					_, otherKey, _ := generateCertAndKey()
+					credentials = containerstore.Credential{Cert: validCert, Key: otherKey}
+				})
+
+				itFailsWithoutWritingConfig()
+			})
+		})
+
+		Context("with a connect timeout configured", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithConnectTimeout(1500*time.Millisecond))
+			})
+
+			It("uses it for the service clusters", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				proxyConfig := readProxyConfig(proxyConfigFile)
+				Expect(proxyConfig.StaticResources.Clusters).To(HaveLen(1))
+				Expect(proxyConfig.StaticResources.Clusters[0].ConnectionTimeout).To(Equal("1.5s"))
+			})
+		})
+
+		Context("with circuit breaker thresholds configured", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithCircuitBreakerThresholds(1024, 512, 2048))
+			})
+
+			It("caps the service clusters", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				proxyConfig := readProxyConfig(proxyConfigFile)
+				Expect(proxyConfig.StaticResources.Clusters).To(HaveLen(1))
+				Expect(proxyConfig.StaticResources.Clusters[0].CircuitBreakers.Thresholds).To(Equal([]envoy.Threshold{
+					{MaxConnections: 1024, MaxPendingRequests: 512, MaxRequests: 2048},
+				}))
+			})
+		})
+
+		Context("with tcp keepalive configured", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithTCPKeepalive(3, 30*time.Second, 10*time.Second))
+			})
+
+			It("writes the keepalive settings to each service cluster", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				proxyConfig := readProxyConfig(proxyConfigFile)
+				Expect(proxyConfig.StaticResources.Clusters).To(HaveLen(1))
+				Expect(proxyConfig.StaticResources.Clusters[0].UpstreamConnectionOptions).To(Equal(&envoy.UpstreamConnectionOptions{
+					TCPKeepalive: envoy.TCPKeepalive{
+						KeepaliveProbes:   3,
+						KeepaliveTime:     30,
+						KeepaliveInterval: 10,
+					},
+				}))
+			})
+		})
+
+		Context("without tcp keepalive configured", func() {
+			It("omits the upstream connection options", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				data, err := ioutil.ReadFile(proxyConfigFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).NotTo(ContainSubstring("upstream_connection_options"))
+			})
+		})
+
+		Context("with outlier detection configured", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithOutlierDetection(5, 3, 30*time.Second))
+			})
+
+			It("writes the outlier detection settings to each service cluster", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				proxyConfig := readProxyConfig(proxyConfigFile)
+				Expect(proxyConfig.StaticResources.Clusters).To(HaveLen(1))
+				Expect(proxyConfig.StaticResources.Clusters[0].OutlierDetection).To(Equal(&envoy.OutlierDetection{
+					Consecutive5xx:            5,
+					ConsecutiveGatewayFailure: 3,
+					BaseEjectionTime:          "30s",
+				}))
+			})
+		})
+
+		Context("with only a consecutive gateway failure threshold configured", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithOutlierDetection(0, 3, 0))
+			})
+
+			It("leaves the other outlier detection settings to envoy", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				data, err := ioutil.ReadFile(proxyConfigFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).To(ContainSubstring("consecutive_gateway_failure: 3"))
+				Expect(string(data)).NotTo(ContainSubstring("consecutive_5xx"))
+				Expect(string(data)).NotTo(ContainSubstring("base_ejection_time"))
+			})
+		})
+
+		Context("without outlier detection configured", func() {
+			It("omits the outlier detection", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				data, err := ioutil.ReadFile(proxyConfigFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).NotTo(ContainSubstring("outlier_detection"))
+			})
+		})
+
+		It("uses the envoy v2 api", func() {
+			err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+			Expect(err).NotTo(HaveOccurred())
+
+			proxyConfig := readProxyConfig(proxyConfigFile)
+			Expect(proxyConfig.DynamicResources.LDSConfig.ResourceAPIVersion).To(BeEmpty())
+			Expect(proxyConfig.StaticResources.Clusters[0].LoadAssignment).To(BeNil())
+			Expect(proxyConfig.StaticResources.Clusters[0].Hosts).NotTo(BeEmpty())
+		})
+
+		Context("with the envoy v3 api", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithEnvoyAPIV3(true))
+			})
+
+			It("loads the listeners with the v3 api", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				proxyConfig := readProxyConfig(proxyConfigFile)
+				Expect(proxyConfig.DynamicResources.LDSConfig.ResourceAPIVersion).To(Equal("V3"))
+			})
+
+			It("assigns the service cluster hosts as endpoints", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				proxyConfig := readProxyConfig(proxyConfigFile)
+				Expect(proxyConfig.StaticResources.Clusters).To(HaveLen(1))
+
+				cluster := proxyConfig.StaticResources.Clusters[0]
+				Expect(cluster.Hosts).To(BeEmpty())
+				Expect(cluster.LoadAssignment).To(Equal(&envoy.ClusterLoadAssignment{
+					ClusterName: "0-service-cluster",
+					Endpoints: []envoy.LocalityLbEndpoints{{
+						LbEndpoints: []envoy.LbEndpoint{{
+							Endpoint: envoy.Endpoint{Address: envoy.Address{
+								SocketAddress: envoy.SocketAddress{Address: "10.0.0.1", PortValue: 8080},
+							}},
+						}},
+					}},
+				}))
+			})
+		})
+
+		Context("with zero circuit breaker thresholds", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithCircuitBreakerThresholds(0, 0, 0))
+			})
+
+			It("leaves connections unlimited and omits the request limits", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				proxyConfig := readProxyConfig(proxyConfigFile)
+				Expect(proxyConfig.StaticResources.Clusters[0].CircuitBreakers.Thresholds).To(Equal([]envoy.Threshold{
+					{MaxConnections: math.MaxUint32},
+				}))
+
+				data, err := ioutil.ReadFile(proxyConfigFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).NotTo(ContainSubstring("max_pending_requests"))
+				Expect(string(data)).NotTo(ContainSubstring("max_requests"))
+			})
+		})
+
+		Context("with an admin access log path configured", func() {
+			var adminAccessLogPath string
+
+			JustBeforeEach(func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			Context("outside of the config mount", func() {
+				BeforeEach(func() {
+					adminAccessLogPath = "/var/log/envoy/admin.log"
+					opts = append(opts, containerstore.WithAdminAccessLogPath(adminAccessLogPath))
+				})
+
+				It("writes the path verbatim into the proxy config", func() {
+					Expect(readProxyConfig(proxyConfigFile).Admin.AccessLogPath).To(Equal(adminAccessLogPath))
+				})
+			})
+
+			Context("inside the config mount", func() {
+				BeforeEach(func() {
+					adminAccessLogPath = "/etc/cf-assets/envoy_config/logs/admin.log"
+					opts = append(opts, containerstore.WithAdminAccessLogPath(adminAccessLogPath))
+				})
+
+				It("writes the path verbatim into the proxy config", func() {
+					Expect(readProxyConfig(proxyConfigFile).Admin.AccessLogPath).To(Equal(adminAccessLogPath))
+				})
+
+				It("creates the parent directory in the container's config dir", func() {
+					Expect(filepath.Join(configPath, "logs")).To(BeADirectory())
+				})
+
+				Context("with the stdout access log enabled", func() {
+					BeforeEach(func() {
+						opts = append(opts, containerstore.WithStdoutAccessLog(true))
+					})
+
+					It("logs to both the file and stdout", func() {
+						err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+						Expect(err).NotTo(HaveOccurred())
+
+						listenerConfig := readListenerConfig(listenerConfigFile)
+						for _, listener := range listenerConfig.Resources {
+							Expect(listener.FilterChains[0].Filters[0].Config.AccessLog).To(ConsistOf(
+								envoy.AccessLog{
+									Name:   "envoy.file_access_log",
+									Config: envoy.AccessLogConfig{Path: "/etc/cf-assets/envoy_config/logs/access.log"},
+								},
+								envoy.AccessLog{
+									Name:   "envoy.file_access_log",
+									Config: envoy.AccessLogConfig{Path: "/dev/stdout"},
+								},
+							))
+						}
+					})
+				})
+			})
+
+			Context("with the stdout access log enabled", func() {
+				BeforeEach(func() {
+					opts = append(opts, containerstore.WithStdoutAccessLog(true))
+				})
+
+				It("logs the connections of each listener to stdout", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).NotTo(HaveOccurred())
+
+					listenerConfig := readListenerConfig(listenerConfigFile)
+					Expect(listenerConfig.Resources).To(HaveLen(2))
+					for _, listener := range listenerConfig.Resources {
+						filter := listener.FilterChains[0].Filters[0]
+						Expect(filter.Name).To(Equal("envoy.tcp_proxy"))
+						Expect(filter.Config.AccessLog).To(ConsistOf(envoy.AccessLog{
+							Name:   "envoy.file_access_log",
+							Config: envoy.AccessLogConfig{Path: "/dev/stdout"},
+						}))
+					}
+				})
+			})
+
+			Context("that is empty", func() {
+				BeforeEach(func() {
+					opts = append(opts, containerstore.WithAdminAccessLogPath(""))
+				})
+
+				It("defaults to /dev/null", func() {
+					Expect(readProxyConfig(proxyConfigFile).Admin.AccessLogPath).To(Equal("/dev/null"))
+				})
+			})
+		})
+
+		Context("for listener config", func() {
+			var listenerConfig envoy.ListenerConfig
+			BeforeEach(func() {
+				containerProxyRequireClientCerts = true
+			})
+
+			Context("with a cipher suite containing a separator", func() {
+				BeforeEach(func() {
+					opts = append(opts, containerstore.WithCipherSuites([]string{"ECDHE-RSA-AES128-GCM-SHA256|RC4"}))
+				})
+
+				It("should error out", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).To(MatchError(`invalid cipher suite: "ECDHE-RSA-AES128-GCM-SHA256|RC4"`))
+				})
+			})
+
+			Context("with a cipher suite containing a bracket", func() {
+				BeforeEach(func() {
+					opts = append(opts, containerstore.WithCipherSuites([]string{"[ECDHE-RSA-AES128-GCM-SHA256"}))
+				})
+
+				It("should error out", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).To(MatchError(`invalid cipher suite: "[ECDHE-RSA-AES128-GCM-SHA256"`))
+				})
+			})
+
+			Context("with an invalid tls protocol version", func() {
+				BeforeEach(func() {
+					opts = append(opts, containerstore.WithTLSProtocolVersions("TLSv1_2", "TLSv9"))
+				})
+
+				It("should error out without writing the config", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).To(MatchError(`invalid tls protocol version: "TLSv9"`))
+					Expect(proxyConfigFile).NotTo(BeAnExistingFile())
+					Expect(listenerConfigFile).NotTo(BeAnExistingFile())
+				})
+			})
+
+			Context("with invalid trusted cert", func() {
+				BeforeEach(func() {
+					containerProxyTrustedCACerts = []string{"some-cert"}
+				})
+
+				It("should error out", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).To(MatchError("failed to read certificate."))
+				})
+			})
+
+			Context("with valid config", func() {
+				JustBeforeEach(func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).NotTo(HaveOccurred())
+					Eventually(listenerConfigFile).Should(BeAnExistingFile())
+
+					data, err := ioutil.ReadFile(listenerConfigFile)
+					Expect(err).NotTo(HaveOccurred())
+
+					err = yaml.Unmarshal(data, &listenerConfig)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(listenerConfig.Resources).To(HaveLen(1))
+				})
+
+				It("writes the initial listener config at start", func() {
+					listener := listenerConfig.Resources[0]
+
+					Expect(listener.Type).To(Equal("type.googleapis.com/envoy.api.v2.Listener"))
+					Expect(listener.Name).To(Equal("listener-8080"))
+					Expect(listener.Address).To(Equal(envoy.Address{SocketAddress: envoy.SocketAddress{Address: "0.0.0.0", PortValue: 61001}}))
+					Expect(listener.FilterChains).To(HaveLen(1))
+
+					chain := listener.FilterChains[0]
+					certs := chain.TLSContext.CommonTLSContext.TLSCertificates
+					validations := chain.TLSContext.CommonTLSContext.ValidationContext
+					Expect(chain.TLSContext.RequireClientCertificate).To(BeTrue())
+					Expect(certs).To(ConsistOf(envoy.TLSCertificate{
+						CertificateChain: envoy.DataSource{InlineString: validCert},
+						PrivateKey:       envoy.DataSource{InlineString: validKey},
+					}))
+					Expect(validations.TrustedCA).To(Equal(envoy.DataSource{InlineString: ""}))
+					Expect(validations.VerifySubjectAltName).To(BeNil())
+					Expect(chain.TLSContext.CommonTLSContext.TLSParams.CipherSuites).To(Equal("[ECDHE-RSA-AES256-GCM-SHA384|ECDHE-RSA-AES128-GCM-SHA256]"))
+
+					Expect(chain.Filters).To(HaveLen(1))
+					filter := chain.Filters[0]
+					Expect(filter.Name).To(Equal("envoy.tcp_proxy"))
+					Expect(filter.Config.Cluster).To(Equal("0-service-cluster"))
+					Expect(filter.Config.StatPrefix).NotTo(BeEmpty())
+				})
+
+				It("does not match filter chains on server names", func() {
+					Expect(listenerConfig.Resources[0].FilterChains[0].FilterChainMatch).To(BeNil())
+
+					data, err := ioutil.ReadFile(listenerConfigFile)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(data)).NotTo(ContainSubstring("filter_chain_match"))
+				})
+
+				Context("with sni certificates", func() {
+					var firstCert, firstKey, secondCert, secondKey string
+
+					BeforeEach(func() {
+						firstCert, firstKey, _ = generateCertAndKey()
+						secondCert, secondKey, _ = generateCertAndKey()
+						opts = append(opts, containerstore.WithSNICertificates([]containerstore.SNICertificate{
+							{ServerNames: []string{"first.example.com"}, Cert: firstCert, Key: firstKey},
+							{ServerNames: []string{"second.example.com", "*.second.example.com"}, Cert: secondCert, Key: secondKey},
+						}))
+					})
+
+					It("adds a filter chain matching the server names of each certificate", func() {
+						chains := listenerConfig.Resources[0].FilterChains
+						Expect(chains).To(HaveLen(3))
+
+						Expect(chains[0].FilterChainMatch).To(Equal(&envoy.FilterChainMatch{ServerNames: []string{"first.example.com"}}))
+						Expect(chains[0].TLSContext.CommonTLSContext.TLSCertificates).To(ConsistOf(envoy.TLSCertificate{
+							CertificateChain: envoy.DataSource{InlineString: firstCert},
+							PrivateKey:       envoy.DataSource{InlineString: firstKey},
+						}))
+
+						Expect(chains[1].FilterChainMatch).To(Equal(&envoy.FilterChainMatch{ServerNames: []string{"second.example.com", "*.second.example.com"}}))
+						Expect(chains[1].TLSContext.CommonTLSContext.TLSCertificates).To(ConsistOf(envoy.TLSCertificate{
+							CertificateChain: envoy.DataSource{InlineString: secondCert},
+							PrivateKey:       envoy.DataSource{InlineString: secondKey},
+						}))
+
+						Expect(chains[0].Filters).To(Equal(chains[2].Filters))
+						Expect(chains[1].Filters).To(Equal(chains[2].Filters))
+					})
+
+					It("serves the container credentials to unmatched connections", func() {
+						chain := listenerConfig.Resources[0].FilterChains[2]
+						Expect(chain.FilterChainMatch).To(BeNil())
+						Expect(chain.TLSContext.CommonTLSContext.TLSCertificates).To(ConsistOf(envoy.TLSCertificate{
+							CertificateChain: envoy.DataSource{InlineString: validCert},
+							PrivateKey:       envoy.DataSource{InlineString: validKey},
+						}))
+					})
+				})
+
+				Context("with a listener bind address", func() {
+					BeforeEach(func() {
+						opts = append(opts, containerstore.WithListenerBindAddress("10.255.0.2"))
+					})
+
+					It("binds the listeners to that address", func() {
+						Expect(listenerConfig.Resources[0].Address).To(Equal(envoy.Address{
+							SocketAddress: envoy.SocketAddress{Address: "10.255.0.2", PortValue: 61001},
+						}))
+					})
+				})
+
+				Context("with an ipv6 listener bind address", func() {
+					BeforeEach(func() {
+						opts = append(opts, containerstore.WithListenerBindAddress("[fd00::2]"))
+					})
+
+					It("binds the listeners to that address without brackets", func() {
+						Expect(listenerConfig.Resources[0].Address.SocketAddress.Address).To(Equal("fd00::2"))
+					})
+				})
+
+				It("does not limit the connection buffers", func() {
+					data, err := ioutil.ReadFile(listenerConfigFile)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(data)).NotTo(ContainSubstring("per_connection_buffer_limit_bytes"))
+				})
+
+				Context("with a per connection buffer limit", func() {
+					BeforeEach(func() {
+						opts = append(opts, containerstore.WithPerConnectionBufferLimit(32768))
+					})
+
+					It("sets it on the listeners", func() {
+						Expect(listenerConfig.Resources[0].PerConnectionBufferLimitBytes).To(Equal(uint32(32768)))
+
+						data, err := ioutil.ReadFile(listenerConfigFile)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(string(data)).To(ContainSubstring("per_connection_buffer_limit_bytes: 32768"))
+					})
+				})
+
+				Context("with an sds server", func() {
+					BeforeEach(func() {
+						opts = append(opts, containerstore.WithSDSServer("10.255.0.9", 8234))
+					})
+
+					It("fetches the container credentials from the sds server", func() {
+						commonTLSContext := listenerConfig.Resources[0].FilterChains[0].TLSContext.CommonTLSContext
+						Expect(commonTLSContext.TLSCertificates).To(BeEmpty())
+						Expect(commonTLSContext.TLSCertificateSDSSecretConfigs).To(Equal([]envoy.SDSSecretConfig{
+							{
+								Name: container.Guid,
+								SDSConfig: envoy.SDSConfig{
+									APIConfigSource: envoy.APIConfigSource{
+										APIType: "GRPC",
+										GRPCServices: []envoy.GRPCService{
+											{EnvoyGRPC: envoy.EnvoyGRPC{ClusterName: "sds-grpc"}},
+										},
+									},
+								},
+							},
+						}))
+					})
+
+					It("does not write the credentials to the listener config", func() {
+						data, err := ioutil.ReadFile(listenerConfigFile)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(string(data)).NotTo(ContainSubstring("private_key"))
+						Expect(string(data)).NotTo(ContainSubstring("tls_certificates"))
+					})
+
+					Context("with the envoy v3 api", func() {
+						BeforeEach(func() {
+							opts = append(opts, containerstore.WithEnvoyAPIV3(true))
+						})
+
+						It("fetches the credentials with the v3 api", func() {
+							tlsContext := listenerConfig.Resources[0].FilterChains[0].TransportSocket.TypedConfig
+							sdsConfig := tlsContext.CommonTLSContext.TLSCertificateSDSSecretConfigs[0].SDSConfig
+							Expect(sdsConfig.ResourceAPIVersion).To(Equal("V3"))
+							Expect(sdsConfig.APIConfigSource.TransportAPIVersion).To(Equal("V3"))
+						})
+					})
+				})
+
+				Context("with the envoy v3 api", func() {
+					BeforeEach(func() {
+						opts = append(opts, containerstore.WithEnvoyAPIV3(true))
+					})
+
+					It("writes v3 listeners", func() {
+						listener := listenerConfig.Resources[0]
+						Expect(listener.Type).To(Equal("type.googleapis.com/envoy.config.listener.v3.Listener"))
+						Expect(listener.FilterChains).To(HaveLen(1))
+
+						filter := listener.FilterChains[0].Filters[0]
+						Expect(filter.Name).To(Equal("envoy.filters.network.tcp_proxy"))
+						Expect(filter.TypedConfig).NotTo(BeNil())
+						Expect(filter.TypedConfig.Type).To(Equal("type.googleapis.com/envoy.extensions.filters.network.tcp_proxy.v3.TcpProxy"))
+						Expect(filter.TypedConfig.Cluster).To(Equal("0-service-cluster"))
+						Expect(filter.Config).To(Equal(envoy.Config{}))
+					})
+
+					It("configures tls with a transport socket", func() {
+						chain := listenerConfig.Resources[0].FilterChains[0]
+						Expect(chain.TLSContext).To(Equal(envoy.TLSContext{}))
+						Expect(chain.TransportSocket).NotTo(BeNil())
+						Expect(chain.TransportSocket.Name).To(Equal("envoy.transport_sockets.tls"))
+
+						tlsContext := chain.TransportSocket.TypedConfig
+						Expect(tlsContext.Type).To(Equal("type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext"))
+						Expect(tlsContext.RequireClientCertificate).To(BeTrue())
+						Expect(tlsContext.CommonTLSContext.TLSCertificates).To(ConsistOf(envoy.TLSCertificate{
+							CertificateChain: envoy.DataSource{InlineString: validCert},
+							PrivateKey:       envoy.DataSource{InlineString: validKey},
+						}))
+
+						data, err := ioutil.ReadFile(listenerConfigFile)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(string(data)).NotTo(ContainSubstring("tls_context:"))
+					})
+
+					Context("with the http connection manager and an access log", func() {
+						BeforeEach(func() {
+							opts = append(opts,
+								containerstore.WithHTTPConnectionManager(true),
+								containerstore.WithStdoutAccessLog(true),
+							)
+						})
+
+						It("types every extension", func() {
+							filter := listenerConfig.Resources[0].FilterChains[0].Filters[0]
+							Expect(filter.Name).To(Equal("envoy.filters.network.http_connection_manager"))
+							Expect(filter.TypedConfig.Type).To(Equal("type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager"))
+
+							Expect(filter.TypedConfig.HTTPFilters).To(Equal([]envoy.HTTPFilter{{
+								Name:        "envoy.filters.http.router",
+								TypedConfig: &envoy.TypedExtension{Type: "type.googleapis.com/envoy.extensions.filters.http.router.v3.Router"},
+							}}))
+							Expect(filter.TypedConfig.AccessLog).To(Equal([]envoy.AccessLog{{
+								Name: "envoy.access_loggers.file",
+								TypedConfig: &envoy.AccessLogTypedConfig{
+									Type: "type.googleapis.com/envoy.extensions.access_loggers.file.v3.FileAccessLog",
+									Path: "/dev/stdout",
+								},
+							}}))
+						})
+					})
+				})
+
+				It("does not set reuse_port", func() {
+					Expect(listenerConfig.Resources[0].ReusePort).To(BeFalse())
+
+					data, err := ioutil.ReadFile(listenerConfigFile)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(data)).NotTo(ContainSubstring("reuse_port"))
+				})
+
+				Context("with reuse port enabled", func() {
+					BeforeEach(func() {
+						opts = append(opts, containerstore.WithReusePort(true))
+					})
+
+					It("sets reuse_port on the listeners", func() {
+						Expect(listenerConfig.Resources[0].ReusePort).To(BeTrue())
+					})
+				})
+
+				It("does not set an idle timeout", func() {
+					filter := listenerConfig.Resources[0].FilterChains[0].Filters[0]
+					Expect(filter.Config.IdleTimeout).To(BeEmpty())
+
+					data, err := ioutil.ReadFile(listenerConfigFile)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(data)).NotTo(ContainSubstring("idle_timeout"))
+				})
+
+				Context("with an idle timeout configured", func() {
+					BeforeEach(func() {
+						opts = append(opts, containerstore.WithIdleTimeout(90*time.Second))
+					})
+
+					It("sets it on the tcp proxy filter", func() {
+						filter := listenerConfig.Resources[0].FilterChains[0].Filters[0]
+						Expect(filter.Name).To(Equal("envoy.tcp_proxy"))
+						Expect(filter.Config.IdleTimeout).To(Equal("90s"))
+					})
+				})
+
+				Context("with the http connection manager enabled", func() {
+					BeforeEach(func() {
+						opts = append(opts, containerstore.WithHTTPConnectionManager(true))
+					})
+
+					It("routes all http traffic to the service cluster", func() {
+						chain := listenerConfig.Resources[0].FilterChains[0]
+						Expect(chain.Filters).To(HaveLen(1))
+
+						filter := chain.Filters[0]
+						Expect(filter.Name).To(Equal("envoy.http_connection_manager"))
+						Expect(filter.Config.Cluster).To(BeEmpty())
+						Expect(filter.Config.StatPrefix).NotTo(BeEmpty())
+						Expect(filter.Config.HTTPFilters).To(ConsistOf(envoy.HTTPFilter{Name: "envoy.router"}))
+
+						Expect(filter.Config.RouteConfig).NotTo(BeNil())
+						Expect(filter.Config.RouteConfig.VirtualHosts).To(HaveLen(1))
+						virtualHost := filter.Config.RouteConfig.VirtualHosts[0]
+						Expect(virtualHost.Domains).To(ConsistOf("*"))
+						Expect(virtualHost.Routes).To(ConsistOf(envoy.Route{
+							Match: envoy.RouteMatch{Prefix: "/"},
+							Route: envoy.RouteAction{Cluster: "0-service-cluster"},
+						}))
+					})
+
+					It("keeps the tls context on the filter chain", func() {
+						chain := listenerConfig.Resources[0].FilterChains[0]
+						Expect(chain.TLSContext.CommonTLSContext.TLSCertificates).To(ConsistOf(envoy.TLSCertificate{
+							CertificateChain: envoy.DataSource{InlineString: validCert},
+							PrivateKey:       envoy.DataSource{InlineString: validKey},
+						}))
+					})
+				})
+
+				Context("without the http connection manager", func() {
+					It("does not write http route config", func() {
+						data, err := ioutil.ReadFile(listenerConfigFile)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(string(data)).NotTo(ContainSubstring("route_config"))
+						Expect(string(data)).NotTo(ContainSubstring("http_filters"))
+					})
+				})
+
+				Context("with custom cipher suites", func() {
+					BeforeEach(func() {
+						opts = append(opts, containerstore.WithCipherSuites([]string{
+							"ECDHE-ECDSA-AES128-GCM-SHA256",
+							"ECDHE-RSA-AES128-GCM-SHA256",
+						}))
+					})
+
+					It("uses them in the listener tls params", func() {
+						chain := listenerConfig.Resources[0].FilterChains[0]
+						Expect(chain.TLSContext.CommonTLSContext.TLSParams.CipherSuites).To(Equal("[ECDHE-ECDSA-AES128-GCM-SHA256|ECDHE-RSA-AES128-GCM-SHA256]"))
+					})
+				})
+
+				Context("with an empty list of cipher suites", func() {
+					BeforeEach(func() {
+						opts = append(opts, containerstore.WithCipherSuites([]string{}))
+					})
+
+					It("falls back to the default cipher suites", func() {
+						chain := listenerConfig.Resources[0].FilterChains[0]
+						Expect(chain.TLSContext.CommonTLSContext.TLSParams.CipherSuites).To(Equal("[ECDHE-RSA-AES256-GCM-SHA384|ECDHE-RSA-AES128-GCM-SHA256]"))
+					})
+				})
+
+				Context("with tls protocol version bounds", func() {
+					BeforeEach(func() {
+						opts = append(opts, containerstore.WithTLSProtocolVersions("TLSv1_2", "TLSv1_3"))
+					})
+
+					It("sets both bounds in the listener tls params", func() {
+						tlsParams := listenerConfig.Resources[0].FilterChains[0].TLSContext.CommonTLSContext.TLSParams
+						Expect(tlsParams.TLSMinimumProtocolVersion).To(Equal("TLSv1_2"))
+						Expect(tlsParams.TLSMaximumProtocolVersion).To(Equal("TLSv1_3"))
+					})
+
+					It("writes the bounds to the listener yaml", func() {
+						data, err := ioutil.ReadFile(listenerConfigFile)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(string(data)).To(ContainSubstring("tls_minimum_protocol_version: TLSv1_2"))
+						Expect(string(data)).To(ContainSubstring("tls_maximum_protocol_version: TLSv1_3"))
+					})
+				})
+
+				Context("with only a minimum tls protocol version", func() {
+					BeforeEach(func() {
+						opts = append(opts, containerstore.WithTLSProtocolVersions("TLSv1_2", ""))
+					})
+
+					It("leaves the maximum unset", func() {
+						tlsParams := listenerConfig.Resources[0].FilterChains[0].TLSContext.CommonTLSContext.TLSParams
+						Expect(tlsParams.TLSMinimumProtocolVersion).To(Equal("TLSv1_2"))
+
+						data, err := ioutil.ReadFile(listenerConfigFile)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(string(data)).NotTo(ContainSubstring("tls_maximum_protocol_version"))
+					})
+				})
+
+				Context("with container proxy trusted certs set", func() {
+					var inlinedCert string
+					BeforeEach(func() {
+						cert, _, _ := generateCertAndKey()
+						inlinedCert = fmt.Sprintf("%s%s", cert, cert)
+						containerProxyTrustedCACerts = []string{cert, cert}
+						containerProxyVerifySubjectAltName = []string{"valid-alt-name-1", "valid-alt-name-2"}
+					})
+
+					It("writes trusted certs info into listener config", func() {
+						listener := listenerConfig.Resources[0]
+						chain := listener.FilterChains[0]
+						validations := chain.TLSContext.CommonTLSContext.ValidationContext
+						Expect(validations.TrustedCA).To(Equal(envoy.DataSource{InlineString: inlinedCert}))
+						Expect(validations.VerifySubjectAltName).To(ConsistOf("valid-alt-name-1", "valid-alt-name-2"))
+					})
+
+					Context("when the container sets its own subject alt names", func() {
+						BeforeEach(func() {
+							container.ContainerProxyVerifySubjectAltName = []string{"container-alt-name"}
+						})
+
+						It("verifies them instead of the handler ones", func() {
+							validations := listenerConfig.Resources[0].FilterChains[0].TLSContext.CommonTLSContext.ValidationContext
+							Expect(validations.VerifySubjectAltName).To(ConsistOf("container-alt-name"))
+						})
+					})
+
+					Context("with typed subject alt names", func() {
+						BeforeEach(func() {
+							opts = append(opts, containerstore.WithTypedSubjectAltNames([]containerstore.TypedSubjectAltName{
+								{Type: "URI", Matcher: "spiffe://cf.example.com/app"},
+								{Type: "DNS", Matcher: "app.example.com"},
+							}))
+						})
+
+						It("verifies them instead of the untyped subject alt names", func() {
+							validations := listenerConfig.Resources[0].FilterChains[0].TLSContext.CommonTLSContext.ValidationContext
+							Expect(validations.VerifySubjectAltName).To(BeNil())
+							Expect(validations.MatchTypedSubjectAltNames).To(Equal([]envoy.SubjectAltNameMatcher{
+								{SanType: "URI", Matcher: envoy.StringMatcher{Exact: "spiffe://cf.example.com/app"}},
+								{SanType: "DNS", Matcher: envoy.StringMatcher{Exact: "app.example.com"}},
+							}))
+
+							data, err := ioutil.ReadFile(listenerConfigFile)
+							Expect(err).NotTo(HaveOccurred())
+							Expect(string(data)).NotTo(ContainSubstring("verify_subject_alt_name"))
+							Expect(string(data)).To(ContainSubstring("san_type: URI"))
+						})
+
+						Context("when the container sets its own subject alt names", func() {
+							BeforeEach(func() {
+								container.ContainerProxyVerifySubjectAltName = []string{"container-alt-name"}
+							})
+
+							It("verifies the container ones", func() {
+								validations := listenerConfig.Resources[0].FilterChains[0].TLSContext.CommonTLSContext.ValidationContext
+								Expect(validations.VerifySubjectAltName).To(ConsistOf("container-alt-name"))
+								Expect(validations.MatchTypedSubjectAltNames).To(BeNil())
+							})
+						})
+					})
+
+					It("does not match typed subject alt names", func() {
+						data, err := ioutil.ReadFile(listenerConfigFile)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(string(data)).NotTo(ContainSubstring("match_typed_subject_alt_names"))
+					})
+
+					Context("when the container sets an empty list of subject alt names", func() {
+						BeforeEach(func() {
+							container.ContainerProxyVerifySubjectAltName = []string{}
+						})
+
+						It("falls back to the handler subject alt names", func() {
+							validations := listenerConfig.Resources[0].FilterChains[0].TLSContext.CommonTLSContext.ValidationContext
+							Expect(validations.VerifySubjectAltName).To(ConsistOf("valid-alt-name-1", "valid-alt-name-2"))
+						})
+					})
+
+					Context("when the container does not require client certs", func() {
+						BeforeEach(func() {
+							requireClientCerts := false
+							container.ContainerProxyRequireClientCerts = &requireClientCerts
+						})
+
+						It("writes a listener without client cert validation", func() {
+							chain := listenerConfig.Resources[0].FilterChains[0]
+							Expect(chain.TLSContext.RequireClientCertificate).To(BeFalse())
+
+							validations := chain.TLSContext.CommonTLSContext.ValidationContext
+							Expect(validations.TrustedCA).To(Equal(envoy.DataSource{InlineString: ""}))
+							Expect(validations.VerifySubjectAltName).To(BeNil())
+						})
+					})
+				})
+			})
+		})
+
+		Context("with a trusted ca certs file", func() {
+			var trustedCACertsFile, firstCert, secondCert string
+
+			BeforeEach(func() {
+				containerProxyRequireClientCerts = true
+				firstCert, _, _ = generateCertAndKey()
+				secondCert, _, _ = generateCertAndKey()
+
+				trustedCACertsFile = filepath.Join(proxyDir, "trusted-ca.crt")
+				err := ioutil.WriteFile(trustedCACertsFile, []byte(firstCert+secondCert), 0644)
+				Expect(err).NotTo(HaveOccurred())
+
+				containerProxyTrustedCACerts = []string{validCert}
+				opts = append(opts, containerstore.WithTrustedCACertsFile(trustedCACertsFile))
+			})
+
+			It("trusts the certificates in the file", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				validations := readListenerConfig(listenerConfigFile).Resources[0].FilterChains[0].TLSContext.CommonTLSContext.ValidationContext
+				Expect(validations.TrustedCA.InlineString).To(Equal(firstCert + secondCert))
+			})
+
+			It("picks up a rotated file on the next update", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				err = ioutil.WriteFile(trustedCACertsFile, []byte(secondCert), 0644)
+				Expect(err).NotTo(HaveOccurred())
+
+				err = proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				validations := readListenerConfig(listenerConfigFile).Resources[0].FilterChains[0].TLSContext.CommonTLSContext.ValidationContext
+				Expect(validations.TrustedCA.InlineString).To(Equal(secondCert))
+			})
+
+			Context("when the file is missing", func() {
+				BeforeEach(func() {
+					Expect(os.Remove(trustedCACertsFile)).To(Succeed())
+				})
+
+				It("returns an error without writing any config", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).To(MatchError(ContainSubstring("failed to read trusted ca certs file")))
+
+					Expect(proxyConfigFile).NotTo(BeAnExistingFile())
+					Expect(listenerConfigFile).NotTo(BeAnExistingFile())
+				})
+			})
+
+			Context("when the file has no certificates", func() {
+				BeforeEach(func() {
+					err := ioutil.WriteFile(trustedCACertsFile, []byte("garbage"), 0644)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("returns an error", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).To(MatchError(ContainSubstring("no certificates found in trusted ca certs file")))
+				})
+			})
+		})
+
+		Context("when the container requires client certs and the handler does not", func() {
+			BeforeEach(func() {
+				cert, _, _ := generateCertAndKey()
+				containerProxyRequireClientCerts = false
+				containerProxyTrustedCACerts = []string{cert}
+				containerProxyVerifySubjectAltName = []string{"valid-alt-name-1"}
+
+				requireClientCerts := true
+				container.ContainerProxyRequireClientCerts = &requireClientCerts
+			})
+
+			It("writes a listener with client cert validation", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				chain := readListenerConfig(listenerConfigFile).Resources[0].FilterChains[0]
+				Expect(chain.TLSContext.RequireClientCertificate).To(BeTrue())
+
+				validations := chain.TLSContext.CommonTLSContext.ValidationContext
+				Expect(validations.TrustedCA.InlineString).To(Equal(containerProxyTrustedCACerts[0]))
+				Expect(validations.VerifySubjectAltName).To(ConsistOf("valid-alt-name-1"))
+			})
+		})
+
+		Context("with multiple port mappings", func() {
+			BeforeEach(func() {
+				container.Ports = []executor.PortMapping{
+					executor.PortMapping{
+						ContainerPort:         8080,
+						ContainerTLSProxyPort: 61001,
+					},
+					executor.PortMapping{
+						ContainerPort:         2222,
+						ContainerTLSProxyPort: 61002,
+					},
+				}
+			})
+
+			It("creates the appropriate listener config with a unique stat prefix", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(listenerConfigFile).Should(BeAnExistingFile())
+
+				data, err := ioutil.ReadFile(listenerConfigFile)
+				Expect(err).NotTo(HaveOccurred())
+
+				var listenerConfig envoy.ListenerConfig
+
+				err = yaml.Unmarshal(data, &listenerConfig)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(listenerConfig.Resources).To(HaveLen(2))
+
+				listener := listenerConfig.Resources[0]
 
 				Expect(listener.Type).To(Equal("type.googleapis.com/envoy.api.v2.Listener"))
 				Expect(listener.Name).To(Equal("listener-8080"))
@@ -473,8 +3387,8 @@ var _ = Describe("ProxyConfigHandler", func() {
 				chain := listener.FilterChains[0]
 				certs := chain.TLSContext.CommonTLSContext.TLSCertificates
 				Expect(certs).To(ConsistOf(envoy.TLSCertificate{
-					CertificateChain: envoy.DataSource{InlineString: "cert"},
-					PrivateKey:       envoy.DataSource{InlineString: "key"},
+					CertificateChain: envoy.DataSource{InlineString: validCert},
+					PrivateKey:       envoy.DataSource{InlineString: validKey},
 				}))
 				Expect(chain.TLSContext.CommonTLSContext.TLSParams.CipherSuites).To(Equal("[ECDHE-RSA-AES256-GCM-SHA384|ECDHE-RSA-AES128-GCM-SHA256]"))
 
@@ -495,8 +3409,8 @@ var _ = Describe("ProxyConfigHandler", func() {
 				chain = listener.FilterChains[0]
 				certs = chain.TLSContext.CommonTLSContext.TLSCertificates
 				Expect(certs).To(ConsistOf(envoy.TLSCertificate{
-					CertificateChain: envoy.DataSource{InlineString: "cert"},
-					PrivateKey:       envoy.DataSource{InlineString: "key"},
+					CertificateChain: envoy.DataSource{InlineString: validCert},
+					PrivateKey:       envoy.DataSource{InlineString: validKey},
 				}))
 				Expect(chain.TLSContext.CommonTLSContext.TLSParams.CipherSuites).To(Equal("[ECDHE-RSA-AES256-GCM-SHA384|ECDHE-RSA-AES128-GCM-SHA256]"))
 
@@ -508,8 +3422,136 @@ var _ = Describe("ProxyConfigHandler", func() {
 				Expect(filter.Config.StatPrefix).NotTo(Equal(listener1StatPrefix))
 			})
 
+			It("names the listener stats after the port index", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				listenerConfig := readListenerConfig(listenerConfigFile)
+				Expect(listenerConfig.Resources[0].FilterChains[0].Filters[0].Config.StatPrefix).To(Equal("0-stats"))
+				Expect(listenerConfig.Resources[1].FilterChains[0].Filters[0].Config.StatPrefix).To(Equal("1-stats"))
+			})
+
+			Context("with stable stat prefixes", func() {
+				BeforeEach(func() {
+					opts = append(opts, containerstore.WithStableStatPrefixes(true))
+				})
+
+				It("names the listener stats after the container and app port", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).NotTo(HaveOccurred())
+
+					listenerConfig := readListenerConfig(listenerConfigFile)
+					Expect(listenerConfig.Resources[0].FilterChains[0].Filters[0].Config.StatPrefix).To(Equal(container.Guid + "-8080"))
+					Expect(listenerConfig.Resources[1].FilterChains[0].Filters[0].Config.StatPrefix).To(Equal(container.Guid + "-2222"))
+				})
+			})
+
+			It("does not write an empty validation context when client certs are not required", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				data, err := ioutil.ReadFile(listenerConfigFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).NotTo(ContainSubstring("validation_context"))
+			})
+
+			Context("when a later update requires client certs", func() {
+				BeforeEach(func() {
+					cert, _, _ := generateCertAndKey()
+					containerProxyTrustedCACerts = []string{cert}
+				})
+
+				It("writes the validation context again", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).NotTo(HaveOccurred())
+
+					requireClientCerts := true
+					container.ContainerProxyRequireClientCerts = &requireClientCerts
+					err = proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).NotTo(HaveOccurred())
+
+					data, err := ioutil.ReadFile(listenerConfigFile)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(data)).To(ContainSubstring("validation_context"))
+				})
+			})
+
+			Context("with a health check port requiring client certs", func() {
+				var trustedCert string
+
+				BeforeEach(func() {
+					trustedCert, _, _ = generateCertAndKey()
+					containerProxyRequireClientCerts = true
+					containerProxyTrustedCACerts = []string{trustedCert}
+					containerProxyVerifySubjectAltName = []string{"valid-alt-name-1"}
+					container.ContainerProxyHealthCheckPort = 2222
+				})
+
+				It("does not require client certs on the health check listener", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).NotTo(HaveOccurred())
+
+					listenerConfig := readListenerConfig(listenerConfigFile)
+					Expect(listenerConfig.Resources).To(HaveLen(2))
+
+					healthCheckListener := listenerConfig.Resources[1]
+					Expect(healthCheckListener.Name).To(Equal("listener-2222"))
+					tlsContext := healthCheckListener.FilterChains[0].TLSContext
+					Expect(tlsContext.RequireClientCertificate).To(BeFalse())
+					Expect(tlsContext.CommonTLSContext.ValidationContext).To(Equal(envoy.CertificateValidationContext{}))
+				})
+
+				It("keeps requiring client certs on the other listeners", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).NotTo(HaveOccurred())
+
+					listenerConfig := readListenerConfig(listenerConfigFile)
+					appListener := listenerConfig.Resources[0]
+					Expect(appListener.Name).To(Equal("listener-8080"))
+					tlsContext := appListener.FilterChains[0].TLSContext
+					Expect(tlsContext.RequireClientCertificate).To(BeTrue())
+					Expect(tlsContext.CommonTLSContext.ValidationContext.TrustedCA.InlineString).To(Equal(trustedCert))
+					Expect(tlsContext.CommonTLSContext.ValidationContext.VerifySubjectAltName).To(ConsistOf("valid-alt-name-1"))
+				})
+			})
+
+			It("does not write access logs for the listeners", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				data, err := ioutil.ReadFile(listenerConfigFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).NotTo(ContainSubstring("access_log"))
+			})
+
+			Context("with a listener access log path configured", func() {
+				BeforeEach(func() {
+					opts = append(opts, containerstore.WithListenerAccessLogPath("/etc/cf-assets/envoy_config/logs/access.log"))
+				})
+
+				It("writes a file access log for each listener", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).NotTo(HaveOccurred())
+
+					listenerConfig := readListenerConfig(listenerConfigFile)
+					Expect(listenerConfig.Resources).To(HaveLen(2))
+					for _, listener := range listenerConfig.Resources {
+						Expect(listener.FilterChains[0].Filters[0].Config.AccessLog).To(ConsistOf(envoy.AccessLog{
+							Name:   "envoy.file_access_log",
+							Config: envoy.AccessLogConfig{Path: "/etc/cf-assets/envoy_config/logs/access.log"},
+						}))
+					}
+				})
+
+				It("creates the log directory in the container config directory", func() {
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(filepath.Join(configPath, "logs")).To(BeADirectory())
+				})
+			})
+
 			It("creates the appropriate proxy config file", func() {
-				err := proxyConfigHandler.Update(containerstore.Credential{Cert: "cert", Key: "key"}, container)
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
 				Expect(err).NotTo(HaveOccurred())
 				Eventually(proxyConfigFile).Should(BeAnExistingFile())
 
@@ -549,6 +3591,51 @@ var _ = Describe("ProxyConfigHandler", func() {
 				}))
 			})
 
+			Context("with a custom proxy port range", func() {
+				BeforeEach(func() {
+					container.Ports = []executor.PortMapping{
+						{ContainerPort: 8080, ContainerTLSProxyPort: 62000},
+						{ContainerPort: 2222, ContainerTLSProxyPort: 62001},
+					}
+				})
+
+				Context("that fits the admin port", func() {
+					BeforeEach(func() {
+						opts = append(opts, containerstore.WithProxyPortRange(62000, 62003))
+					})
+
+					It("allocates the admin port from that range", func() {
+						err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+						Expect(err).NotTo(HaveOccurred())
+
+						proxyConfig := readProxyConfig(proxyConfigFile)
+						Expect(proxyConfig.Admin.Address).To(Equal(envoy.Address{SocketAddress: envoy.SocketAddress{Address: "127.0.0.1", PortValue: 62002}}))
+					})
+				})
+
+				Context("that is exhausted by the listener ports", func() {
+					BeforeEach(func() {
+						opts = append(opts, containerstore.WithProxyPortRange(62000, 62002))
+					})
+
+					It("returns an error", func() {
+						err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+						Expect(err).To(Equal(containerstore.ErrNoPortsAvailable))
+					})
+				})
+
+				Context("that is inverted", func() {
+					BeforeEach(func() {
+						opts = append(opts, containerstore.WithProxyPortRange(62003, 62000))
+					})
+
+					It("returns an error", func() {
+						err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+						Expect(err).To(MatchError("invalid proxy port range: 62003-62000"))
+					})
+				})
+			})
+
 			Context("when no ports are left", func() {
 				BeforeEach(func() {
 					ports := []executor.PortMapping{}
@@ -563,13 +3650,134 @@ var _ = Describe("ProxyConfigHandler", func() {
 				})
 
 				It("returns an error", func() {
-					err := proxyConfigHandler.Update(containerstore.Credential{Cert: "cert", Key: "key"}, container)
+					err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
 					Expect(err).To(Equal(containerstore.ErrNoPortsAvailable))
 				})
 			})
 		})
 	})
 
+	Describe("Runner", func() {
+		var (
+			credChan chan containerstore.Credential
+			process  ifrit.Process
+		)
+
+		BeforeEach(func() {
+			container.Ports = []executor.PortMapping{
+				{ContainerPort: 8080, ContainerTLSProxyPort: 61001},
+			}
+			credChan = make(chan containerstore.Credential)
+		})
+
+		JustBeforeEach(func() {
+			_, _, err := proxyConfigHandler.CreateDir(logger, container)
+			Expect(err).NotTo(HaveOccurred())
+
+			runner, err := proxyConfigHandler.Runner(logger, container, credChan)
+			Expect(err).NotTo(HaveOccurred())
+			process = ifrit.Background(runner)
+			Eventually(process.Ready()).Should(BeClosed())
+		})
+
+		AfterEach(func() {
+			process.Signal(os.Interrupt)
+			Eventually(func() <-chan error {
+				reloadClock.Increment(time.Second)
+				return process.Wait()
+			}).Should(Receive())
+		})
+
+		It("updates the proxy config with every credential it receives", func() {
+			Expect(listenerConfigFile).NotTo(BeAnExistingFile())
+
+			Eventually(credChan).Should(BeSent(containerstore.Credential{Cert: validCert, Key: validKey}))
+			Eventually(listenerConfigFile).Should(BeAnExistingFile())
+			Expect(proxyConfigFile).To(BeAnExistingFile())
+
+			newCert, newKey, _ := generateCertAndKey()
+			Eventually(credChan).Should(BeSent(containerstore.Credential{Cert: newCert, Key: newKey}))
+			Eventually(func() string {
+				certs := readListenerConfig(listenerConfigFile).Resources[0].FilterChains[0].TLSContext.CommonTLSContext.TLSCertificates
+				return certs[0].CertificateChain.InlineString
+			}).Should(Equal(newCert))
+		})
+
+		Context("when an update fails", func() {
+			It("logs the error and keeps running", func() {
+				Eventually(credChan).Should(BeSent(containerstore.Credential{Cert: "invalid", Key: "invalid"}))
+				Eventually(logger).Should(gbytes.Say("failed-to-update"))
+				Consistently(process.Wait()).ShouldNot(Receive())
+
+				Eventually(credChan).Should(BeSent(containerstore.Credential{Cert: validCert, Key: validKey}))
+				Eventually(listenerConfigFile).Should(BeAnExistingFile())
+			})
+		})
+
+		Context("when signalled", func() {
+			It("closes the proxy with invalid credentials and exits after the reload duration", func() {
+				Eventually(credChan).Should(BeSent(containerstore.Credential{Cert: validCert, Key: validKey}))
+				Eventually(listenerConfigFile).Should(BeAnExistingFile())
+
+				process.Signal(os.Interrupt)
+
+				Eventually(reloadClock.WatcherCount).Should(Equal(1))
+				listeners := readListenerConfig(listenerConfigFile).Resources
+				Expect(listeners).To(HaveLen(1))
+				certs := listeners[0].FilterChains[0].TLSContext.CommonTLSContext.TLSCertificates
+				Expect(certs).To(HaveLen(1))
+				Expect(certs[0].CertificateChain.InlineString).To(HavePrefix("-----BEGIN CERTIFICATE-----"))
+				Expect(certs[0].CertificateChain.InlineString).NotTo(Equal(validCert))
+				Expect(certs[0].PrivateKey.InlineString).NotTo(Equal(validKey))
+				Consistently(process.Wait()).ShouldNot(Receive())
+
+				reloadClock.Increment(1000 * time.Millisecond)
+				Eventually(process.Wait()).Should(Receive(BeNil()))
+			})
+
+			Context("with drain on close enabled", func() {
+				BeforeEach(func() {
+					opts = append(opts, containerstore.WithDrainOnClose(true))
+				})
+
+				It("removes the listeners and exits after the drain and reload durations", func() {
+					Eventually(credChan).Should(BeSent(containerstore.Credential{Cert: validCert, Key: validKey}))
+					Eventually(listenerConfigFile).Should(BeAnExistingFile())
+
+					process.Signal(os.Interrupt)
+
+					Eventually(reloadClock.WatcherCount).Should(Equal(1))
+					Expect(readListenerConfig(listenerConfigFile).Resources).To(BeEmpty())
+
+					reloadClock.Increment(1000 * time.Millisecond)
+					Eventually(reloadClock.WatcherCount).Should(Equal(1))
+					listeners := readListenerConfig(listenerConfigFile).Resources
+					Expect(listeners).To(HaveLen(1))
+					certs := listeners[0].FilterChains[0].TLSContext.CommonTLSContext.TLSCertificates
+					Expect(certs[0].CertificateChain.InlineString).NotTo(Equal(validCert))
+					Consistently(process.Wait()).ShouldNot(Receive())
+
+					reloadClock.Increment(1000 * time.Millisecond)
+					Eventually(process.Wait()).Should(Receive(BeNil()))
+				})
+			})
+		})
+
+		Context("the EnableContainerProxy is disabled on the container", func() {
+			BeforeEach(func() {
+				container.EnableContainerProxy = false
+			})
+
+			It("does not write any config", func() {
+				Eventually(credChan).Should(BeSent(containerstore.Credential{Cert: validCert, Key: validKey}))
+				Consistently(listenerConfigFile).ShouldNot(BeAnExistingFile())
+
+				process.Signal(os.Interrupt)
+				Eventually(process.Wait()).Should(Receive(BeNil()))
+			})
+		})
+	})
+
 	Describe("Close", func() {
 		var (
 			cert, key string
@@ -632,6 +3840,220 @@ var _ = Describe("ProxyConfigHandler", func() {
 			Eventually(ch).Should(BeClosed())
 		})
 
+		Context("when the container overrides the reload duration", func() {
+			BeforeEach(func() {
+				container.ContainerProxyReloadDurationMs = 5000
+			})
+
+			It("returns after the reload duration of the container instead", func() {
+				ch := make(chan struct{})
+				go func() {
+					proxyConfigHandler.Close(containerstore.Credential{Cert: cert, Key: key}, container)
+					close(ch)
+				}()
+
+				reloadClock.WaitForWatcherAndIncrement(1000 * time.Millisecond)
+				Consistently(ch).ShouldNot(BeClosed())
+
+				reloadClock.Increment(4000 * time.Millisecond)
+				Eventually(ch).Should(BeClosed())
+			})
+		})
+
+		Context("when the container is updated while closing", func() {
+			It("serializes the writes and leaves a consistent config", func() {
+				credentials := []containerstore.Credential{{Cert: cert, Key: key}}
+				for i := 0; i < 4; i++ {
+					updateCert, updateKey, _ := generateCertAndKey()
+					credentials = append(credentials, containerstore.Credential{Cert: updateCert, Key: updateKey})
+				}
+
+				errCh := make(chan error, 2*len(credentials))
+				wg := sync.WaitGroup{}
+				for _, credential := range credentials[1:] {
+					wg.Add(2)
+					go func(credential containerstore.Credential) {
+						defer wg.Done()
+						errCh <- proxyConfigHandler.Update(credential, container)
+					}(credential)
+					go func() {
+						defer wg.Done()
+						errCh <- proxyConfigHandler.Close(credentials[0], container)
+					}()
+				}
+
+				done := make(chan struct{})
+				go func() {
+					wg.Wait()
+					close(done)
+				}()
+				Eventually(func() chan struct{} {
+					reloadClock.Increment(time.Second)
+					return done
+				}).Should(BeClosed())
+
+				close(errCh)
+				for err := range errCh {
+					Expect(err).NotTo(HaveOccurred())
+				}
+
+				listenerConfig := readListenerConfig(listenerConfigFile)
+				Expect(listenerConfig.Resources).To(HaveLen(1))
+				certs := listenerConfig.Resources[0].FilterChains[0].TLSContext.CommonTLSContext.TLSCertificates
+				Expect(certs).To(HaveLen(1))
+				Expect(credentials).To(ContainElement(containerstore.Credential{
+					Cert: certs[0].CertificateChain.InlineString,
+					Key:  certs[0].PrivateKey.InlineString,
+				}))
+				Expect(listenerConfigFile + ".tmp").NotTo(BeAnExistingFile())
+
+				proxyConfig := readProxyConfig(proxyConfigFile)
+				Expect(proxyConfig.StaticResources.Clusters).To(HaveLen(1))
+			})
+		})
+
+		Describe("CloseWithContext", func() {
+			It("returns after the configured reload duration", func() {
+				errCh := make(chan error, 1)
+				go func() {
+					errCh <- proxyConfigHandler.CloseWithContext(context.Background(), containerstore.Credential{Cert: cert, Key: key}, container)
+				}()
+
+				Consistently(errCh).ShouldNot(Receive())
+				reloadClock.WaitForWatcherAndIncrement(1000 * time.Millisecond)
+				Eventually(errCh).Should(Receive(BeNil()))
+			})
+
+			It("returns early when the context is cancelled while waiting for the reload", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				errCh := make(chan error, 1)
+				go func() {
+					errCh <- proxyConfigHandler.CloseWithContext(ctx, containerstore.Credential{Cert: cert, Key: key}, container)
+				}()
+
+				Eventually(reloadClock.WatcherCount).Should(Equal(1))
+				Consistently(errCh).ShouldNot(Receive())
+
+				cancel()
+				Eventually(errCh).Should(Receive(Equal(context.Canceled)))
+				Expect(listenerConfigFile).To(BeAnExistingFile())
+			})
+		})
+
+		It("keeps the listeners in place", func() {
+			go func() {
+				reloadClock.WaitForWatcherAndIncrement(1 * time.Second)
+			}()
+			err := proxyConfigHandler.Close(containerstore.Credential{Cert: cert, Key: key}, container)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(readListenerConfig(listenerConfigFile).Resources).To(HaveLen(1))
+		})
+
+		Context("with reload jitter", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithReloadJitter(0.2, mathrand.NewSource(42)))
+			})
+
+			It("returns after the reload duration adjusted by the jitter of the source", func() {
+				offset := mathrand.New(mathrand.NewSource(42)).Float64()*2 - 1
+				jittered := time.Second + time.Duration(offset*0.2*float64(time.Second))
+				Expect(jittered).To(BeNumerically(">=", 800*time.Millisecond))
+				Expect(jittered).To(BeNumerically("<=", 1200*time.Millisecond))
+
+				ch := make(chan struct{})
+				go func() {
+					proxyConfigHandler.Close(containerstore.Credential{Cert: cert, Key: key}, container)
+					close(ch)
+				}()
+
+				reloadClock.WaitForWatcherAndIncrement(jittered - time.Millisecond)
+				Consistently(ch).ShouldNot(BeClosed())
+
+				reloadClock.Increment(time.Millisecond)
+				Eventually(ch).Should(BeClosed())
+			})
+		})
+
+		Context("with drain on close enabled", func() {
+			BeforeEach(func() {
+				opts = append(opts, containerstore.WithDrainOnClose(true))
+			})
+
+			It("drains the listeners while the credentials are still valid and invalidates them afterwards", func() {
+				err := proxyConfigHandler.Update(containerstore.Credential{Cert: validCert, Key: validKey}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				ch := make(chan struct{})
+				go func() {
+					defer GinkgoRecover()
+					err := proxyConfigHandler.Close(containerstore.Credential{Cert: cert, Key: key}, container)
+					Expect(err).NotTo(HaveOccurred())
+					close(ch)
+				}()
+
+				Eventually(reloadClock.WatcherCount).Should(Equal(1))
+				Expect(readListenerConfig(listenerConfigFile).Resources).To(BeEmpty())
+
+				reloadClock.Increment(1000 * time.Millisecond)
+				Eventually(reloadClock.WatcherCount).Should(Equal(1))
+				listeners := readListenerConfig(listenerConfigFile).Resources
+				Expect(listeners).To(HaveLen(1))
+				certs := listeners[0].FilterChains[0].TLSContext.CommonTLSContext.TLSCertificates
+				Expect(certs[0].CertificateChain.InlineString).To(Equal(cert))
+				Consistently(ch).ShouldNot(BeClosed())
+
+				reloadClock.Increment(1000 * time.Millisecond)
+				Eventually(ch).Should(BeClosed())
+			})
+
+			Context("with a drain duration", func() {
+				BeforeEach(func() {
+					opts = append(opts, containerstore.WithDrainDuration(30*time.Second))
+				})
+
+				It("waits for the drain duration and then the reload duration", func() {
+					ch := make(chan struct{})
+					go func() {
+						defer GinkgoRecover()
+						err := proxyConfigHandler.Close(containerstore.Credential{Cert: cert, Key: key}, container)
+						Expect(err).NotTo(HaveOccurred())
+						close(ch)
+					}()
+
+					Eventually(reloadClock.WatcherCount).Should(Equal(1))
+					Expect(readListenerConfig(listenerConfigFile).Resources).To(BeEmpty())
+
+					reloadClock.Increment(29 * time.Second)
+					Eventually(reloadClock.WatcherCount).Should(Equal(1))
+					Consistently(func() []envoy.Resource {
+						return readListenerConfig(listenerConfigFile).Resources
+					}).Should(BeEmpty())
+
+					reloadClock.Increment(1 * time.Second)
+					Eventually(func() []envoy.Resource {
+						return readListenerConfig(listenerConfigFile).Resources
+					}).Should(HaveLen(1))
+					Eventually(reloadClock.WatcherCount).Should(Equal(1))
+					Consistently(ch).ShouldNot(BeClosed())
+
+					reloadClock.Increment(1 * time.Second)
+					Eventually(ch).Should(BeClosed())
+				})
+			})
+
+			It("still writes the proxy config", func() {
+				go func() {
+					reloadClock.WaitForWatcherAndIncrement(1 * time.Second)
+					reloadClock.WaitForWatcherAndIncrement(1 * time.Second)
+				}()
+				err := proxyConfigHandler.Close(containerstore.Credential{Cert: cert, Key: key}, container)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(proxyConfigFile).To(BeAnExistingFile())
+			})
+		})
+
 		Context("the EnableContainerProxy is disabled on the container", func() {
 			BeforeEach(func() {
 				container.EnableContainerProxy = false
@@ -658,6 +4080,26 @@ var _ = Describe("ProxyConfigHandler", func() {
 	})
 })
 
+func readProxyConfig(path string) envoy.ProxyConfig {
+	data, err := ioutil.ReadFile(path)
+	Expect(err).NotTo(HaveOccurred())
+
+	var proxyConfig envoy.ProxyConfig
+	err = yaml.Unmarshal(data, &proxyConfig)
+	Expect(err).NotTo(HaveOccurred())
+	return proxyConfig
+}
+
+func readListenerConfig(path string) envoy.ListenerConfig {
+	data, err := ioutil.ReadFile(path)
+	Expect(err).NotTo(HaveOccurred())
+
+	var listenerConfig envoy.ListenerConfig
+	err = yaml.Unmarshal(data, &listenerConfig)
+	Expect(err).NotTo(HaveOccurred())
+	return listenerConfig
+}
+
 func generateCertAndKey() (string, string, *big.Int) {
 	// generate a real cert
 	privateKey, err := rsa.GenerateKey(rand.Reader, 512)
@@ -306,6 +306,12 @@ func (n *storeNode) createGardenContainer(logger lager.Logger, info *executor.Co
 	netInPorts := info.Ports
 	if !n.enableUnproxiedPortMappings {
 		netInPorts = []executor.PortMapping{}
+		for _, port := range info.Ports {
+			// ports bypassing the proxy can only be reached directly
+			if port.DisableContainerProxy {
+				netInPorts = append(netInPorts, port)
+			}
+		}
 		for _, port := range extraPorts {
 			netInPorts = append(netInPorts, executor.PortMapping{
 				ContainerPort: port,
@@ -423,6 +429,7 @@ func (n *storeNode) portMappingFromContainerInfo(
 			ContainerPort:         appPort,
 			ContainerTLSProxyPort: proxyContainerPort,
 			HostTLSProxyPort:      proxyHostPort,
+			DisableContainerProxy: portMapping.DisableContainerProxy,
 		})
 	}
 
@@ -2,13 +2,24 @@ package steps
 
 import (
 	"os"
+	"time"
 
+	"code.cloudfoundry.org/clock"
 	"code.cloudfoundry.org/executor/depot/log_streamer"
 	"github.com/tedsuo/ifrit"
 
 	"code.cloudfoundry.org/lager"
 )
 
+// ProgressMetadata describes how the substep of an emit progress step went,
+// for UIs that show more than the progress messages.
+type ProgressMetadata struct {
+	Duration  time.Duration
+	Succeeded bool
+	// Error is the message of the error the substep failed with
+	Error string
+}
+
 type emitProgressStep struct {
 	substep        ifrit.Runner
 	logger         lager.Logger
@@ -16,6 +27,8 @@ type emitProgressStep struct {
 	successMessage string
 	failureMessage string
 	streamer       log_streamer.LogStreamer
+	clock          clock.Clock
+	onFinished     func(ProgressMetadata)
 }
 
 func NewEmitProgress(
@@ -24,6 +37,8 @@ func NewEmitProgress(
 	successMessage,
 	failureMessage string,
 	streamer log_streamer.LogStreamer,
+	clock clock.Clock,
+	onFinished func(ProgressMetadata),
 	logger lager.Logger,
 ) *emitProgressStep {
 	logger = logger.Session("emit-progress-step")
@@ -34,6 +49,8 @@ func NewEmitProgress(
 		successMessage: successMessage,
 		failureMessage: failureMessage,
 		streamer:       streamer,
+		clock:          clock,
+		onFinished:     onFinished,
 	}
 }
 
@@ -42,7 +59,9 @@ func (step *emitProgressStep) Run(signals <-chan os.Signal, ready chan<- struct{
 		step.streamer.Stdout().Write([]byte(step.startMessage + "\n"))
 	}
 
+	startTime := step.clock.Now()
 	err := step.substep.Run(signals, ready)
+	duration := step.clock.Since(startTime)
 
 	if err != nil {
 		if step.failureMessage != "" {
@@ -71,5 +90,13 @@ func (step *emitProgressStep) Run(signals <-chan os.Signal, ready chan<- struct{
 		}
 	}
 
+	if step.onFinished != nil {
+		metadata := ProgressMetadata{Duration: duration, Succeeded: err == nil}
+		if err != nil {
+			metadata.Error = err.Error()
+		}
+		step.onFinished(metadata)
+	}
+
 	return err
 }
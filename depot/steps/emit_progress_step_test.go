@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"errors"
 	"os"
+	"time"
 
+	"code.cloudfoundry.org/clock/fakeclock"
 	"code.cloudfoundry.org/lager/lagertest"
 
 	"code.cloudfoundry.org/executor/depot/log_streamer/fake_log_streamer"
@@ -26,6 +28,8 @@ var _ = Describe("EmitProgressStep", func() {
 	var logger *lagertest.TestLogger
 	var stderrBuffer *bytes.Buffer
 	var stdoutBuffer *bytes.Buffer
+	var fakeClock *fakeclock.FakeClock
+	var metadata []steps.ProgressMetadata
 
 	BeforeEach(func() {
 		stderrBuffer = new(bytes.Buffer)
@@ -38,17 +42,22 @@ var _ = Describe("EmitProgressStep", func() {
 		fakeStreamer.StdoutReturns(stdoutBuffer)
 
 		subStep = &fake_runner.FakeRunner{}
+		fakeClock = fakeclock.NewFakeClock(time.Now())
 
 		subStep.RunStub = func(signals <-chan os.Signal, ready chan<- struct{}) error {
 			fakeStreamer.Stdout().Write([]byte("RUNNING\n"))
+			fakeClock.Increment(3 * time.Second)
 			return errorToReturn
 		}
 
 		logger = lagertest.NewTestLogger("test")
+		metadata = nil
 	})
 
 	JustBeforeEach(func() {
-		step = steps.NewEmitProgress(subStep, startMessage, successMessage, failureMessage, fakeStreamer, logger)
+		step = steps.NewEmitProgress(subStep, startMessage, successMessage, failureMessage, fakeStreamer, fakeClock, func(m steps.ProgressMetadata) {
+			metadata = append(metadata, m)
+		}, logger)
 	})
 
 	Context("Ready", func() {
@@ -109,6 +118,12 @@ var _ = Describe("EmitProgressStep", func() {
 				Expect(err).NotTo(HaveOccurred())
 				Expect(stdoutBuffer.String()).To(Equal("RUNNING\nSUCCESS\n"))
 			})
+
+			It("reports the duration and the success", func() {
+				Expect(metadata).To(Equal([]steps.ProgressMetadata{
+					{Duration: 3 * time.Second, Succeeded: true},
+				}))
+			})
 		})
 
 		Context("when the substep fails", func() {
@@ -120,6 +135,12 @@ var _ = Describe("EmitProgressStep", func() {
 				Expect(err).To(MatchError(errorToReturn))
 			})
 
+			It("reports the duration and the failure", func() {
+				Expect(metadata).To(Equal([]steps.ProgressMetadata{
+					{Duration: 3 * time.Second, Succeeded: false, Error: "bam!"},
+				}))
+			})
+
 			Context("and there is a failure message", func() {
 				BeforeEach(func() {
 					failureMessage = "FAIL"
@@ -10,6 +10,7 @@ import (
 
 type parallelStep struct {
 	substeps []ifrit.Runner
+	failFast bool
 }
 
 func NewParallel(substeps []ifrit.Runner) *parallelStep {
@@ -18,6 +19,16 @@ func NewParallel(substeps []ifrit.Runner) *parallelStep {
 	}
 }
 
+// NewFailFastParallel runs its substeps in parallel like NewParallel, but
+// cancels the remaining substeps as soon as one of them fails and returns
+// the first error.
+func NewFailFastParallel(substeps []ifrit.Runner) *parallelStep {
+	return &parallelStep{
+		substeps: substeps,
+		failFast: true,
+	}
+}
+
 func (step *parallelStep) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
 	var subProcesses []ifrit.Process
 	for _, subStep := range step.substeps {
@@ -30,6 +41,10 @@ func (step *parallelStep) Run(signals <-chan os.Signal, ready chan<- struct{}) e
 	go waitForChildrenToBeReady(done, subProcesses, ready)
 	go waitForSignal(done, signals, subProcesses)
 
+	if step.failFast {
+		return waitForFirstFailure(subProcesses)
+	}
+
 	aggregate := &multierror.Error{}
 	aggregate.ErrorFormat = step.errorFormat
 
@@ -43,6 +58,26 @@ func (step *parallelStep) Run(signals <-chan os.Signal, ready chan<- struct{}) e
 	return aggregate.ErrorOrNil()
 }
 
+func waitForFirstFailure(subProcesses []ifrit.Process) error {
+	errs := make(chan error, len(subProcesses))
+	for _, subProcess := range subProcesses {
+		go func(p ifrit.Process) {
+			errs <- <-p.Wait()
+		}(subProcess)
+	}
+
+	var firstErr error
+	for range subProcesses {
+		err := <-errs
+		if err != nil && err != ErrCancelled && firstErr == nil {
+			firstErr = err
+			cancel(subProcesses, os.Interrupt)
+		}
+	}
+
+	return firstErr
+}
+
 func waitForSignal(done <-chan struct{}, signals <-chan os.Signal, ps []ifrit.Process) {
 	select {
 	case <-done:
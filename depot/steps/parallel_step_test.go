@@ -20,15 +20,22 @@ var _ = Describe("ParallelStep", func() {
 
 		subStep1 *fake_runner.TestRunner
 		subStep2 *fake_runner.TestRunner
+
+		failFast bool
 	)
 
 	BeforeEach(func() {
 		subStep1 = fake_runner.NewTestRunner()
 		subStep2 = fake_runner.NewTestRunner()
+		failFast = false
 	})
 
 	JustBeforeEach(func() {
-		step = steps.NewParallel([]ifrit.Runner{subStep1, subStep2})
+		if failFast {
+			step = steps.NewFailFastParallel([]ifrit.Runner{subStep1, subStep2})
+		} else {
+			step = steps.NewParallel([]ifrit.Runner{subStep1, subStep2})
+		}
 		process = ifrit.Background(step)
 	})
 
@@ -105,6 +112,47 @@ var _ = Describe("ParallelStep", func() {
 		})
 	})
 
+	Describe("fail fast", func() {
+		BeforeEach(func() {
+			failFast = true
+		})
+
+		It("performs its substeps in parallel", func() {
+			Eventually(subStep1.RunCallCount).Should(Equal(1))
+			Eventually(subStep2.RunCallCount).Should(Equal(1))
+			subStep1.TriggerExit(nil)
+			subStep2.TriggerExit(nil)
+
+			Eventually(process.Wait()).Should(Receive(BeNil()))
+		})
+
+		Context("when a substep fails", func() {
+			disaster := errors.New("oh no!")
+
+			It("cancels the remaining substeps", func() {
+				subStep1.TriggerExit(disaster)
+
+				Eventually(subStep2.WaitForCall()).Should(Receive(Equal(os.Interrupt)))
+			})
+
+			It("returns the first error", func() {
+				subStep1.TriggerExit(disaster)
+				Eventually(subStep2.WaitForCall()).Should(Receive(Equal(os.Interrupt)))
+				subStep2.TriggerExit(errors.New("oh my"))
+
+				Eventually(process.Wait()).Should(Receive(Equal(disaster)))
+			})
+
+			It("does not treat the cancelled substeps as failures", func() {
+				subStep1.TriggerExit(disaster)
+				Eventually(subStep2.WaitForCall()).Should(Receive(Equal(os.Interrupt)))
+				subStep2.TriggerExit(steps.ErrCancelled)
+
+				Eventually(process.Wait()).Should(Receive(Equal(disaster)))
+			})
+		})
+	})
+
 	Describe("readiness", func() {
 		It("does not become ready until its subprocesses are", func() {
 			Consistently(process.Ready()).ShouldNot(BeClosed())
@@ -0,0 +1,80 @@
+package steps
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+	"github.com/tedsuo/ifrit"
+)
+
+type retryStep struct {
+	substep  ifrit.Runner
+	attempts int
+	backoff  time.Duration
+	clock    clock.Clock
+	logger   lager.Logger
+}
+
+// NewRetry runs its substep until it succeeds, at most attempts times. The
+// wait between attempts starts at backoff and doubles after every failure.
+// The error of the last attempt is returned once all attempts have failed.
+func NewRetry(substep ifrit.Runner, attempts int, backoff time.Duration, clock clock.Clock, logger lager.Logger) ifrit.Runner {
+	return &retryStep{
+		substep:  substep,
+		attempts: attempts,
+		backoff:  backoff,
+		clock:    clock,
+		logger:   logger.Session("retry-step"),
+	}
+}
+
+func (step *retryStep) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	var readyOnce sync.Once
+	backoff := step.backoff
+
+	for attempt := 1; ; attempt++ {
+		process := ifrit.Background(step.substep)
+		go func() {
+			select {
+			case <-process.Ready():
+				readyOnce.Do(func() { close(ready) })
+			case <-process.Wait():
+			}
+		}()
+
+		var err error
+		select {
+		case s := <-signals:
+			process.Signal(s)
+			return <-process.Wait()
+		case err = <-process.Wait():
+		}
+
+		if err == nil || err == ErrCancelled {
+			return err
+		}
+
+		if attempt >= step.attempts {
+			step.logger.Error("giving-up", err, lager.Data{"attempts": attempt})
+			return err
+		}
+
+		step.logger.Info("retrying", lager.Data{
+			"attempt": attempt,
+			"backoff": backoff.String(),
+			"error":   err.Error(),
+		})
+
+		timer := step.clock.NewTimer(backoff)
+		select {
+		case <-signals:
+			timer.Stop()
+			return ErrCancelled
+		case <-timer.C():
+		}
+		backoff *= 2
+	}
+}
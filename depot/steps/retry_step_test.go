@@ -0,0 +1,122 @@
+package steps_test
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/executor/depot/steps"
+	"code.cloudfoundry.org/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tedsuo/ifrit"
+	"github.com/tedsuo/ifrit/fake_runner"
+)
+
+var _ = Describe("RetryStep", func() {
+	var (
+		substep *fake_runner.TestRunner
+		clock   *fakeclock.FakeClock
+		logger  *lagertest.TestLogger
+
+		backoff time.Duration
+		process ifrit.Process
+	)
+
+	BeforeEach(func() {
+		backoff = 100 * time.Millisecond
+		clock = fakeclock.NewFakeClock(time.Now())
+		substep = fake_runner.NewTestRunner()
+		logger = lagertest.NewTestLogger("test")
+	})
+
+	JustBeforeEach(func() {
+		process = ifrit.Background(steps.NewRetry(substep, 3, backoff, clock, logger))
+	})
+
+	AfterEach(func() {
+		substep.EnsureExit()
+	})
+
+	It("becomes ready when the substep is ready", func() {
+		Consistently(process.Ready()).ShouldNot(BeClosed())
+		substep.TriggerReady()
+		Eventually(process.Ready()).Should(BeClosed())
+	})
+
+	Context("when the substep succeeds", func() {
+		It("does not retry it", func() {
+			substep.TriggerExit(nil)
+
+			Eventually(process.Wait()).Should(Receive(BeNil()))
+			Expect(substep.RunCallCount()).To(Equal(1))
+		})
+	})
+
+	Context("when the substep fails", func() {
+		disaster := errors.New("oh no")
+
+		It("retries it after the backoff", func() {
+			substep.TriggerExit(disaster)
+
+			Consistently(substep.RunCallCount).Should(Equal(1))
+			clock.WaitForWatcherAndIncrement(backoff)
+			Eventually(substep.RunCallCount).Should(Equal(2))
+
+			substep.TriggerExit(nil)
+			Eventually(process.Wait()).Should(Receive(BeNil()))
+		})
+
+		It("doubles the backoff between attempts", func() {
+			substep.TriggerExit(disaster)
+			clock.WaitForWatcherAndIncrement(backoff)
+			Eventually(substep.RunCallCount).Should(Equal(2))
+
+			substep.TriggerExit(disaster)
+			clock.WaitForWatcherAndIncrement(backoff)
+			Consistently(substep.RunCallCount).Should(Equal(2))
+
+			clock.Increment(backoff)
+			Eventually(substep.RunCallCount).Should(Equal(3))
+		})
+
+		It("returns the last error once all attempts have failed", func() {
+			lastDisaster := errors.New("oh my")
+
+			substep.TriggerExit(disaster)
+			clock.WaitForWatcherAndIncrement(backoff)
+			substep.TriggerExit(disaster)
+			clock.WaitForWatcherAndIncrement(2 * backoff)
+			substep.TriggerExit(lastDisaster)
+
+			Eventually(process.Wait()).Should(Receive(Equal(lastDisaster)))
+			Expect(substep.RunCallCount()).To(Equal(3))
+		})
+
+		Context("when signalled during the backoff", func() {
+			It("does not retry the substep", func() {
+				substep.TriggerExit(disaster)
+				Eventually(clock.WatcherCount).Should(Equal(1))
+
+				process.Signal(os.Interrupt)
+
+				Eventually(process.Wait()).Should(Receive(Equal(steps.ErrCancelled)))
+				Expect(substep.RunCallCount()).To(Equal(1))
+			})
+		})
+	})
+
+	Context("when signalled while the substep is running", func() {
+		It("signals the substep and returns its error", func() {
+			process.Signal(os.Interrupt)
+
+			Eventually(substep.WaitForCall()).Should(Receive(Equal(os.Interrupt)))
+			substep.TriggerExit(steps.ErrCancelled)
+
+			Eventually(process.Wait()).Should(Receive(Equal(steps.ErrCancelled)))
+			Expect(substep.RunCallCount()).To(Equal(1))
+		})
+	})
+})
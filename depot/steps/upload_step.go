@@ -27,6 +27,7 @@ type uploadStep struct {
 	streamer    log_streamer.LogStreamer
 	rateLimiter chan struct{}
 	logger      lager.Logger
+	streaming   bool
 
 	cancelUpload chan struct{}
 }
@@ -41,6 +42,36 @@ func NewUpload(
 	rateLimiter chan struct{},
 	logger lager.Logger,
 ) ifrit.Runner {
+	return newUploadStep(container, model, uploader, compressor, tempDir, streamer, rateLimiter, logger)
+}
+
+// NewStreamingUpload is like NewUpload, but streams the artifact straight
+// into the uploader instead of copying it into a temp file first.
+func NewStreamingUpload(
+	container garden.Container,
+	model models.UploadAction,
+	uploader uploader.Uploader,
+	compressor compressor.Compressor,
+	tempDir string,
+	streamer log_streamer.LogStreamer,
+	rateLimiter chan struct{},
+	logger lager.Logger,
+) ifrit.Runner {
+	step := newUploadStep(container, model, uploader, compressor, tempDir, streamer, rateLimiter, logger)
+	step.streaming = true
+	return step
+}
+
+func newUploadStep(
+	container garden.Container,
+	model models.UploadAction,
+	uploader uploader.Uploader,
+	compressor compressor.Compressor,
+	tempDir string,
+	streamer log_streamer.LogStreamer,
+	rateLimiter chan struct{},
+	logger lager.Logger,
+) *uploadStep {
 	logger = logger.Session("upload-step", lager.Data{
 		"from": model.From,
 	})
@@ -87,6 +118,18 @@ func (step *uploadStep) Run(signals <-chan os.Signal, ready chan<- struct{}) (er
 		return err
 	}
 
+	if step.streaming {
+		return step.streamUpload(signals, url)
+	}
+
+	err = os.MkdirAll(step.tempDir, 0755)
+	if err != nil {
+		step.logger.Error("failed-to-create-tmp-dir", err)
+		errString := step.artifactErrString(ErrCreateTmpDir)
+		step.emitError(errString)
+		return NewEmittableError(err, errString)
+	}
+
 	tempDir, err := ioutil.TempDir(step.tempDir, "upload")
 	if err != nil {
 		step.logger.Error("failed-to-create-tmp-dir", err)
@@ -140,7 +183,36 @@ func (step *uploadStep) Run(signals <-chan os.Signal, ready chan<- struct{}) (er
 	defer close(finished)
 	go step.cancelUploadOnSignal(finished, signals)
 
-	uploadedBytes, err := step.uploader.Upload(finalFileLocation, url, step.cancelUpload)
+	return step.uploaded(step.uploader.Upload(finalFileLocation, url, step.cancelUpload))
+}
+
+func (step *uploadStep) streamUpload(signals <-chan os.Signal, url *url.URL) error {
+	outStream, err := step.container.StreamOut(garden.StreamOutSpec{Path: step.model.From, User: step.model.User})
+	if err != nil {
+		step.logger.Error("failed-to-stream-out", err)
+		errString := step.artifactErrString(ErrEstablishStream)
+		step.emitError(errString)
+		return NewEmittableError(err, errString)
+	}
+	defer outStream.Close()
+
+	tarStream := tar.NewReader(outStream)
+	_, err = tarStream.Next()
+	if err != nil {
+		step.logger.Error("failed-to-read-stream", err)
+		errString := step.artifactErrString(ErrReadTar)
+		step.emitError(errString)
+		return NewEmittableError(err, errString)
+	}
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go step.cancelUploadOnSignal(finished, signals)
+
+	return step.uploaded(step.uploader.UploadStream(tarStream, url, step.cancelUpload))
+}
+
+func (step *uploadStep) uploaded(uploadedBytes int64, err error) error {
 	if err != nil {
 		select {
 		case <-step.cancelUpload:
@@ -11,6 +11,7 @@ import (
 	"net/url"
 	"os"
 	"os/user"
+	"path/filepath"
 	"time"
 
 	"code.cloudfoundry.org/bbs/models"
@@ -40,6 +41,12 @@ func (u *fakeUploader) Upload(fileLocation string, destinationUrl *url.URL, canc
 	return 0, nil
 }
 
+func (u *fakeUploader) UploadStream(source io.Reader, destinationUrl *url.URL, cancel <-chan struct{}) (int64, error) {
+	u.ready <- struct{}{}
+	<-u.barrier
+	return 0, nil
+}
+
 func newFakeStreamer() *fake_log_streamer.FakeLogStreamer {
 	fakeStreamer := new(fake_log_streamer.FakeLogStreamer)
 
@@ -64,6 +71,7 @@ var _ = Describe("UploadStep", func() {
 		fakeStreamer    *fake_log_streamer.FakeLogStreamer
 		uploadTarget    *httptest.Server
 		uploadedPayload []byte
+		streaming       bool
 	)
 
 	BeforeEach(func() {
@@ -95,6 +103,7 @@ var _ = Describe("UploadStep", func() {
 		uploader = Uploader.New(logger, 5*time.Second, nil)
 
 		fakeStreamer = newFakeStreamer()
+		streaming = false
 
 		_, err = user.Current()
 		Expect(err).NotTo(HaveOccurred())
@@ -113,7 +122,12 @@ var _ = Describe("UploadStep", func() {
 		container, err := gardenClient.Create(garden.ContainerSpec{})
 		Expect(err).NotTo(HaveOccurred())
 
-		step = steps.NewUpload(
+		newUpload := steps.NewUpload
+		if streaming {
+			newUpload = steps.NewStreamingUpload
+		}
+
+		step = newUpload(
 			container,
 			*uploadAction,
 			uploader,
@@ -193,6 +207,28 @@ var _ = Describe("UploadStep", func() {
 				}))
 			})
 
+			Context("when the upload is streamed", func() {
+				BeforeEach(func() {
+					streaming = true
+				})
+
+				It("uploads the specified file to the destination", func() {
+					err := <-ifrit.Invoke(step).Wait()
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(buffer.Closed()).To(BeTrue())
+					Expect(string(uploadedPayload)).To(Equal("expected-contents"))
+				})
+
+				It("does not copy the file into the temp dir", func() {
+					err := <-ifrit.Invoke(step).Wait()
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(logger.TestSink.LogMessages()).To(ContainElement("test.URLUploader.upload-stream.succeeded-uploading"))
+					Expect(ioutil.ReadDir(tempDir)).To(BeEmpty())
+				})
+			})
+
 			Describe("Signal", func() {
 				cancelledErr := errors.New("upload cancelled")
 
@@ -230,10 +266,27 @@ var _ = Describe("UploadStep", func() {
 				})
 			})
 
+			Context("when the temp dir does not exist yet", func() {
+				BeforeEach(func() {
+					tempDir = filepath.Join(tempDir, "some-container-guid")
+				})
+
+				It("creates it and uploads the file", func() {
+					err := <-ifrit.Invoke(step).Wait()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(tempDir).To(BeADirectory())
+					Expect(string(uploadedPayload)).To(Equal("expected-contents"))
+				})
+			})
+
 			Context("when creating a TmpDir fails", func() {
 				var stderr *gbytes.Buffer
 				BeforeEach(func() {
-					tempDir = "doesnotexist"
+					notADirectory := filepath.Join(tempDir, "not-a-directory")
+					err := ioutil.WriteFile(notADirectory, []byte("some-contents"), 0644)
+					Expect(err).NotTo(HaveOccurred())
+
+					tempDir = filepath.Join(notADirectory, "doesnotexist")
 					stderr = fakeStreamer.Stderr().(*gbytes.Buffer)
 				})
 
@@ -38,6 +38,29 @@ type Transformer interface {
 	StepsRunner(lager.Logger, executor.Container, garden.Container, log_streamer.LogStreamer, Config) (ifrit.Runner, error)
 }
 
+//go:generate counterfeiter -o faketransformer/fake_progress_sink.go . ProgressSink
+
+// ProgressSink receives a ProgressEvent whenever the setup or action step of
+// a container starts, succeeds or fails.
+type ProgressSink interface {
+	Emit(ProgressEvent)
+}
+
+type ProgressState string
+
+const (
+	ProgressStateStarted   ProgressState = "started"
+	ProgressStateSucceeded ProgressState = "succeeded"
+	ProgressStateFailed    ProgressState = "failed"
+)
+
+type ProgressEvent struct {
+	ContainerGuid string
+	StepIndex     int
+	ActionType    string
+	State         ProgressState
+}
+
 type Config struct {
 	ProxyTLSPorts []uint16
 	BindMounts    []garden.BindMount
@@ -64,6 +87,23 @@ type transformer struct {
 
 	postSetupHook []string
 	postSetupUser string
+
+	failFastParallelActions bool
+
+	transferRetryAttempts int
+	transferRetryBackoff  time.Duration
+
+	baseEnv []*models.EnvironmentVariable
+
+	progressSink ProgressSink
+
+	maxFileDescriptors uint64
+
+	streamingUploads bool
+
+	stepLogSourceTags bool
+
+	emitProgressMetadata func(steps.ProgressMetadata)
 }
 
 type Option func(*transformer)
@@ -96,6 +136,73 @@ func WithPostSetupHook(user string, hook []string) Option {
 	}
 }
 
+// WithFailFastParallelActions cancels the remaining steps of a parallel
+// action as soon as one of them fails, instead of waiting for all of them.
+func WithFailFastParallelActions() Option {
+	return func(t *transformer) {
+		t.failFastParallelActions = true
+	}
+}
+
+// WithTransferRetries retries failed download and upload actions until they
+// have been attempted the given number of times, doubling the backoff after
+// every failed attempt.
+func WithTransferRetries(attempts int, backoff time.Duration) Option {
+	return func(t *transformer) {
+		t.transferRetryAttempts = attempts
+		t.transferRetryBackoff = backoff
+	}
+}
+
+// WithBaseEnvironment sets environment variables for every run action. The
+// variables of the action itself take precedence over them.
+func WithBaseEnvironment(env []*models.EnvironmentVariable) Option {
+	return func(t *transformer) {
+		t.baseEnv = env
+	}
+}
+
+// WithProgressSink reports the lifecycle of the setup and action steps of
+// every container to sink.
+func WithProgressSink(sink ProgressSink) Option {
+	return func(t *transformer) {
+		t.progressSink = sink
+	}
+}
+
+// WithMaxFileDescriptors clamps the file descriptor limit of run actions to
+// max. A max of 0 leaves the limits untouched.
+func WithMaxFileDescriptors(max uint64) Option {
+	return func(t *transformer) {
+		t.maxFileDescriptors = max
+	}
+}
+
+// WithStreamingUploads streams upload action artifacts straight into the
+// uploader instead of copying them into the temp dir first.
+func WithStreamingUploads() Option {
+	return func(t *transformer) {
+		t.streamingUploads = true
+	}
+}
+
+// WithStepLogSourceTags tags the output of run, download and upload actions
+// without a log source of their own with their action type, e.g. LOG:run, so
+// the output of different steps can be told apart.
+func WithStepLogSourceTags() Option {
+	return func(t *transformer) {
+		t.stepLogSourceTags = true
+	}
+}
+
+// WithEmitProgressMetadata passes the duration and outcome of the action
+// wrapped by every emit progress action to callback once the action finished.
+func WithEmitProgressMetadata(callback func(steps.ProgressMetadata)) Option {
+	return func(t *transformer) {
+		t.emitProgressMetadata = callback
+	}
+}
+
 func NewTransformer(
 	clock clock.Clock,
 	cachedDownloader cacheddownloader.CachedDownloader,
@@ -138,17 +245,21 @@ func (t *transformer) stepFor(
 	externalIP string,
 	internalIP string,
 	ports []executor.PortMapping,
+	tempDir string,
 	suppressExitStatusCode bool,
 	monitorOutputWrapper bool,
 	logger lager.Logger,
-) ifrit.Runner {
+) (ifrit.Runner, error) {
 	a := action.GetValue()
 	switch actionModel := a.(type) {
 	case *models.RunAction:
+		runAction := *actionModel
+		runAction.Env = mergeEnvironmentVariables(t.baseEnv, actionModel.Env)
+		runAction.ResourceLimits = t.clampFileDescriptors(actionModel.ResourceLimits, logger)
 		return steps.NewRun(
 			container,
-			*actionModel,
-			logStreamer.WithSource(actionModel.LogSource),
+			runAction,
+			t.stepLogStreamer(logStreamer, actionModel, actionModel.LogSource),
 			logger,
 			externalIP,
 			internalIP,
@@ -156,178 +267,272 @@ func (t *transformer) stepFor(
 			t.clock,
 			t.gracefulShutdownInterval,
 			suppressExitStatusCode,
-		)
+		), nil
 
 	case *models.DownloadAction:
-		return steps.NewDownload(
+		return t.withTransferRetries(steps.NewDownload(
 			container,
 			*actionModel,
 			t.cachedDownloader,
 			t.downloadLimiter,
-			logStreamer.WithSource(actionModel.LogSource),
+			t.stepLogStreamer(logStreamer, actionModel, actionModel.LogSource),
 			logger,
-		)
+		), logger), nil
 
 	case *models.UploadAction:
-		return steps.NewUpload(
+		newUpload := steps.NewUpload
+		if t.streamingUploads {
+			newUpload = steps.NewStreamingUpload
+		}
+		return t.withTransferRetries(newUpload(
 			container,
 			*actionModel,
 			t.uploader,
 			t.compressor,
-			t.tempDir,
-			logStreamer.WithSource(actionModel.LogSource),
+			tempDir,
+			t.stepLogStreamer(logStreamer, actionModel, actionModel.LogSource),
 			t.uploadLimiter,
 			logger,
-		)
+		), logger), nil
 
 	case *models.EmitProgressAction:
+		subStep, err := t.stepFor(
+			logStreamer,
+			actionModel.Action,
+			container,
+			externalIP,
+			internalIP,
+			ports,
+			tempDir,
+			suppressExitStatusCode,
+			monitorOutputWrapper,
+			logger,
+		)
+		if err != nil {
+			return nil, err
+		}
 		return steps.NewEmitProgress(
-			t.stepFor(
-				logStreamer,
-				actionModel.Action,
-				container,
-				externalIP,
-				internalIP,
-				ports,
-				suppressExitStatusCode,
-				monitorOutputWrapper,
-				logger,
-			),
+			subStep,
 			actionModel.StartMessage,
 			actionModel.SuccessMessage,
 			actionModel.FailureMessagePrefix,
 			logStreamer.WithSource(actionModel.LogSource),
+			t.clock,
+			t.emitProgressMetadata,
 			logger,
-		)
+		), nil
 
 	case *models.TimeoutAction:
+		subStep, err := t.stepFor(
+			logStreamer.WithSource(actionModel.LogSource),
+			actionModel.Action,
+			container,
+			externalIP,
+			internalIP,
+			ports,
+			tempDir,
+			suppressExitStatusCode,
+			monitorOutputWrapper,
+			logger,
+		)
+		if err != nil {
+			return nil, err
+		}
 		return steps.NewTimeout(
-			t.stepFor(
-				logStreamer.WithSource(actionModel.LogSource),
-				actionModel.Action,
-				container,
-				externalIP,
-				internalIP,
-				ports,
-				suppressExitStatusCode,
-				monitorOutputWrapper,
-				logger,
-			),
+			subStep,
 			time.Duration(actionModel.TimeoutMs)*time.Millisecond,
 			t.clock,
 			logger,
-		)
+		), nil
 
 	case *models.TryAction:
-		return steps.NewTry(
-			t.stepFor(
-				logStreamer.WithSource(actionModel.LogSource),
-				actionModel.Action,
-				container,
-				externalIP,
-				internalIP,
-				ports,
-				suppressExitStatusCode,
-				monitorOutputWrapper,
-				logger,
-			),
+		subStep, err := t.stepFor(
+			logStreamer.WithSource(actionModel.LogSource),
+			actionModel.Action,
+			container,
+			externalIP,
+			internalIP,
+			ports,
+			tempDir,
+			suppressExitStatusCode,
+			monitorOutputWrapper,
 			logger,
 		)
+		if err != nil {
+			return nil, err
+		}
+		return steps.NewTry(subStep, logger), nil
 
 	case *models.ParallelAction:
-		subSteps := make([]ifrit.Runner, len(actionModel.Actions))
-		for i, action := range actionModel.Actions {
-			var subStep ifrit.Runner
-			if monitorOutputWrapper {
-				buffer := log_streamer.NewConcurrentBuffer(bytes.NewBuffer(nil))
-				bufferedLogStreamer := log_streamer.NewBufferStreamer(buffer, ioutil.Discard)
-				subStep = steps.NewOutputWrapper(t.stepFor(
-					bufferedLogStreamer,
-					action,
-					container,
-					externalIP,
-					internalIP,
-					ports,
-					suppressExitStatusCode,
-					monitorOutputWrapper,
-					logger,
-				),
-					buffer,
-				)
-			} else {
-				subStep = t.stepFor(
-					logStreamer.WithSource(actionModel.LogSource),
-					action,
-					container,
-					externalIP,
-					internalIP,
-					ports,
-					suppressExitStatusCode,
-					monitorOutputWrapper,
-					logger,
-				)
-			}
-			subSteps[i] = subStep
+		subSteps, err := t.concurrentSubStepsFor(
+			logStreamer.WithSource(actionModel.LogSource),
+			actionModel.Actions,
+			container,
+			externalIP,
+			internalIP,
+			ports,
+			tempDir,
+			suppressExitStatusCode,
+			monitorOutputWrapper,
+			logger,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if t.failFastParallelActions {
+			return steps.NewFailFastParallel(subSteps), nil
 		}
-		return steps.NewParallel(subSteps)
+		return steps.NewParallel(subSteps), nil
 
 	case *models.CodependentAction:
-		subSteps := make([]ifrit.Runner, len(actionModel.Actions))
-		for i, action := range actionModel.Actions {
-			var subStep ifrit.Runner
-			if monitorOutputWrapper {
-				buffer := log_streamer.NewConcurrentBuffer(bytes.NewBuffer(nil))
-				bufferedLogStreamer := log_streamer.NewBufferStreamer(buffer, ioutil.Discard)
-				subStep = steps.NewOutputWrapper(t.stepFor(
-					bufferedLogStreamer,
-					action,
-					container,
-					externalIP,
-					internalIP,
-					ports,
-					suppressExitStatusCode,
-					monitorOutputWrapper,
-					logger,
-				),
-					buffer,
-				)
-			} else {
-				subStep = t.stepFor(
-					logStreamer.WithSource(actionModel.LogSource),
-					action,
-					container,
-					externalIP,
-					internalIP,
-					ports,
-					suppressExitStatusCode,
-					monitorOutputWrapper,
-					logger,
-				)
-			}
-			subSteps[i] = subStep
+		subSteps, err := t.concurrentSubStepsFor(
+			logStreamer.WithSource(actionModel.LogSource),
+			actionModel.Actions,
+			container,
+			externalIP,
+			internalIP,
+			ports,
+			tempDir,
+			suppressExitStatusCode,
+			monitorOutputWrapper,
+			logger,
+		)
+		if err != nil {
+			return nil, err
 		}
 		errorOnExit := true
-		return steps.NewCodependent(subSteps, errorOnExit, false)
+		return steps.NewCodependent(subSteps, errorOnExit, false), nil
 
 	case *models.SerialAction:
 		subSteps := make([]ifrit.Runner, len(actionModel.Actions))
 		for i, action := range actionModel.Actions {
-			subSteps[i] = t.stepFor(
+			subStep, err := t.stepFor(
 				logStreamer,
 				action,
 				container,
 				externalIP,
 				internalIP,
 				ports,
+				tempDir,
 				suppressExitStatusCode,
 				monitorOutputWrapper,
 				logger,
 			)
+			if err != nil {
+				return nil, err
+			}
+			subSteps[i] = subStep
 		}
-		return steps.NewSerial(subSteps)
+		return steps.NewSerial(subSteps), nil
 	}
 
-	panic(fmt.Sprintf("unknown action: %T", action))
+	return nil, fmt.Errorf("unknown action: %T", a)
+}
+
+func (t *transformer) stepLogStreamer(logStreamer log_streamer.LogStreamer, action models.ActionInterface, logSource string) log_streamer.LogStreamer {
+	if logSource != "" || !t.stepLogSourceTags {
+		return logStreamer.WithSource(logSource)
+	}
+	return logStreamer.WithSource(fmt.Sprintf("%s:%s", logStreamer.SourceName(), action.ActionType()))
+}
+
+func (t *transformer) withTransferRetries(step ifrit.Runner, logger lager.Logger) ifrit.Runner {
+	if t.transferRetryAttempts <= 1 {
+		return step
+	}
+	return steps.NewRetry(step, t.transferRetryAttempts, t.transferRetryBackoff, t.clock, logger)
+}
+
+func (t *transformer) clampFileDescriptors(limits *models.ResourceLimits, logger lager.Logger) *models.ResourceLimits {
+	if t.maxFileDescriptors == 0 || limits == nil || limits.Nofile == nil || *limits.Nofile <= t.maxFileDescriptors {
+		return limits
+	}
+
+	logger.Info("clamping-file-descriptors", lager.Data{
+		"requested": *limits.Nofile,
+		"max":       t.maxFileDescriptors,
+	})
+
+	clamped := *limits
+	nofile := t.maxFileDescriptors
+	clamped.Nofile = &nofile
+	return &clamped
+}
+
+func mergeEnvironmentVariables(base, overrides []*models.EnvironmentVariable) []*models.EnvironmentVariable {
+	if len(base) == 0 {
+		return overrides
+	}
+
+	overridden := make(map[string]bool, len(overrides))
+	for _, envVar := range overrides {
+		overridden[envVar.Name] = true
+	}
+
+	merged := make([]*models.EnvironmentVariable, 0, len(base)+len(overrides))
+	for _, envVar := range base {
+		if !overridden[envVar.Name] {
+			merged = append(merged, envVar)
+		}
+	}
+	return append(merged, overrides...)
+}
+
+// concurrentSubStepsFor builds the sub steps of a parallel or codependent
+// action, buffering the output of each one when monitorOutputWrapper is set.
+func (t *transformer) concurrentSubStepsFor(
+	logStreamer log_streamer.LogStreamer,
+	actions []*models.Action,
+	container garden.Container,
+	externalIP string,
+	internalIP string,
+	ports []executor.PortMapping,
+	tempDir string,
+	suppressExitStatusCode bool,
+	monitorOutputWrapper bool,
+	logger lager.Logger,
+) ([]ifrit.Runner, error) {
+	subSteps := make([]ifrit.Runner, len(actions))
+	for i, action := range actions {
+		if monitorOutputWrapper {
+			buffer := log_streamer.NewConcurrentBuffer(bytes.NewBuffer(nil))
+			bufferedLogStreamer := log_streamer.NewBufferStreamer(buffer, ioutil.Discard)
+			subStep, err := t.stepFor(
+				bufferedLogStreamer,
+				action,
+				container,
+				externalIP,
+				internalIP,
+				ports,
+				tempDir,
+				suppressExitStatusCode,
+				monitorOutputWrapper,
+				logger,
+			)
+			if err != nil {
+				return nil, err
+			}
+			subSteps[i] = steps.NewOutputWrapper(subStep, buffer)
+		} else {
+			subStep, err := t.stepFor(
+				logStreamer,
+				action,
+				container,
+				externalIP,
+				internalIP,
+				ports,
+				tempDir,
+				suppressExitStatusCode,
+				monitorOutputWrapper,
+				logger,
+			)
+			if err != nil {
+				return nil, err
+			}
+			subSteps[i] = subStep
+		}
+	}
+	return subSteps, nil
 }
 
 func overrideSuppressLogOutput(monitorAction *models.Action) {
@@ -359,22 +564,65 @@ func (t *transformer) StepsRunner(
 	gardenContainer garden.Container,
 	logStreamer log_streamer.LogStreamer,
 	config Config,
+) (ifrit.Runner, error) {
+	tempDir, err := t.containerTempDir(container)
+	if err != nil {
+		logger.Error("steps-runner-failed-to-create-temp-dir", err)
+		return nil, err
+	}
+
+	runner, err := t.stepsRunner(logger, container, gardenContainer, logStreamer, config, tempDir)
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return nil, err
+	}
+
+	return removeTempDirOnExit(runner, tempDir, logger), nil
+}
+
+// containerTempDir creates scratch space of its own for the steps of the
+// container, so concurrent containers never share temporary file names. It
+// is a new directory under the temp dir even for a container without a guid.
+func (t *transformer) containerTempDir(container executor.Container) (string, error) {
+	err := os.MkdirAll(t.tempDir, 0755)
+	if err != nil {
+		return "", err
+	}
+	return ioutil.TempDir(t.tempDir, container.Guid+"-")
+}
+
+func (t *transformer) stepsRunner(
+	logger lager.Logger,
+	container executor.Container,
+	gardenContainer garden.Container,
+	logStreamer log_streamer.LogStreamer,
+	config Config,
+	tempDir string,
 ) (ifrit.Runner, error) {
 	var setup, action, postSetup, monitor, longLivedAction ifrit.Runner
 	var substeps []ifrit.Runner
+	var err error
+	var stepIndex int
 
 	if container.Setup != nil {
-		setup = t.stepFor(
+		setup, err = t.stepFor(
 			logStreamer,
 			container.Setup,
 			gardenContainer,
 			container.ExternalIP,
 			container.InternalIP,
 			container.Ports,
+			tempDir,
 			false,
 			false,
 			logger.Session("setup"),
 		)
+		if err != nil {
+			logger.Error("steps-runner-invalid-setup", err)
+			return nil, err
+		}
+		setup = t.withProgress(setup, container.Guid, stepIndex, container.Setup)
+		stepIndex++
 	}
 
 	if len(t.postSetupHook) > 0 {
@@ -404,17 +652,23 @@ func (t *transformer) StepsRunner(
 		return nil, err
 	}
 
-	action = t.stepFor(
+	action, err = t.stepFor(
 		logStreamer,
 		container.Action,
 		gardenContainer,
 		container.ExternalIP,
 		container.InternalIP,
 		container.Ports,
+		tempDir,
 		false,
 		false,
 		logger.Session("action"),
 	)
+	if err != nil {
+		logger.Error("steps-runner-invalid-action", err)
+		return nil, err
+	}
+	action = t.withProgress(action, container.Guid, stepIndex, container.Action)
 
 	substeps = append(substeps, action)
 
@@ -456,19 +710,26 @@ func (t *transformer) StepsRunner(
 		substeps = append(substeps, monitor)
 	} else if container.Monitor != nil {
 		overrideSuppressLogOutput(container.Monitor)
+		monitorStep, err := t.stepFor(
+			logStreamer,
+			container.Monitor,
+			gardenContainer,
+			container.ExternalIP,
+			container.InternalIP,
+			container.Ports,
+			tempDir,
+			true,
+			true,
+			logger.Session("monitor-run"),
+		)
+		if err != nil {
+			logger.Error("steps-runner-invalid-monitor", err)
+			return nil, err
+		}
+
 		monitor = steps.NewMonitor(
 			func() ifrit.Runner {
-				return t.stepFor(
-					logStreamer,
-					container.Monitor,
-					gardenContainer,
-					container.ExternalIP,
-					container.InternalIP,
-					container.Ports,
-					true,
-					true,
-					logger.Session("monitor-run"),
-				)
+				return monitorStep
 			},
 			logger.Session("monitor"),
 			t.clock,
@@ -513,6 +774,51 @@ func (t *transformer) StepsRunner(
 	return cumulativeStep, nil
 }
 
+func (t *transformer) withProgress(runner ifrit.Runner, containerGuid string, stepIndex int, action *models.Action) ifrit.Runner {
+	if t.progressSink == nil {
+		return runner
+	}
+
+	var actionType string
+	if actionModel, ok := action.GetValue().(models.ActionInterface); ok {
+		actionType = actionModel.ActionType()
+	}
+
+	emit := func(state ProgressState) {
+		t.progressSink.Emit(ProgressEvent{
+			ContainerGuid: containerGuid,
+			StepIndex:     stepIndex,
+			ActionType:    actionType,
+			State:         state,
+		})
+	}
+
+	return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+		emit(ProgressStateStarted)
+		err := runner.Run(signals, ready)
+		if err != nil {
+			emit(ProgressStateFailed)
+		} else {
+			emit(ProgressStateSucceeded)
+		}
+		return err
+	})
+}
+
+// removeTempDirOnExit removes the temp dir created for the steps of a single
+// container once they exit, never the shared temp dir it was created in.
+func removeTempDirOnExit(runner ifrit.Runner, tempDir string, logger lager.Logger) ifrit.Runner {
+	return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+		defer func() {
+			err := os.RemoveAll(tempDir)
+			if err != nil {
+				logger.Error("failed-to-remove-temp-dir", err, lager.Data{"path": tempDir})
+			}
+		}()
+		return runner.Run(signals, ready)
+	})
+}
+
 func (t *transformer) createCheck(
 	container *executor.Container,
 	gardenContainer garden.Container,
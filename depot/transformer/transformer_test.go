@@ -1,9 +1,13 @@
 package transformer_test
 
 import (
+	"archive/tar"
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sync"
@@ -11,11 +15,16 @@ import (
 	"time"
 
 	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/cacheddownloader"
+	cdfakes "code.cloudfoundry.org/cacheddownloader/cacheddownloaderfakes"
 	"code.cloudfoundry.org/clock/fakeclock"
 	mfakes "code.cloudfoundry.org/diego-logging-client/testhelpers"
 	"code.cloudfoundry.org/executor"
 	"code.cloudfoundry.org/executor/depot/log_streamer"
+	"code.cloudfoundry.org/executor/depot/steps"
 	"code.cloudfoundry.org/executor/depot/transformer"
+	"code.cloudfoundry.org/executor/depot/transformer/faketransformer"
+	"code.cloudfoundry.org/executor/depot/uploader/fake_uploader"
 	"code.cloudfoundry.org/garden"
 	"code.cloudfoundry.org/garden/gardenfakes"
 	"code.cloudfoundry.org/lager"
@@ -24,6 +33,7 @@ import (
 	"github.com/gogo/protobuf/proto"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 	"github.com/tedsuo/ifrit"
 	"github.com/tedsuo/ifrit/ginkgomon"
 )
@@ -44,6 +54,11 @@ var _ = Describe("Transformer", func() {
 			healthCheckWorkPool         *workpool.WorkPool
 			cfg                         transformer.Config
 			options                     []transformer.Option
+			cachedDownloader            *cdfakes.FakeCachedDownloader
+			fakeUploader                *fake_uploader.FakeUploader
+			downloadLimiter             chan struct{}
+			uploadLimiter               chan struct{}
+			tempDir                     string
 		)
 
 		BeforeEach(func() {
@@ -61,8 +76,17 @@ var _ = Describe("Transformer", func() {
 			healthCheckWorkPool, err = workpool.NewWorkPool(10)
 			Expect(err).NotTo(HaveOccurred())
 
+			tempDir, err = ioutil.TempDir("", "transformer")
+			Expect(err).NotTo(HaveOccurred())
+
 			clock = fakeclock.NewFakeClock(time.Now())
 
+			cachedDownloader = &cdfakes.FakeCachedDownloader{}
+			cachedDownloader.FetchReturns(ioutil.NopCloser(new(bytes.Buffer)), 42, nil)
+			fakeUploader = &fake_uploader.FakeUploader{}
+			downloadLimiter = make(chan struct{}, 1)
+			uploadLimiter = make(chan struct{}, 1)
+
 			cfg = transformer.Config{
 				BindMounts: []garden.BindMount{
 					{
@@ -106,8 +130,11 @@ var _ = Describe("Transformer", func() {
 		JustBeforeEach(func() {
 			optimusPrime = transformer.NewTransformer(
 				clock,
-				nil, nil, nil, nil, nil,
-				os.TempDir(),
+				cachedDownloader,
+				fakeUploader, nil,
+				downloadLimiter,
+				uploadLimiter,
+				tempDir,
 				healthyMonitoringInterval,
 				unhealthyMonitoringInterval,
 				gracefulShutdownInterval,
@@ -116,6 +143,10 @@ var _ = Describe("Transformer", func() {
 			)
 		})
 
+		AfterEach(func() {
+			os.RemoveAll(tempDir)
+		})
+
 		Context("when there is no run action", func() {
 			BeforeEach(func() {
 				container.Action = nil
@@ -127,6 +158,46 @@ var _ = Describe("Transformer", func() {
 			})
 		})
 
+		Context("when the action is of an unknown type", func() {
+			BeforeEach(func() {
+				container.Action = &models.Action{}
+			})
+
+			It("returns an error", func() {
+				_, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+				Expect(err).To(MatchError(ContainSubstring("unknown action")))
+			})
+		})
+
+		Context("when a nested action is of an unknown type", func() {
+			BeforeEach(func() {
+				container.Setup = &models.Action{
+					SerialAction: &models.SerialAction{
+						Actions: []*models.Action{
+							{RunAction: &models.RunAction{Path: "/setup/path"}},
+							{},
+						},
+					},
+				}
+			})
+
+			It("returns an error", func() {
+				_, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+				Expect(err).To(MatchError(ContainSubstring("unknown action")))
+			})
+		})
+
+		Context("when the monitor action is of an unknown type", func() {
+			BeforeEach(func() {
+				container.Monitor = &models.Action{}
+			})
+
+			It("returns an error", func() {
+				_, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+				Expect(err).To(MatchError(ContainSubstring("unknown action")))
+			})
+		})
+
 		It("returns a step encapsulating setup, post-setup, action, and monitor", func() {
 			setupReceived := make(chan struct{})
 			postSetupReceived := make(chan struct{})
@@ -1418,6 +1489,866 @@ var _ = Describe("Transformer", func() {
 			})
 		})
 
+		Context("DownloadAction", func() {
+			BeforeEach(func() {
+				container.Monitor = nil
+				container.Setup = &models.Action{
+					DownloadAction: &models.DownloadAction{
+						From:              "http://example.com/droplet.tgz",
+						To:                "/tmp/droplet",
+						CacheKey:          "droplet-cache-key",
+						ChecksumAlgorithm: "sha256",
+						ChecksumValue:     "some-checksum-value",
+					},
+				}
+			})
+
+			It("passes the checksum through to the cached downloader", func() {
+				runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+				Expect(err).NotTo(HaveOccurred())
+
+				process := ifrit.Background(runner)
+				defer ginkgomon.Interrupt(process)
+
+				Eventually(cachedDownloader.FetchCallCount).Should(Equal(1))
+				_, url, cacheKey, checksum, _ := cachedDownloader.FetchArgsForCall(0)
+				Expect(url.String()).To(Equal("http://example.com/droplet.tgz"))
+				Expect(cacheKey).To(Equal("droplet-cache-key"))
+				Expect(checksum).To(Equal(cacheddownloader.ChecksumInfoType{
+					Algorithm: "sha256",
+					Value:     "some-checksum-value",
+				}))
+			})
+
+			Context("when the runner is signalled while the download is in flight", func() {
+				var fetchCancelled chan struct{}
+
+				BeforeEach(func() {
+					fetchCancelled = make(chan struct{})
+					cachedDownloader.FetchStub = func(_ lager.Logger, _ *url.URL, _ string, _ cacheddownloader.ChecksumInfoType, cancelChan <-chan struct{}) (io.ReadCloser, int64, error) {
+						<-cancelChan
+						close(fetchCancelled)
+						return nil, 0, errors.New("download cancelled")
+					}
+				})
+
+				It("cancels the download and does not run the action", func() {
+					runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+					Expect(err).NotTo(HaveOccurred())
+
+					process := ifrit.Background(runner)
+					Eventually(cachedDownloader.FetchCallCount).Should(Equal(1))
+
+					process.Signal(os.Interrupt)
+					Eventually(fetchCancelled).Should(BeClosed())
+					Eventually(process.Wait()).Should(Receive(HaveOccurred()))
+					Expect(gardenContainer.RunCallCount()).To(Equal(0))
+				})
+			})
+
+			Context("when transfer retries are enabled", func() {
+				BeforeEach(func() {
+					options = append(options, transformer.WithTransferRetries(2, time.Second))
+					cachedDownloader.FetchStub = func(lager.Logger, *url.URL, string, cacheddownloader.ChecksumInfoType, <-chan struct{}) (io.ReadCloser, int64, error) {
+						if cachedDownloader.FetchCallCount() == 1 {
+							return nil, 0, errors.New("download failed")
+						}
+						return ioutil.NopCloser(new(bytes.Buffer)), 42, nil
+					}
+				})
+
+				It("retries the failed download after the backoff", func() {
+					runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+					Expect(err).NotTo(HaveOccurred())
+
+					process := ifrit.Background(runner)
+					defer ginkgomon.Interrupt(process)
+
+					Eventually(cachedDownloader.FetchCallCount).Should(Equal(1))
+					Consistently(cachedDownloader.FetchCallCount).Should(Equal(1))
+
+					clock.WaitForWatcherAndIncrement(time.Second)
+					Eventually(cachedDownloader.FetchCallCount).Should(Equal(2))
+					Eventually(gardenContainer.RunCallCount).Should(Equal(1))
+				})
+			})
+		})
+
+		Context("when the runner is signalled in the middle of a serial action", func() {
+			var firstProcess *gardenfakes.FakeProcess
+
+			BeforeEach(func() {
+				container.Monitor = nil
+				container.Setup = &models.Action{
+					SerialAction: models.Serial(
+						&models.RunAction{Path: "/first/path"},
+						&models.RunAction{Path: "/second/path"},
+					),
+				}
+
+				exitCh := make(chan int, 1)
+				firstProcess = &gardenfakes.FakeProcess{}
+				firstProcess.WaitStub = func() (int, error) {
+					return <-exitCh, nil
+				}
+				firstProcess.SignalStub = func(garden.Signal) error {
+					select {
+					case exitCh <- 143:
+					default:
+					}
+					return nil
+				}
+
+				gardenContainer.RunStub = func(processSpec garden.ProcessSpec, processIO garden.ProcessIO) (garden.Process, error) {
+					if processSpec.Path == "/first/path" {
+						return firstProcess, nil
+					}
+					return &gardenfakes.FakeProcess{}, nil
+				}
+			})
+
+			It("interrupts the running step and skips the remaining steps", func() {
+				runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+				Expect(err).NotTo(HaveOccurred())
+
+				process := ifrit.Background(runner)
+				Eventually(gardenContainer.RunCallCount).Should(Equal(1))
+
+				process.Signal(os.Interrupt)
+				Eventually(firstProcess.SignalCallCount).Should(Equal(1))
+				Eventually(process.Wait()).Should(Receive(HaveOccurred()))
+
+				Expect(gardenContainer.RunCallCount()).To(Equal(1))
+				processSpec, _ := gardenContainer.RunArgsForCall(0)
+				Expect(processSpec.Path).To(Equal("/first/path"))
+			})
+		})
+
+		Context("UploadAction", func() {
+			var streamOutBarrier chan struct{}
+
+			containerTempDirs := func() []string {
+				dirs, err := filepath.Glob(filepath.Join(tempDir, container.Guid+"-*"))
+				Expect(err).NotTo(HaveOccurred())
+				return dirs
+			}
+
+			BeforeEach(func() {
+				container.Guid = fmt.Sprintf("upload-container-guid-%d", GinkgoParallelNode())
+				container.Monitor = nil
+				container.Setup = &models.Action{
+					UploadAction: &models.UploadAction{From: "/tmp/artifact", To: "http://example.com/artifact"},
+				}
+
+				streamOutBarrier = make(chan struct{})
+				gardenContainer.StreamOutStub = func(garden.StreamOutSpec) (io.ReadCloser, error) {
+					<-streamOutBarrier
+					return nil, errors.New("stream-out-failed")
+				}
+			})
+
+			It("uses a temp dir scoped to the container", func() {
+				runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+				Expect(err).NotTo(HaveOccurred())
+
+				process := ifrit.Background(runner)
+
+				Eventually(gardenContainer.StreamOutCallCount).Should(Equal(1))
+				Expect(containerTempDirs()).To(HaveLen(1))
+				Expect(containerTempDirs()[0]).To(BeADirectory())
+
+				close(streamOutBarrier)
+				Eventually(process.Wait()).Should(Receive(HaveOccurred()))
+			})
+
+			Context("when the container has no guid", func() {
+				BeforeEach(func() {
+					container.Guid = ""
+				})
+
+				It("still uses a temp dir of its own instead of the shared one", func() {
+					runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+					Expect(err).NotTo(HaveOccurred())
+
+					process := ifrit.Background(runner)
+
+					Eventually(gardenContainer.StreamOutCallCount).Should(Equal(1))
+					dirs := containerTempDirs()
+					Expect(dirs).To(HaveLen(1))
+					Expect(dirs[0]).To(BeADirectory())
+					Expect(filepath.Dir(dirs[0])).To(Equal(tempDir))
+
+					close(streamOutBarrier)
+					Eventually(process.Wait()).Should(Receive(HaveOccurred()))
+					Expect(tempDir).To(BeADirectory())
+				})
+			})
+
+			Context("when the artifact can be streamed out", func() {
+				BeforeEach(func() {
+					gardenContainer.StreamOutStub = func(garden.StreamOutSpec) (io.ReadCloser, error) {
+						buffer := new(bytes.Buffer)
+						tarWriter := tar.NewWriter(buffer)
+						err := tarWriter.WriteHeader(&tar.Header{Name: "artifact", Size: int64(len("contents"))})
+						Expect(err).NotTo(HaveOccurred())
+						_, err = tarWriter.Write([]byte("contents"))
+						Expect(err).NotTo(HaveOccurred())
+						Expect(tarWriter.Close()).To(Succeed())
+						return ioutil.NopCloser(buffer), nil
+					}
+				})
+
+				It("uploads the artifact from a temp file", func() {
+					runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+					Expect(err).NotTo(HaveOccurred())
+
+					process := ifrit.Background(runner)
+					defer ginkgomon.Interrupt(process)
+
+					Eventually(fakeUploader.UploadCallCount).Should(Equal(1))
+					Expect(fakeUploader.UploadStreamCallCount()).To(Equal(0))
+				})
+
+				Context("when streaming uploads are enabled", func() {
+					BeforeEach(func() {
+						options = append(options, transformer.WithStreamingUploads())
+					})
+
+					It("streams the artifact into the uploader", func() {
+						runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+						Expect(err).NotTo(HaveOccurred())
+
+						process := ifrit.Background(runner)
+						defer ginkgomon.Interrupt(process)
+
+						Eventually(fakeUploader.UploadStreamCallCount).Should(Equal(1))
+						Expect(fakeUploader.UploadCallCount()).To(Equal(0))
+
+						_, destinationURL, _ := fakeUploader.UploadStreamArgsForCall(0)
+						Expect(destinationURL.String()).To(Equal("http://example.com/artifact"))
+					})
+				})
+			})
+
+			It("removes the container temp dir once the steps exit", func() {
+				runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+				Expect(err).NotTo(HaveOccurred())
+
+				process := ifrit.Background(runner)
+
+				Eventually(gardenContainer.StreamOutCallCount).Should(Equal(1))
+				Expect(containerTempDirs()).To(HaveLen(1))
+
+				close(streamOutBarrier)
+				Eventually(process.Wait()).Should(Receive(HaveOccurred()))
+				Expect(containerTempDirs()).To(BeEmpty())
+				Expect(tempDir).To(BeADirectory())
+			})
+
+			It("leaves the temp dirs of other containers alone", func() {
+				otherDir := filepath.Join(tempDir, "other-container-guid-1234")
+				Expect(os.MkdirAll(otherDir, 0755)).To(Succeed())
+
+				runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+				Expect(err).NotTo(HaveOccurred())
+
+				process := ifrit.Background(runner)
+
+				Eventually(gardenContainer.StreamOutCallCount).Should(Equal(1))
+				close(streamOutBarrier)
+				Eventually(process.Wait()).Should(Receive(HaveOccurred()))
+
+				Expect(containerTempDirs()).To(BeEmpty())
+				Expect(otherDir).To(BeADirectory())
+			})
+
+			Context("when the steps cannot be built", func() {
+				BeforeEach(func() {
+					container.Action = &models.Action{}
+				})
+
+				It("removes the temp dir it created", func() {
+					_, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+					Expect(err).To(HaveOccurred())
+
+					Expect(containerTempDirs()).To(BeEmpty())
+				})
+			})
+		})
+
+		Context("SerialAction nested in a ParallelAction", func() {
+			var (
+				exitChs  map[string]chan int
+				runPaths chan string
+			)
+
+			BeforeEach(func() {
+				container.Setup = nil
+				container.Monitor = nil
+				container.Action = &models.Action{
+					ParallelAction: models.Parallel(
+						models.Serial(
+							&models.RunAction{Path: "/first/path"},
+							models.Serial(
+								&models.RunAction{Path: "/second/path"},
+							),
+						),
+						&models.RunAction{Path: "/sibling/path"},
+					),
+				}
+
+				exitChs = map[string]chan int{
+					"/first/path":   make(chan int, 1),
+					"/second/path":  make(chan int, 1),
+					"/sibling/path": make(chan int, 1),
+				}
+				runPaths = make(chan string, 3)
+				gardenContainer.RunStub = func(processSpec garden.ProcessSpec, processIO garden.ProcessIO) (garden.Process, error) {
+					exitCh := exitChs[processSpec.Path]
+					process := &gardenfakes.FakeProcess{}
+					process.WaitStub = func() (int, error) {
+						return <-exitCh, nil
+					}
+					runPaths <- processSpec.Path
+					return process, nil
+				}
+			})
+
+			It("runs the nested actions in order alongside the sibling action", func() {
+				runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+				Expect(err).NotTo(HaveOccurred())
+
+				process := ifrit.Background(runner)
+
+				var firstPath, secondPath string
+				Eventually(runPaths).Should(Receive(&firstPath))
+				Eventually(runPaths).Should(Receive(&secondPath))
+				Expect([]string{firstPath, secondPath}).To(ConsistOf("/first/path", "/sibling/path"))
+				Consistently(runPaths).ShouldNot(Receive())
+
+				exitChs["/first/path"] <- 0
+				Eventually(runPaths).Should(Receive(Equal("/second/path")))
+
+				exitChs["/second/path"] <- 0
+				exitChs["/sibling/path"] <- 0
+				Eventually(process.Wait()).Should(Receive(BeNil()))
+			})
+		})
+
+		Context("ParallelAction with multiple uploads", func() {
+			var streamOutBarrier chan struct{}
+
+			BeforeEach(func() {
+				container.Setup = nil
+				container.Monitor = nil
+				container.Action = &models.Action{
+					ParallelAction: models.Parallel(
+						&models.UploadAction{From: "/tmp/artifact-1", To: "http://example.com/1"},
+						&models.UploadAction{From: "/tmp/artifact-2", To: "http://example.com/2"},
+					),
+				}
+
+				streamOutBarrier = make(chan struct{})
+				gardenContainer.StreamOutStub = func(garden.StreamOutSpec) (io.ReadCloser, error) {
+					<-streamOutBarrier
+					return nil, errors.New("stream-out-failed")
+				}
+			})
+
+			It("limits the number of uploads in flight to the upload limiter capacity", func() {
+				runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+				Expect(err).NotTo(HaveOccurred())
+
+				process := ifrit.Background(runner)
+
+				Eventually(gardenContainer.StreamOutCallCount).Should(Equal(1))
+				Consistently(gardenContainer.StreamOutCallCount).Should(Equal(1))
+
+				streamOutBarrier <- struct{}{}
+				Eventually(gardenContainer.StreamOutCallCount).Should(Equal(2))
+
+				streamOutBarrier <- struct{}{}
+				Eventually(process.Wait()).Should(Receive(HaveOccurred()))
+			})
+		})
+
+		Context("ParallelAction", func() {
+			var (
+				serverProcess *gardenfakes.FakeProcess
+				serverExitCh  chan int
+			)
+
+			BeforeEach(func() {
+				container.Setup = nil
+				container.Monitor = nil
+				container.Action = &models.Action{
+					ParallelAction: models.Parallel(
+						&models.RunAction{Path: "/server/path"},
+						&models.RunAction{Path: "/failing/path"},
+					),
+				}
+
+				serverExitCh = make(chan int, 2)
+				serverProcess = &gardenfakes.FakeProcess{}
+				serverProcess.WaitStub = func() (int, error) {
+					return <-serverExitCh, nil
+				}
+				serverProcess.SignalStub = func(garden.Signal) error {
+					select {
+					case serverExitCh <- 143:
+					default:
+					}
+					return nil
+				}
+
+				failingProcess := &gardenfakes.FakeProcess{}
+				failingProcess.WaitReturns(1, nil)
+
+				gardenContainer.RunStub = func(processSpec garden.ProcessSpec, processIO garden.ProcessIO) (garden.Process, error) {
+					if processSpec.Path == "/server/path" {
+						return serverProcess, nil
+					}
+					return failingProcess, nil
+				}
+			})
+
+			It("waits for all of the actions when one of them fails", func() {
+				runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+				Expect(err).NotTo(HaveOccurred())
+
+				process := ifrit.Background(runner)
+
+				Eventually(gardenContainer.RunCallCount).Should(Equal(2))
+				Consistently(process.Wait()).ShouldNot(Receive())
+				Expect(serverProcess.SignalCallCount()).To(Equal(0))
+
+				serverExitCh <- 0
+				Eventually(process.Wait()).Should(Receive(HaveOccurred()))
+			})
+
+			Context("when fail fast parallel actions are enabled", func() {
+				BeforeEach(func() {
+					options = append(options, transformer.WithFailFastParallelActions())
+				})
+
+				It("runs the actions concurrently", func() {
+					runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+					Expect(err).NotTo(HaveOccurred())
+
+					process := ifrit.Background(runner)
+
+					Eventually(gardenContainer.RunCallCount).Should(Equal(2))
+					var paths []string
+					for i := 0; i < gardenContainer.RunCallCount(); i++ {
+						processSpec, _ := gardenContainer.RunArgsForCall(i)
+						paths = append(paths, processSpec.Path)
+					}
+					Expect(paths).To(ConsistOf("/server/path", "/failing/path"))
+
+					Eventually(process.Wait()).Should(Receive(HaveOccurred()))
+				})
+
+				It("cancels the remaining actions and returns the first error", func() {
+					runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+					Expect(err).NotTo(HaveOccurred())
+
+					process := ifrit.Background(runner)
+
+					Eventually(serverProcess.SignalCallCount).Should(Equal(1))
+					Expect(serverProcess.SignalArgsForCall(0)).To(Equal(garden.SignalTerminate))
+
+					var waitErr error
+					Eventually(process.Wait()).Should(Receive(&waitErr))
+					Expect(waitErr).To(MatchError(ContainSubstring("Exited with status 1")))
+				})
+			})
+		})
+
+		Context("TimeoutAction", func() {
+			var (
+				runProcess *gardenfakes.FakeProcess
+				exitCh     chan int
+			)
+
+			BeforeEach(func() {
+				container.Setup = nil
+				container.Monitor = nil
+				container.Action = &models.Action{
+					TimeoutAction: models.Timeout(
+						&models.RunAction{Path: "/action/path"},
+						5*time.Second,
+					),
+				}
+
+				exitCh = make(chan int, 1)
+				runProcess = &gardenfakes.FakeProcess{}
+				runProcess.WaitStub = func() (int, error) {
+					return <-exitCh, nil
+				}
+				runProcess.SignalStub = func(garden.Signal) error {
+					select {
+					case exitCh <- 143:
+					default:
+					}
+					return nil
+				}
+				gardenContainer.RunReturns(runProcess, nil)
+			})
+
+			It("runs the wrapped action", func() {
+				runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+				Expect(err).NotTo(HaveOccurred())
+
+				process := ifrit.Background(runner)
+
+				Eventually(gardenContainer.RunCallCount).Should(Equal(1))
+				processSpec, _ := gardenContainer.RunArgsForCall(0)
+				Expect(processSpec.Path).To(Equal("/action/path"))
+
+				exitCh <- 0
+				Eventually(process.Wait()).Should(Receive(BeNil()))
+			})
+
+			It("cancels the wrapped action once the timeout elapses", func() {
+				runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+				Expect(err).NotTo(HaveOccurred())
+
+				process := ifrit.Background(runner)
+
+				Eventually(gardenContainer.RunCallCount).Should(Equal(1))
+				Consistently(runProcess.SignalCallCount).Should(Equal(0))
+
+				clock.WaitForWatcherAndIncrement(5 * time.Second)
+
+				Eventually(runProcess.SignalCallCount).Should(Equal(1))
+				Expect(runProcess.SignalArgsForCall(0)).To(Equal(garden.SignalTerminate))
+
+				var waitErr error
+				Eventually(process.Wait()).Should(Receive(&waitErr))
+				Expect(waitErr).To(MatchError(ContainSubstring("exceeded 5s timeout")))
+			})
+		})
+
+		Context("when a base environment is configured", func() {
+			BeforeEach(func() {
+				options = append(options, transformer.WithBaseEnvironment([]*models.EnvironmentVariable{
+					{Name: "SHARED", Value: "base"},
+					{Name: "BASE_ONLY", Value: "base"},
+				}))
+
+				container.Setup = nil
+				container.Monitor = nil
+				container.Action = &models.Action{
+					RunAction: &models.RunAction{
+						Path: "/action/path",
+						Env: []*models.EnvironmentVariable{
+							{Name: "SHARED", Value: "action"},
+							{Name: "ACTION_ONLY", Value: "action"},
+						},
+					},
+				}
+			})
+
+			It("merges it into the environment of the run actions", func() {
+				runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+				Expect(err).NotTo(HaveOccurred())
+
+				process := ifrit.Background(runner)
+				defer ginkgomon.Interrupt(process)
+
+				Eventually(gardenContainer.RunCallCount).Should(Equal(1))
+				processSpec, _ := gardenContainer.RunArgsForCall(0)
+				Expect(processSpec.Path).To(Equal("/action/path"))
+				Expect(processSpec.Env).To(ContainElement("BASE_ONLY=base"))
+				Expect(processSpec.Env).To(ContainElement("ACTION_ONLY=action"))
+				Expect(processSpec.Env).To(ContainElement("SHARED=action"))
+				Expect(processSpec.Env).NotTo(ContainElement("SHARED=base"))
+			})
+		})
+
+		Context("when step log source tags are enabled", func() {
+			BeforeEach(func() {
+				options = append(options, transformer.WithStepLogSourceTags())
+
+				container.Monitor = nil
+				container.Setup = &models.Action{
+					DownloadAction: &models.DownloadAction{
+						Artifact: "droplet",
+						From:     "http://example.com/droplet.tgz",
+						To:       "/tmp/droplet",
+						CacheKey: "droplet-cache-key",
+					},
+				}
+
+				gardenContainer.RunStub = func(processSpec garden.ProcessSpec, processIO garden.ProcessIO) (garden.Process, error) {
+					fmt.Fprintln(processIO.Stdout, "hello from", processSpec.Path)
+					process := &gardenfakes.FakeProcess{}
+					process.WaitReturns(0, nil)
+					return process, nil
+				}
+			})
+
+			logSources := func() []string {
+				sources := []string{}
+				for i := 0; i < fakeMetronClient.SendAppLogCallCount(); i++ {
+					_, _, source, _ := fakeMetronClient.SendAppLogArgsForCall(i)
+					sources = append(sources, source)
+				}
+				return sources
+			}
+
+			It("tags the output of every step with its action type", func() {
+				runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+				Expect(err).NotTo(HaveOccurred())
+
+				process := ifrit.Background(runner)
+				Eventually(process.Wait()).Should(Receive(BeNil()))
+
+				Expect(logSources()).To(ContainElement("test:download"))
+				Expect(logSources()).To(ContainElement("test:run"))
+				Expect(logSources()).NotTo(ContainElement("test"))
+			})
+
+			Context("when an action has its own log source", func() {
+				BeforeEach(func() {
+					container.Action.RunAction.LogSource = "APP"
+				})
+
+				It("keeps it", func() {
+					runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+					Expect(err).NotTo(HaveOccurred())
+
+					process := ifrit.Background(runner)
+					Eventually(process.Wait()).Should(Receive(BeNil()))
+
+					Expect(logSources()).To(ContainElement("test:download"))
+					Expect(logSources()).To(ContainElement("APP"))
+					Expect(logSources()).NotTo(ContainElement("test:run"))
+				})
+			})
+		})
+
+		Context("when a max file descriptor limit is configured", func() {
+			var requestedNofile uint64
+
+			BeforeEach(func() {
+				options = append(options, transformer.WithMaxFileDescriptors(1024))
+
+				container.Setup = nil
+				container.Monitor = nil
+			})
+
+			JustBeforeEach(func() {
+				container.Action = &models.Action{
+					RunAction: &models.RunAction{
+						Path:           "/action/path",
+						ResourceLimits: &models.ResourceLimits{Nofile: &requestedNofile},
+					},
+				}
+			})
+
+			Context("when a run action requests more file descriptors", func() {
+				BeforeEach(func() {
+					requestedNofile = 4096
+				})
+
+				It("clamps the limit and logs it", func() {
+					runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+					Expect(err).NotTo(HaveOccurred())
+
+					process := ifrit.Background(runner)
+					defer ginkgomon.Interrupt(process)
+
+					Eventually(gardenContainer.RunCallCount).Should(Equal(1))
+					processSpec, _ := gardenContainer.RunArgsForCall(0)
+					Expect(*processSpec.Limits.Nofile).To(Equal(uint64(1024)))
+					Expect(requestedNofile).To(Equal(uint64(4096)))
+					Expect(logger.(*lagertest.TestLogger)).To(gbytes.Say("clamping-file-descriptors"))
+				})
+			})
+
+			Context("when a run action requests fewer file descriptors", func() {
+				BeforeEach(func() {
+					requestedNofile = 117
+				})
+
+				It("leaves the limit alone", func() {
+					runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+					Expect(err).NotTo(HaveOccurred())
+
+					process := ifrit.Background(runner)
+					defer ginkgomon.Interrupt(process)
+
+					Eventually(gardenContainer.RunCallCount).Should(Equal(1))
+					processSpec, _ := gardenContainer.RunArgsForCall(0)
+					Expect(*processSpec.Limits.Nofile).To(Equal(uint64(117)))
+					Expect(logger.(*lagertest.TestLogger)).NotTo(gbytes.Say("clamping-file-descriptors"))
+				})
+			})
+		})
+
+		Context("when a progress sink is configured", func() {
+			var progressSink *faketransformer.FakeProgressSink
+
+			BeforeEach(func() {
+				progressSink = &faketransformer.FakeProgressSink{}
+				options = append(options, transformer.WithProgressSink(progressSink))
+
+				container.Guid = "some-container-guid"
+				container.Monitor = nil
+
+				failingProcess := &gardenfakes.FakeProcess{}
+				failingProcess.WaitReturns(1, nil)
+				gardenContainer.RunStub = func(processSpec garden.ProcessSpec, processIO garden.ProcessIO) (garden.Process, error) {
+					if processSpec.Path == "/action/path" {
+						return failingProcess, nil
+					}
+					return &gardenfakes.FakeProcess{}, nil
+				}
+			})
+
+			It("emits an event for every transition of the setup and action steps", func() {
+				runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+				Expect(err).NotTo(HaveOccurred())
+
+				process := ifrit.Background(runner)
+				Eventually(process.Wait()).Should(Receive(HaveOccurred()))
+
+				Expect(progressSink.EmitCallCount()).To(Equal(4))
+				Expect(progressSink.EmitArgsForCall(0)).To(Equal(transformer.ProgressEvent{
+					ContainerGuid: "some-container-guid",
+					StepIndex:     0,
+					ActionType:    models.ActionTypeRun,
+					State:         transformer.ProgressStateStarted,
+				}))
+				Expect(progressSink.EmitArgsForCall(1)).To(Equal(transformer.ProgressEvent{
+					ContainerGuid: "some-container-guid",
+					StepIndex:     0,
+					ActionType:    models.ActionTypeRun,
+					State:         transformer.ProgressStateSucceeded,
+				}))
+				Expect(progressSink.EmitArgsForCall(2)).To(Equal(transformer.ProgressEvent{
+					ContainerGuid: "some-container-guid",
+					StepIndex:     1,
+					ActionType:    models.ActionTypeRun,
+					State:         transformer.ProgressStateStarted,
+				}))
+				Expect(progressSink.EmitArgsForCall(3)).To(Equal(transformer.ProgressEvent{
+					ContainerGuid: "some-container-guid",
+					StepIndex:     1,
+					ActionType:    models.ActionTypeRun,
+					State:         transformer.ProgressStateFailed,
+				}))
+			})
+		})
+
+		Context("EmitProgressAction", func() {
+			BeforeEach(func() {
+				container.Monitor = nil
+				container.Setup = &models.Action{
+					EmitProgressAction: models.EmitProgressFor(
+						&models.RunAction{Path: "/setup/path"},
+						"starting setup",
+						"setup succeeded",
+						"setup failed",
+					),
+				}
+			})
+
+			Context("with an emit progress metadata callback", func() {
+				var metadataCh chan steps.ProgressMetadata
+
+				BeforeEach(func() {
+					metadataCh = make(chan steps.ProgressMetadata, 1)
+					options = append(options, transformer.WithEmitProgressMetadata(func(metadata steps.ProgressMetadata) {
+						metadataCh <- metadata
+					}))
+				})
+
+				It("reports the outcome of the wrapped action", func() {
+					runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+					Expect(err).NotTo(HaveOccurred())
+
+					process := ifrit.Background(runner)
+					defer ginkgomon.Interrupt(process)
+
+					var metadata steps.ProgressMetadata
+					Eventually(metadataCh).Should(Receive(&metadata))
+					Expect(metadata.Succeeded).To(BeTrue())
+					Expect(metadata.Error).To(BeEmpty())
+				})
+			})
+		})
+
+		Context("CodependentAction", func() {
+			var (
+				serverProcess *gardenfakes.FakeProcess
+				serverExitCh  chan int
+			)
+
+			BeforeEach(func() {
+				container.Setup = nil
+				container.Monitor = nil
+				container.Action = &models.Action{
+					CodependentAction: models.Codependent(
+						&models.RunAction{Path: "/server/path"},
+						&models.RunAction{Path: "/probe/path"},
+					),
+				}
+
+				serverExitCh = make(chan int, 2)
+				serverProcess = &gardenfakes.FakeProcess{}
+				serverProcess.WaitStub = func() (int, error) {
+					return <-serverExitCh, nil
+				}
+				serverProcess.SignalStub = func(garden.Signal) error {
+					select {
+					case serverExitCh <- 143:
+					default:
+					}
+					return nil
+				}
+
+				gardenContainer.RunStub = func(processSpec garden.ProcessSpec, processIO garden.ProcessIO) (garden.Process, error) {
+					if processSpec.Path == "/server/path" {
+						return serverProcess, nil
+					}
+					return &gardenfakes.FakeProcess{}, nil
+				}
+			})
+
+			It("runs the actions concurrently", func() {
+				runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+				Expect(err).NotTo(HaveOccurred())
+
+				process := ifrit.Background(runner)
+
+				Eventually(gardenContainer.RunCallCount).Should(Equal(2))
+				var paths []string
+				for i := 0; i < gardenContainer.RunCallCount(); i++ {
+					processSpec, _ := gardenContainer.RunArgsForCall(i)
+					paths = append(paths, processSpec.Path)
+				}
+				Expect(paths).To(ConsistOf("/server/path", "/probe/path"))
+
+				Eventually(process.Wait()).Should(Receive(HaveOccurred()))
+			})
+
+			It("signals the remaining actions when one of them exits", func() {
+				runner, err := optimusPrime.StepsRunner(logger, container, gardenContainer, logStreamer, cfg)
+				Expect(err).NotTo(HaveOccurred())
+
+				process := ifrit.Background(runner)
+
+				Eventually(serverProcess.SignalCallCount).Should(Equal(1))
+				Expect(serverProcess.SignalArgsForCall(0)).To(Equal(garden.SignalTerminate))
+
+				var waitErr error
+				Eventually(process.Wait()).Should(Receive(&waitErr))
+				Expect(waitErr).To(MatchError(ContainSubstring("Codependent step exited")))
+			})
+		})
+
 		Context("MonitorAction", func() {
 			var (
 				process ifrit.Process
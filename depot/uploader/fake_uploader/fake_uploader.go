@@ -2,6 +2,7 @@
 package fake_uploader
 
 import (
+	"io"
 	"net/url"
 	"sync"
 
@@ -20,6 +21,17 @@ type FakeUploader struct {
 		result1 int64
 		result2 error
 	}
+	UploadStreamStub        func(source io.Reader, destinationUrl *url.URL, cancel <-chan struct{}) (int64, error)
+	uploadStreamMutex       sync.RWMutex
+	uploadStreamArgsForCall []struct {
+		source         io.Reader
+		destinationUrl *url.URL
+		cancel         <-chan struct{}
+	}
+	uploadStreamReturns struct {
+		result1 int64
+		result2 error
+	}
 }
 
 func (fake *FakeUploader) Upload(fileLocation string, destinationUrl *url.URL, cancel <-chan struct{}) (int64, error) {
@@ -57,4 +69,39 @@ func (fake *FakeUploader) UploadReturns(result1 int64, result2 error) {
 	}{result1, result2}
 }
 
+func (fake *FakeUploader) UploadStream(source io.Reader, destinationUrl *url.URL, cancel <-chan struct{}) (int64, error) {
+	fake.uploadStreamMutex.Lock()
+	fake.uploadStreamArgsForCall = append(fake.uploadStreamArgsForCall, struct {
+		source         io.Reader
+		destinationUrl *url.URL
+		cancel         <-chan struct{}
+	}{source, destinationUrl, cancel})
+	fake.uploadStreamMutex.Unlock()
+	if fake.UploadStreamStub != nil {
+		return fake.UploadStreamStub(source, destinationUrl, cancel)
+	} else {
+		return fake.uploadStreamReturns.result1, fake.uploadStreamReturns.result2
+	}
+}
+
+func (fake *FakeUploader) UploadStreamCallCount() int {
+	fake.uploadStreamMutex.RLock()
+	defer fake.uploadStreamMutex.RUnlock()
+	return len(fake.uploadStreamArgsForCall)
+}
+
+func (fake *FakeUploader) UploadStreamArgsForCall(i int) (io.Reader, *url.URL, <-chan struct{}) {
+	fake.uploadStreamMutex.RLock()
+	defer fake.uploadStreamMutex.RUnlock()
+	return fake.uploadStreamArgsForCall[i].source, fake.uploadStreamArgsForCall[i].destinationUrl, fake.uploadStreamArgsForCall[i].cancel
+}
+
+func (fake *FakeUploader) UploadStreamReturns(result1 int64, result2 error) {
+	fake.UploadStreamStub = nil
+	fake.uploadStreamReturns = struct {
+		result1 int64
+		result2 error
+	}{result1, result2}
+}
+
 var _ uploader.Uploader = new(FakeUploader)
@@ -21,6 +21,7 @@ var ErrUploadCancelled = errors.New("upload cancelled")
 
 type Uploader interface {
 	Upload(fileLocation string, destinationUrl *url.URL, cancel <-chan struct{}) (int64, error)
+	UploadStream(source io.Reader, destinationUrl *url.URL, cancel <-chan struct{}) (int64, error)
 }
 
 type URLUploader struct {
@@ -95,6 +96,49 @@ UPLOAD_ATTEMPTS:
 	return int64(bytesToUpload), nil
 }
 
+// UploadStream uploads source as it is read, without buffering it in a file
+// first. The stream cannot be replayed, so a failed upload is not retried.
+func (uploader *URLUploader) UploadStream(source io.Reader, url *url.URL, cancel <-chan struct{}) (int64, error) {
+	logger := uploader.logger.Session("upload-stream")
+
+	request, err := http.NewRequest("POST", url.String(), nil)
+	if err != nil {
+		logger.Error("somehow-failed-to-create-request", err)
+		return 0, err
+	}
+
+	body := &countingReader{reader: source}
+	request.Body = ioutil.NopCloser(body)
+	request.ContentLength = -1
+	request.Header.Set("Content-Type", "application/octet-stream")
+
+	logger.Info("uploading")
+	err = uploader.doUpload(request, cancel, logger)
+	switch err {
+	case nil:
+		logger.Info("succeeded-uploading")
+	case ErrUploadCancelled:
+		logger.Info("cancelled-uploading")
+		return 0, err
+	default:
+		logger.Error("failed-uploading", err)
+		return 0, err
+	}
+
+	return body.count, nil
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
 func (uploader *URLUploader) prepareFileForUpload(fileLocation string, logger lager.Logger) (*os.File, int64, string, error) {
 	sourceFile, err := os.Open(fileLocation)
 	if err != nil {
@@ -144,6 +188,10 @@ func (uploader *URLUploader) attemptUpload(
 	request.Header.Set("Content-Type", "application/octet-stream")
 	request.Header.Set("Content-MD5", contentMD5)
 
+	return uploader.doUpload(request, cancelCh, logger)
+}
+
+func (uploader *URLUploader) doUpload(request *http.Request, cancelCh <-chan struct{}, logger lager.Logger) error {
 	var resp *http.Response
 	reqComplete := make(chan error)
 	go func() {
@@ -12,6 +12,7 @@ import (
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -221,6 +222,60 @@ var _ = Describe("Uploader", func() {
 		})
 	})
 
+	Describe("Streaming Upload", func() {
+		BeforeEach(func() {
+			upldr = uploader.New(logger, 100*time.Millisecond, nil)
+		})
+
+		Context("when the upload is successful", func() {
+			BeforeEach(func() {
+				testServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					serverRequests = append(serverRequests, r)
+
+					data, err := ioutil.ReadAll(r.Body)
+					Expect(err).NotTo(HaveOccurred())
+					serverRequestBody = append(serverRequestBody, string(data))
+
+					fmt.Fprintln(w, "Hello, client")
+				}))
+
+				serverUrl := testServer.URL + "/somepath"
+				url, _ = url.Parse(serverUrl)
+			})
+
+			It("uploads the stream to the url and returns the number of bytes read", func() {
+				numBytes, err := upldr.UploadStream(strings.NewReader("streamed content"), url, nil)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(numBytes).To(Equal(int64(len("streamed content"))))
+
+				Expect(serverRequests).To(HaveLen(1))
+				request := serverRequests[0]
+				Expect(request.URL.Path).To(Equal("/somepath"))
+				Expect(request.Header.Get("Content-Type")).To(Equal("application/octet-stream"))
+				Expect(request.Header.Get("Content-MD5")).To(BeEmpty())
+				Expect(serverRequestBody[0]).To(Equal("streamed content"))
+			})
+		})
+
+		Context("when the upload fails with a status code error", func() {
+			BeforeEach(func() {
+				testServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					serverRequests = append(serverRequests, r)
+					http.NotFound(w, r)
+				}))
+
+				serverUrl := testServer.URL + "/somepath"
+				url, _ = url.Parse(serverUrl)
+			})
+
+			It("returns the error without retrying", func() {
+				_, err := upldr.UploadStream(strings.NewReader("streamed content"), url, nil)
+				Expect(err).To(HaveOccurred())
+				Expect(serverRequests).To(HaveLen(1))
+			})
+		})
+	})
+
 	Describe("Secure Upload", func() {
 		Context("when the server supports tls", func() {
 			var (
@@ -266,7 +266,7 @@ func Initialize(logger lager.Logger, config ExecutorConfig, cellID string,
 		if err != nil {
 			logger.Error("failed-removing-container-proxy-config-path", err)
 		}
-		proxyConfigHandler = containerstore.NewProxyConfigHandler(
+		handler := containerstore.NewProxyConfigHandler(
 			logger,
 			config.ContainerProxyPath,
 			config.ContainerProxyConfigPath,
@@ -275,7 +275,14 @@ func Initialize(logger lager.Logger, config ExecutorConfig, cellID string,
 			config.ContainerProxyRequireClientCerts,
 			time.Duration(config.EnvoyConfigReloadDuration),
 			clock,
+			containerstore.WithMetronClient(metronClient),
 		)
+		err = handler.Validate()
+		if err != nil {
+			logger.Error("invalid-container-proxy-config", err)
+			return nil, nil, grouper.Members{}, err
+		}
+		proxyConfigHandler = handler
 	} else {
 		proxyConfigHandler = containerstore.NewNoopProxyConfigHandler()
 	}
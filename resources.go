@@ -34,6 +34,14 @@ type ProxyPortMapping struct {
 	ProxyPort uint16 `json:"proxy_port"`
 }
 
+// ProxyCluster is an upstream the container proxy can reach besides the
+// service clusters of the container ports.
+type ProxyCluster struct {
+	Name string `json:"name"`
+	Host string `json:"host"`
+	Port uint16 `json:"port"`
+}
+
 type Container struct {
 	Guid string `json:"guid"`
 	Resource
@@ -185,6 +193,28 @@ type RunInfo struct {
 	ImageUsername                 string                      `json:"image_username"`
 	ImagePassword                 string                      `json:"image_password"`
 	EnableContainerProxy          bool                        `json:"enable_container_proxy"`
+	// overrides whether the container proxy requires client certificates,
+	// the proxy config handler default applies when nil
+	ContainerProxyRequireClientCerts *bool `json:"container_proxy_require_client_certs,omitempty"`
+	// overrides the client certificate subject alt names the container proxy
+	// verifies, the proxy config handler default applies when empty
+	ContainerProxyVerifySubjectAltName []string `json:"container_proxy_verify_subject_alt_name,omitempty"`
+	// container port the platform health checks through the container proxy,
+	// its listener does not require client certificates
+	ContainerProxyHealthCheckPort uint16 `json:"container_proxy_health_check_port,omitempty"`
+	// further ips of the container the container proxy balances across
+	// together with the internal ip
+	AdditionalInternalIPs []string `json:"additional_internal_ips,omitempty"`
+	// static clusters added to the container proxy config next to the
+	// service clusters, e.g. for an external metrics collector
+	ContainerProxyExtraClusters []ProxyCluster `json:"container_proxy_extra_clusters,omitempty"`
+	// the cf app and process the container runs, the container proxy passes
+	// them on so its traffic can be attributed to them
+	AppGuid     string `json:"app_guid,omitempty"`
+	ProcessGuid string `json:"process_guid,omitempty"`
+	// overrides how long closing the container proxy waits for envoy to
+	// reload, the proxy config handler default applies when zero
+	ContainerProxyReloadDurationMs uint `json:"container_proxy_reload_duration_ms,omitempty"`
 }
 
 type BindMountMode uint8
@@ -244,6 +274,10 @@ type PortMapping struct {
 	HostPort              uint16 `json:"host_port,omitempty"`
 	ContainerTLSProxyPort uint16 `json:"container_tls_proxy_port,omitempty"`
 	HostTLSProxyPort      uint16 `json:"host_tls_proxy_port,omitempty"`
+	// the port is reached directly, without a container proxy listener
+	DisableContainerProxy bool `json:"disable_container_proxy,omitempty"`
+	// the container proxy listener passes connections on without terminating tls
+	PlaintextContainerProxy bool `json:"plaintext_container_proxy,omitempty"`
 }
 
 type ContainerRunResult struct {